@@ -38,6 +38,18 @@ func main() {
 		log.Fatalf("Failed to start grpc server on port %s with error: %v", port, err)
 	}
 
+	// The admin service lists, halts and delists markets and changes risk limits, so it never
+	// shares the public port: it gets its own listener, on loopback unless ADMIN_ADDR says otherwise
+	adminAddr := os.Getenv("ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = "127.0.0.1:50055"
+	}
+
+	adminLis, err := net.Listen("tcp", adminAddr)
+	if err != nil {
+		log.Fatalf("Failed to start admin grpc server on %s with error: %v", adminAddr, err)
+	}
+
 	var ops []grpc.ServerOption
 	grpcServer := grpc.NewServer(ops...)
 
@@ -45,14 +57,48 @@ func main() {
 
 	pb.RegisterMatchingEngineServer(grpcServer, matchingEngineServer)
 
-	symbols := []internal.Symbol{
-		{Name: "BTCUSD", StartingPrice: 90_000, MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000},
-		{Name: "SOLUSD", StartingPrice: 150, MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000},
-		{Name: "ETHUSD", StartingPrice: 3_510, MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000},
+	// Settings of symbols listed at runtime through the admin service
+	adminServer := &internal.AdminServer{
+		Defaults: internal.Symbol{MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000, SnapshotIntervalMM: 60_000, IdempotencyWindowSize: 100_000, DepthSnapshotIntervalMM: 1_000, L3Feed: true, TickerHeartbeatMM: 5_000, CircuitBreaker: internal.CircuitBreakerSpec{MaxMoveBps: 1_000, WindowMM: 300_000}},
+	}
+
+	adminGrpcServer := grpc.NewServer()
+	pb.RegisterMatchingEngineAdminServer(adminGrpcServer, adminServer)
+
+	// Seeds wal/symbols.json on the first start; after that the file is the list of markets
+	seedSymbols := []internal.Symbol{
+		{Name: "BTCUSD", StartingPrice: 90_000, MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000, SnapshotIntervalMM: 60_000, IdempotencyWindowSize: 100_000, DepthSnapshotIntervalMM: 1_000, L3Feed: true, TickerHeartbeatMM: 5_000, Instrument: internal.InstrumentSpec{TickSize: 1, LotSize: 1, MinQuantity: 1, MaxQuantity: 1_000_000, MinNotional: 10}, CircuitBreaker: internal.CircuitBreakerSpec{MaxMoveBps: 1_000, WindowMM: 300_000}},
+		{Name: "SOLUSD", StartingPrice: 150, MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000, SnapshotIntervalMM: 60_000, IdempotencyWindowSize: 100_000, DepthSnapshotIntervalMM: 1_000, L3Feed: true, TickerHeartbeatMM: 5_000, Instrument: internal.InstrumentSpec{TickSize: 1, LotSize: 1, MinQuantity: 1, MaxQuantity: 1_000_000, MinNotional: 10}, CircuitBreaker: internal.CircuitBreakerSpec{MaxMoveBps: 1_000, WindowMM: 300_000}},
+		{Name: "ETHUSD", StartingPrice: 3_510, MaxWalFileSize: 67_108_864, WalDir: "wal", WalSyncInterval: 400, WalShouldFsync: true, KafkaBatchSize: 300, KafkaEmitMM: 2000, SnapshotIntervalMM: 60_000, IdempotencyWindowSize: 100_000, DepthSnapshotIntervalMM: 1_000, L3Feed: true, TickerHeartbeatMM: 5_000, Instrument: internal.InstrumentSpec{TickSize: 1, LotSize: 1, MinQuantity: 1, MaxQuantity: 1_000_000, MinNotional: 10}, CircuitBreaker: internal.CircuitBreakerSpec{MaxMoveBps: 1_000, WindowMM: 300_000}},
+	}
+
+	if err := internal.LoadSelfTradePreventionDefaults("wal/stp_defaults.json"); err != nil {
+		log.Fatalf("Failed to load self-trade prevention defaults: %v", err)
+	}
+
+	if err := internal.LoadRiskLimits("wal/risk_limits.json"); err != nil {
+		log.Fatalf("Failed to load risk limits: %v", err)
+	}
+
+	symbols, err := internal.LoadSymbols("wal/symbols.json", seedSymbols)
+	if err != nil {
+		log.Fatalf("Failed to load listed symbols: %v", err)
 	}
 
 	internal.StartActors(symbols)
 
+	// After the actors: a countdown that ran out while the engine was down cancels right away
+	if err := internal.LoadCancelAllAfter("wal/cancel_all_after.json"); err != nil {
+		log.Fatalf("Failed to load cancel-all-after countdowns: %v", err)
+	}
+
+	go func() {
+		log.Printf("admin gRPC server listening at %v", adminLis.Addr())
+		if err := adminGrpcServer.Serve(adminLis); err != nil {
+			log.Fatalf("Failed to serve admin: %v", err)
+		}
+	}()
+
 	log.Printf("gRPC server listening at %v", lis.Addr())
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
@@ -1,9 +1,14 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
+	"sync"
+
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/status"
 )
 
 type Symbol struct {
@@ -15,77 +20,143 @@ type Symbol struct {
 	WalShouldFsync  bool
 	KafkaBatchSize  int
 	KafkaEmitMM     int
+
+	// SnapshotIntervalMM is how often the order book is snapshotted; 0 disables snapshots.
+	SnapshotIntervalMM int
+
+	// IdempotencyWindowSize is how many recent order / modify ids are remembered for retries.
+	IdempotencyWindowSize int
+
+	// Instrument is the tick / lot size and quantity rules orders are checked against.
+	Instrument InstrumentSpec
+
+	// CircuitBreaker halts the symbol on a sharp price move; a zero spec disables it.
+	CircuitBreaker CircuitBreakerSpec
+
+	// Matching is FIFO, pro-rata or top order then pro-rata; a zero spec is FIFO.
+	Matching MatchingSpec
+
+	// DepthSnapshotIntervalMM is how often a full DEPTH snapshot goes out next to the DEPTH_DIFF
+	// events; 0 sends snapshots only on request.
+	DepthSnapshotIntervalMM int
+
+	// L3Feed publishes every displayed order change, under anonymous public order ids.
+	L3Feed bool
+
+	// TickerHeartbeatMM is how often an idle symbol still sends its TICKER; 0 sends it only
+	// on trades and best bid / ask changes.
+	TickerHeartbeatMM int
 }
 
-var actors = map[string]*SymbolActor{}
+// Inbox size of every symbol actor
+const actorInboxSize = 8192
+
+var (
+	actors   = map[string]*SymbolActor{}
+	actorsMu sync.RWMutex
+)
+
+func lookupActor(symbol string) (*SymbolActor, error) {
+	actorsMu.RLock()
+	defer actorsMu.RUnlock()
+
+	actor, ok := actors[symbol]
+	if !ok {
+		return nil, unknownSymbol(symbol)
+	}
+	return actor, nil
+}
 
 func StartActors(symbols []Symbol) {
 	for _, sym := range symbols {
-		actor, err := NewSymbolActor(sym, 8192)
+		actor, err := NewSymbolActor(sym, actorInboxSize)
 		if err != nil {
 			log.Fatalln("Failed to start actor", symbols, err)
 		}
 
-		// 1. Load snapshot (if exists) --> TODO
-		// 2. Replay WAL (blocking)
-		slog.Info(fmt.Sprintf("replaying the %s orderbook Starting...", sym.Name))
-		err = actor.replayWal(0)
-
-		if err != nil {
-			slog.Info(fmt.Sprintf("Replaying the %s orderbook Failed. Error: %s", sym.Name, err.Error()))
+		if err := actor.start(); err != nil {
+			slog.Info(fmt.Sprintf("Starting the %s actor Failed. Error: %s", sym.Name, err.Error()))
 			continue
 		}
-		slog.Info(fmt.Sprintf("Replaying the %s orderbook Completed and the order count is %v", sym.Name, len(actor.engine.AllOrders)))
 
-		// 3. Start other workers owned by actor
-		go actor.wal.keepSyncing()
-		go actor.kafkaEmitter.Run()
-		// go actor.snapshotWorker() --> TODO
+		actorsMu.Lock()
+		actors[sym.Name] = actor
+		actorsMu.Unlock()
+	}
+}
 
-		// 4. Start actor loop LAST
-		go actor.Run()
+// GetInstruments returns the instrument specs of symbols, or of every symbol when none are given.
+func GetInstruments(symbols []string) ([]*pb.InstrumentSpec, error) {
+	if len(symbols) == 0 {
+		symbols = runningSymbols()
+	}
 
-		actors[sym.Name] = actor
+	instruments := make([]*pb.InstrumentSpec, 0, len(symbols))
+	for _, name := range symbols {
+		actor, err := lookupActor(name)
+		if err != nil {
+			return nil, err
+		}
+		// The spec is set before the actor starts and never changes, so no message round trip
+		instruments = append(instruments, actor.engine.Instrument.ToProto(name))
 	}
+
+	return instruments, nil
 }
 
-func PlaceOrder(order *Order) (*AddOrderInternalResponse, error) {
-	actor, ok := actors[order.Symbol]
-	if !ok {
-		return nil, fmt.Errorf("unknown symbol %s", order.Symbol)
+// PlaceOrder, CancelOrder and ModifyOrder give up with ctx: a full inbox turns them away
+// once ctx's deadline passes, and a request whose caller is gone is dropped before matching.
+func PlaceOrder(ctx context.Context, order *Order) (*AddOrderInternalResponse, error) {
+	if err := checkTimeInForceValue(order); err != nil {
+		return nil, err
+	}
+
+	actor, err := lookupActor(order.Symbol)
+	if err != nil {
+		return nil, err
 	}
 
 	replayCh := make(chan *AddOrderInternalResponse, 1)
 	errCh := make(chan error, 1)
-	actor.inbox <- PlaceOrderMsg{
+	err = actor.send(ctx, PlaceOrderMsg{
+		ctx:    ctx,
 		Order:  order,
 		replay: replayCh,
 		Err:    errCh,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	select {
 	case res := <-replayCh:
 		return res, nil
 	case err := <-errCh:
-		return nil, fmt.Errorf("failed to process the order. Error: %v", err)
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
 	}
 }
 
-func CancelOrder(id string, userID string, symbol string) (*CancelOrderInternalResponse, error) {
-	actor, ok := actors[symbol]
-	if !ok {
-		return nil, fmt.Errorf("unknown symbol %s", symbol)
+func CancelOrder(ctx context.Context, id string, userID string, symbol string) (*CancelOrderInternalResponse, error) {
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
 	}
 
 	replayCh := make(chan *CancelOrderInternalResponse, 1)
 	errCh := make(chan error, 1)
 
-	actor.inbox <- CancelOrderMsg{
+	err = actor.send(ctx, CancelOrderMsg{
+		ctx:    ctx,
 		ID:     id,
 		UserID: userID,
 		Symbol: symbol,
 		replay: replayCh,
 		Err:    errCh,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	select {
@@ -93,10 +164,13 @@ func CancelOrder(id string, userID string, symbol string) (*CancelOrderInternalR
 		return res, nil
 	case err := <-errCh:
 		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
 	}
 }
 
 func ModifyOrder(
+	ctx context.Context,
 	symbol string,
 	orderID string,
 	userID string,
@@ -104,15 +178,16 @@ func ModifyOrder(
 	newPrice *int64,
 	newQuantity *int64,
 ) (*ModifyOrderInternalResponse, error) {
-	actor, ok := actors[symbol]
-	if !ok {
-		return nil, fmt.Errorf("unknown symbol %s", symbol)
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
 	}
 
 	replayCh := make(chan *ModifyOrderInternalResponse, 1)
 	errCh := make(chan error, 1)
 
-	actor.inbox <- ModifyOrderMsg{
+	err = actor.send(ctx, ModifyOrderMsg{
+		ctx:            ctx,
 		Symbol:         symbol,
 		OrderID:        orderID,
 		UserID:         userID,
@@ -121,6 +196,9 @@ func ModifyOrder(
 		NewQuantity:    newQuantity,
 		replay:         replayCh,
 		Err:            errCh,
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	select {
@@ -128,6 +206,8 @@ func ModifyOrder(
 		return res, nil
 	case err := <-errCh:
 		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
 	}
 }
 
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+==================================================================
+===================== Listed Symbols Registry ====================
+==================================================================
+*/
+
+var symbolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// symbolRegistry is the set of listed symbols, persisted so symbols listed at runtime
+// survive a restart. It also keeps symbols whose actor failed to start, so a bad boot
+// never drops a market from the file.
+type symbolRegistry struct {
+	path    string
+	symbols map[string]Symbol
+}
+
+var (
+	listedSymbols = &symbolRegistry{symbols: map[string]Symbol{}}
+
+	// Serialises ListSymbol / DelistSymbol, and guards listedSymbols
+	adminMu sync.Mutex
+)
+
+// LoadSymbols reads the listed symbols from path and keeps path as the file later changes
+// are written to. On the first start the file does not exist yet and is created from seed.
+func LoadSymbols(path string, seed []Symbol) ([]Symbol, error) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	listedSymbols.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	symbols := seed
+	if err == nil {
+		symbols = nil
+		if err := json.Unmarshal(data, &symbols); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sym := range symbols {
+		listedSymbols.symbols[sym.Name] = sym
+	}
+
+	if os.IsNotExist(err) {
+		if err := listedSymbols.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return listedSymbols.list(), nil
+}
+
+func (r *symbolRegistry) list() []Symbol {
+	symbols := make([]Symbol, 0, len(r.symbols))
+	for _, sym := range r.symbols {
+		symbols = append(symbols, sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].Name < symbols[j].Name })
+	return symbols
+}
+
+// save writes the registry atomically. Callers hold adminMu.
+func (r *symbolRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.path, data)
+}
+
+func runningSymbols() []string {
+	actorsMu.RLock()
+	defer actorsMu.RUnlock()
+
+	symbols := make([]string, 0, len(actors))
+	for name := range actors {
+		symbols = append(symbols, name)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+/*
+==================================================================
+===================== Symbol Listing / Delisting =================
+==================================================================
+*/
+
+// ListSymbol starts a new market: its WAL directory, actor and Kafka worker. A symbol listed
+// before and delisted gets its book back from the snapshot and WAL it left on disk. With
+// openWithAuction the symbol takes its first orders in a call auction.
+func ListSymbol(sym Symbol, openWithAuction bool) (*pb.SymbolStatus, error) {
+	if !symbolNamePattern.MatchString(sym.Name) {
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "invalid symbol name %q", sym.Name)
+	}
+	if err := sym.Validate(); err != nil {
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "%v", err)
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	if _, err := lookupActor(sym.Name); err == nil {
+		return nil, engineError(codes.AlreadyExists, pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "symbol %s is already listed", sym.Name)
+	}
+
+	actor, err := NewSymbolActor(sym, actorInboxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := actor.start(); err != nil {
+		actor.closeFiles()
+		return nil, err
+	}
+
+	// Not reachable through lookupActor yet, so no order can arrive before the auction starts
+	if openWithAuction {
+		if _, err := actor.setTradingState(context.Background(), pbTypes.TradingState_TRADING_STATE_AUCTION, "Opening auction"); err != nil {
+			if stopErr := actor.stop(); stopErr != nil {
+				slog.Error("failed to stop actor after a failed listing", "symbol", sym.Name, "err", stopErr)
+			}
+			return nil, err
+		}
+	}
+
+	previous, existed := listedSymbols.symbols[sym.Name]
+	listedSymbols.symbols[sym.Name] = sym
+	if err := listedSymbols.save(); err != nil {
+		// Keep memory and disk in agreement
+		if existed {
+			listedSymbols.symbols[sym.Name] = previous
+		} else {
+			delete(listedSymbols.symbols, sym.Name)
+		}
+		if stopErr := actor.stop(); stopErr != nil {
+			slog.Error("failed to stop actor after a failed listing", "symbol", sym.Name, "err", stopErr)
+		}
+		return nil, err
+	}
+
+	actorsMu.Lock()
+	actors[sym.Name] = actor
+	actorsMu.Unlock()
+
+	slog.Info("symbol listed", "symbol", sym.Name)
+
+	return actor.status(context.Background())
+}
+
+// DelistSymbol stops taking orders for a symbol, drains what is already queued and closes
+// its actor. The WAL, snapshots and Kafka checkpoint stay on disk for a later relisting.
+func DelistSymbol(symbol string) (uint64, error) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	actor, err := lookupActor(symbol)
+	running := err == nil
+
+	previous, listed := listedSymbols.symbols[symbol]
+	if !running && !listed {
+		return 0, unknownSymbol(symbol)
+	}
+
+	delete(listedSymbols.symbols, symbol)
+	if err := listedSymbols.save(); err != nil {
+		if listed {
+			listedSymbols.symbols[symbol] = previous
+		}
+		return 0, err
+	}
+
+	if !running {
+		return 0, nil
+	}
+
+	// New lookups fail from here on; requests that already hold the actor are drained by stop
+	actorsMu.Lock()
+	delete(actors, symbol)
+	actorsMu.Unlock()
+
+	if err := actor.stop(); err != nil {
+		return 0, err
+	}
+
+	slog.Info("symbol delisted", "symbol", symbol, "walSequence", actor.wal.LastSequenceNumber())
+
+	return actor.wal.LastSequenceNumber(), nil
+}
+
+// SymbolStatuses reports the given running symbols, or all of them when none are given.
+func SymbolStatuses(ctx context.Context, symbols []string) ([]*pb.SymbolStatus, error) {
+	if len(symbols) == 0 {
+		symbols = runningSymbols()
+	}
+
+	statuses := make([]*pb.SymbolStatus, 0, len(symbols))
+	for _, name := range symbols {
+		actor, err := lookupActor(name)
+		if err != nil {
+			return nil, err
+		}
+
+		status, err := actor.status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// SetTradingState switches a running symbol to state. The change goes through the actor,
+// so it is ordered with the orders around it and lands in the WAL like any other event.
+func SetTradingState(ctx context.Context, symbol string, state pbTypes.TradingState, reason string) (*pb.SetTradingStateResponse, error) {
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	return actor.setTradingState(ctx, state, reason)
+}
+
+func (a *SymbolActor) setTradingState(ctx context.Context, state pbTypes.TradingState, reason string) (*pb.SetTradingStateResponse, error) {
+	replayCh := make(chan *pb.SetTradingStateResponse, 1)
+	errCh := make(chan error, 1)
+
+	err := a.send(ctx, TradingStateMsg{
+		State:  state,
+		Reason: reason,
+		replay: replayCh,
+		Err:    errCh,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+/*
+==================================================================
+========================= Actor Lifecycle ========================
+==================================================================
+*/
+
+// start restores the book from the latest snapshot and the WAL tail, then starts the
+// workers and the actor loop.
+func (a *SymbolActor) start() error {
+	// 1. Load snapshot (if exists)
+	from, err := a.loadSnapshot()
+	if err != nil {
+		return fmt.Errorf("loading the %s snapshot failed: %w", a.symbol, err)
+	}
+
+	// 2. Replay WAL tail (blocking)
+	slog.Info(fmt.Sprintf("replaying the %s orderbook from WAL sequence %d Starting...", a.symbol, from))
+	if err := a.replayWal(from); err != nil {
+		return fmt.Errorf("replaying the %s orderbook failed: %w", a.symbol, err)
+	}
+	slog.Info(fmt.Sprintf("Replaying the %s orderbook Completed and the order count is %v", a.symbol, len(a.engine.AllOrders)))
+	a.engine.resetDepthTracking(a.wal.LastSequenceNumber())
+
+	// 3. Start other workers owned by actor
+	a.workers.Add(4)
+	go func() { defer a.workers.Done(); a.wal.keepSyncing() }()
+	go func() { defer a.workers.Done(); a.kafkaEmitter.Run() }()
+	go func() { defer a.workers.Done(); a.snapshotWorker() }()
+	go func() { defer a.workers.Done(); a.tickerWorker() }()
+
+	// 4. Start actor loop LAST, after the publishers it feeds
+	go a.publisher.run()
+	if a.l3Feed != nil {
+		go a.l3Feed.run()
+	}
+	go a.Run()
+
+	return nil
+}
+
+// stop is the reverse of start. The workers go first, as the snapshot and ticker workers talk
+// to the inbox; then the inbox is closed and drained, and the final state is written out.
+func (a *SymbolActor) stop() error {
+	close(a.quit)
+	a.wal.cancel()
+	a.kafkaEmitter.cancel()
+	a.workers.Wait()
+
+	// In-flight senders finish first; later ones get an error instead of a closed channel
+	a.inboxMu.Lock()
+	a.inboxClosed = true
+	close(a.inbox)
+	close(a.cancelInbox)
+	a.inboxMu.Unlock()
+	<-a.done
+	a.closeSubscribers()
+	a.publisher.close()
+	if a.l3Feed != nil {
+		a.l3Feed.close()
+	}
+
+	if err := a.wal.Close(); err != nil {
+		return err
+	}
+
+	// The actor loop has exited, so the book can be read directly
+	if err := a.persistSnapshot(a.engine.Snapshot(a.wal.LastSequenceNumber())); err != nil {
+		return err
+	}
+
+	return a.kafkaEmitter.Close()
+}
+
+// closeFiles releases an actor that never started.
+func (a *SymbolActor) closeFiles() {
+	closeWAL(a.wal)
+	if err := a.kafkaEmitter.checkpointFile.Close(); err != nil {
+		slog.Error("failed to close Kafka checkpoint", "symbol", a.symbol, "err", err)
+	}
+}
+
+func (a *SymbolActor) status(ctx context.Context) (*pb.SymbolStatus, error) {
+	replay := make(chan *pb.SymbolStatus, 1)
+	if err := a.send(ctx, StatusMsg{replay: replay}); err != nil {
+		return nil, err
+	}
+
+	var res *pb.SymbolStatus
+	select {
+	case res = <-replay:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	res.WalSequence = a.wal.LastSequenceNumber()
+	res.KafkaCommittedOffset = a.kafkaEmitter.CommittedOffset()
+	res.InboxDepth = int64(len(a.inbox))
+	res.InboxCapacity = int64(cap(a.inbox))
+	res.CancelInboxDepth = int64(len(a.cancelInbox))
+	res.CancelInboxCapacity = int64(cap(a.cancelInbox))
+	res.InboxRejected = a.inboxRejected.Load()
+	res.InboxExpired = a.inboxExpired.Load()
+
+	return res, nil
+}
+
+// Status reports the book side of a symbol's status. Runs inside the actor loop.
+func (me *MatchingEngine) Status() *pb.SymbolStatus {
+	status := &pb.SymbolStatus{
+		Symbol:         me.Symbol,
+		OpenOrders:     uint64(len(me.AllOrders)),
+		StopOrders:     uint64(len(me.Stops.Orders)),
+		LastTradePrice: me.LastTradePrice,
+		TradeSequence:  me.TradeSequence,
+		Instrument:     me.Instrument.ToProto(me.Symbol),
+		TradingState:   me.TradingState,
+	}
+
+	if me.TradingState == pbTypes.TradingState_TRADING_STATE_AUCTION {
+		status.Auction = me.auctionProto(me.equilibrium())
+	}
+
+	if me.Bids.BestPriceLevel != nil {
+		status.BestBid = me.Bids.BestPriceLevel.Price
+	}
+	if me.Asks.BestPriceLevel != nil {
+		status.BestAsk = me.Asks.BestPriceLevel.Price
+	}
+
+	return status
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+type AdminServer struct {
+	pb.UnimplementedMatchingEngineAdminServer
+
+	// Defaults holds the settings of symbols listed at runtime that a request leaves unset. The
+	// WAL, Kafka and idempotency settings always come from here
+	Defaults Symbol
+}
+
+func (s *AdminServer) ListSymbol(ctx context.Context, req *pb.ListSymbolRequest) (*pb.ListSymbolResponse, error) {
+	slog.Info("Request to list a symbol", "symbol", req.Symbol, "instrument", req.Instrument, "matching", req.Matching, "circuitBreaker", req.CircuitBreaker, "l3Feed", req.L3Feed)
+
+	sym := s.Defaults
+	sym.Name = req.Symbol
+	sym.StartingPrice = req.StartingPrice
+	sym.Instrument = InstrumentSpecFromProto(req.Instrument)
+	if req.Matching != nil {
+		sym.Matching = MatchingSpecFromProto(req.Matching)
+	}
+	if req.CircuitBreaker != nil {
+		sym.CircuitBreaker = CircuitBreakerSpecFromProto(req.CircuitBreaker)
+	}
+	if req.L3Feed != nil {
+		sym.L3Feed = *req.L3Feed
+	}
+	if req.SnapshotIntervalMs != nil {
+		sym.SnapshotIntervalMM = int(*req.SnapshotIntervalMs)
+	}
+	if req.DepthSnapshotIntervalMs != nil {
+		sym.DepthSnapshotIntervalMM = int(*req.DepthSnapshotIntervalMs)
+	}
+	if req.TickerHeartbeatMs != nil {
+		sym.TickerHeartbeatMM = int(*req.TickerHeartbeatMs)
+	}
+
+	status, err := ListSymbol(sym, req.OpenWithAuction)
+	if err != nil {
+		slog.Error("Failed to list symbol", "symbol", req.Symbol, "error", err)
+		return nil, err
+	}
+
+	return &pb.ListSymbolResponse{Status: status}, nil
+}
+
+func (s *AdminServer) DelistSymbol(ctx context.Context, req *pb.DelistSymbolRequest) (*pb.DelistSymbolResponse, error) {
+	slog.Info("Request to delist a symbol", "symbol", req.Symbol)
+
+	walSequence, err := DelistSymbol(req.Symbol)
+	if err != nil {
+		slog.Error("Failed to delist symbol", "symbol", req.Symbol, "error", err)
+		return nil, err
+	}
+
+	return &pb.DelistSymbolResponse{
+		Symbol:      req.Symbol,
+		WalSequence: walSequence,
+	}, nil
+}
+
+func (s *AdminServer) GetSymbolStatus(ctx context.Context, req *pb.GetSymbolStatusRequest) (*pb.GetSymbolStatusResponse, error) {
+	statuses, err := SymbolStatuses(ctx, req.Symbols)
+	if err != nil {
+		slog.Error("Failed to get symbol status", "symbols", req.Symbols, "error", err)
+		return nil, err
+	}
+
+	return &pb.GetSymbolStatusResponse{Symbols: statuses}, nil
+}
+
+func (s *AdminServer) SetTradingState(ctx context.Context, req *pb.SetTradingStateRequest) (*pb.SetTradingStateResponse, error) {
+	slog.Info("Request to set the trading state", "symbol", req.Symbol, "state", req.State, "reason", req.Reason)
+
+	response, err := SetTradingState(ctx, req.Symbol, req.State, req.Reason)
+	if err != nil {
+		slog.Error("Failed to set the trading state", "symbol", req.Symbol, "error", err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (s *AdminServer) SetRiskLimits(ctx context.Context, req *pb.SetRiskLimitsRequest) (*pb.SetRiskLimitsResponse, error) {
+	slog.Info("Request to set risk limits", "symbol", req.Symbol, "user", req.UserId, "limits", req.Limits, "clear", req.Clear)
+
+	previous, limits, err := SetRiskLimits(req.Symbol, req.UserId, RiskLimitsFromProto(req.Limits), req.Clear)
+	if err != nil {
+		slog.Error("Failed to set risk limits", "symbol", req.Symbol, "user", req.UserId, "error", err)
+		return nil, err
+	}
+
+	return &pb.SetRiskLimitsResponse{
+		Symbol:         req.Symbol,
+		UserId:         req.UserId,
+		Limits:         limits.ToProto(),
+		PreviousLimits: previous.ToProto(),
+	}, nil
+}
+
+func (s *AdminServer) GetRiskLimits(ctx context.Context, req *pb.GetRiskLimitsRequest) (*pb.GetRiskLimitsResponse, error) {
+	response, err := GetRiskLimits(req.Symbol)
+	if err != nil {
+		slog.Error("Failed to get risk limits", "symbol", req.Symbol, "error", err)
+		return nil, err
+	}
+
+	return response, nil
+}
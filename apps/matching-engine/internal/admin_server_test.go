@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"testing"
+
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListSymbolChecksTheRequestedSettings(t *testing.T) {
+	server := &AdminServer{Defaults: Symbol{WalDir: t.TempDir(), MaxWalFileSize: 4096, SnapshotIntervalMM: 1000}}
+
+	tests := []struct {
+		name string
+		req  *pb.ListSymbolRequest
+	}{
+		{"unknown algorithm", &pb.ListSymbolRequest{Matching: &pb.MatchingSpec{Algorithm: 7}}},
+		{"top order quantity off the lot size", &pb.ListSymbolRequest{Instrument: &pb.InstrumentSpec{LotSize: 10}, Matching: &pb.MatchingSpec{Algorithm: pb.MatchingAlgorithm_MATCHING_ALGORITHM_TOP_ORDER_PRO_RATA, TopOrderQuantity: 5}}},
+		{"circuit breaker without a window", &pb.ListSymbolRequest{CircuitBreaker: &pb.CircuitBreakerSpec{MaxMoveBps: 500}}},
+		{"negative interval", &pb.ListSymbolRequest{TickerHeartbeatMs: int64Ptr(-1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Symbol = "NEW"
+			if _, err := server.ListSymbol(t.Context(), tt.req); status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("ListSymbol: %v", err)
+			}
+		})
+	}
+}
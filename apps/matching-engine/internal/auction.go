@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+==================================================================
+========================== Call Auction ==========================
+==================================================================
+*/
+
+// auctionResult is the equilibrium of a crossed book: the price and the quantity that
+// executes there, and what is left over on either side at that price.
+type auctionResult struct {
+	price       int64
+	volume      int64
+	buySurplus  int64
+	sellSurplus int64
+}
+
+func (r auctionResult) imbalance() int64 {
+	return r.buySurplus + r.sellSurplus
+}
+
+type levelVolume struct {
+	price  int64
+	volume int64
+}
+
+// crossedLevels lists the levels of obs, best first, while inRange holds.
+func crossedLevels(obs *OrderBookSide, inRange func(price int64) bool) []levelVolume {
+	levels := []levelVolume{}
+	for level := obs.BestPriceLevel; level != nil && inRange(level.Price); level = level.NextPrice {
+		levels = append(levels, levelVolume{price: level.Price, volume: int64(level.TotalVolume)})
+	}
+	return levels
+}
+
+// equilibrium finds the uncrossing price. Every price level inside the crossed range is a
+// candidate, and the first rule that leaves a single candidate decides:
+//  1. the most executed volume
+//  2. the smallest imbalance
+//  3. market pressure: the highest price when every candidate has buy surplus, the lowest
+//     when every candidate has sell surplus
+//  4. the price closest to the reference price, then the lower one
+//
+// Hidden and iceberg reserve quantity takes part in full. A zero result means no cross.
+func (me *MatchingEngine) equilibrium() auctionResult {
+	if me.Bids.BestPriceLevel == nil || me.Asks.BestPriceLevel == nil {
+		return auctionResult{}
+	}
+
+	low, high := me.Asks.BestPriceLevel.Price, me.Bids.BestPriceLevel.Price
+	if high < low {
+		return auctionResult{}
+	}
+
+	bids := crossedLevels(me.Bids, func(price int64) bool { return price >= low })
+	asks := crossedLevels(me.Asks, func(price int64) bool { return price <= high })
+
+	prices := make([]int64, 0, len(bids)+len(asks))
+	var buy int64
+	for _, level := range bids {
+		prices = append(prices, level.price)
+		buy += level.volume
+	}
+	for _, level := range asks {
+		prices = append(prices, level.price)
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+
+	// Walk the candidates upwards: bids below the price drop out, asks at or below it join
+	var sell int64
+	lowestBid, nextAsk := len(bids)-1, 0
+	candidates := []auctionResult{}
+
+	for i, price := range prices {
+		if i > 0 && price == prices[i-1] {
+			continue
+		}
+
+		for lowestBid >= 0 && bids[lowestBid].price < price {
+			buy -= bids[lowestBid].volume
+			lowestBid--
+		}
+		for nextAsk < len(asks) && asks[nextAsk].price <= price {
+			sell += asks[nextAsk].volume
+			nextAsk++
+		}
+
+		volume := min(buy, sell)
+		result := auctionResult{price: price, volume: volume, buySurplus: buy - volume, sellSurplus: sell - volume}
+
+		switch {
+		case len(candidates) == 0 || volume > candidates[0].volume:
+			candidates = []auctionResult{result}
+		case volume < candidates[0].volume:
+		case result.imbalance() < candidates[0].imbalance():
+			candidates = []auctionResult{result}
+		case result.imbalance() == candidates[0].imbalance():
+			candidates = append(candidates, result)
+		}
+	}
+
+	return me.breakAuctionTie(candidates)
+}
+
+// breakAuctionTie applies the market pressure and reference price rules. candidates are in
+// ascending price order.
+func (me *MatchingEngine) breakAuctionTie(candidates []auctionResult) auctionResult {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	allBuySurplus, allSellSurplus := true, true
+	for _, candidate := range candidates {
+		allBuySurplus = allBuySurplus && candidate.buySurplus > 0
+		allSellSurplus = allSellSurplus && candidate.sellSurplus > 0
+	}
+
+	switch {
+	case allBuySurplus:
+		return candidates[len(candidates)-1]
+	case allSellSurplus:
+		return candidates[0]
+	}
+
+	reference := me.LastTradePrice
+	if reference == 0 {
+		reference = me.StartingPrice
+	}
+
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if distance(candidate.price, reference) < distance(best.price, reference) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+func distance(a int64, b int64) int64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// checkAuctionOrder returns a reject message for orders that cannot wait for the uncross.
+func checkAuctionOrder(order *Order) string {
+	if order.Type != pbTypes.OrderType_LIMIT {
+		return "Only LIMIT orders are accepted during an auction"
+	}
+	if order.TimeInForce != pbTypes.TimeInForce_GTC {
+		return fmt.Sprintf("%s orders are not accepted during an auction", order.TimeInForce)
+	}
+	return ""
+}
+
+// uncross executes the crossed part of the book at the equilibrium price. Orders pair up in
+// price-time priority from the best bid and the best ask; the order that arrived first is
+// the maker. Self-trade prevention does not apply, as neither order is the aggressor.
+func (me *MatchingEngine) uncross() []*pb.EngineEvent {
+	result := me.equilibrium()
+	events := []*pb.EngineEvent{}
+
+	for remaining := result.volume; remaining > 0; {
+		bidLevel, askLevel := me.Bids.BestPriceLevel, me.Asks.BestPriceLevel
+		if bidLevel == nil || askLevel == nil || bidLevel.Price < result.price || askLevel.Price > result.price {
+			break
+		}
+
+		bid, ask := bidLevel.HeadOrder, askLevel.HeadOrder
+		quantity := min(bid.matchableQuantity(), ask.matchableQuantity(), remaining)
+		remaining -= quantity
+
+		maker, taker := bid, ask
+		if ask.EngineTimestamp.AsTime().Before(bid.EngineTimestamp.AsTime()) {
+			maker, taker = ask, bid
+		}
+
+		trade := me.ExecuteTrade(taker, maker, quantity, result.price)
+		trade.Auction = true
+
+		tradeData, _ := EncodeTradeEvent(&trade)
+		events = append(events, &pb.EngineEvent{
+			EventType: pbTypes.EventType_TRADE_EXECUTED,
+			UserId:    taker.UserID,
+			Data:      tradeData,
+		})
+
+		me.TotalMatches++
+		me.TotalVolume += uint64(quantity)
+
+		for _, order := range []*Order{bid, ask} {
+			order.PriceLevel.Fill(order, quantity)
+			order.FilledQuantity += quantity
+			order.ExecutedValue += result.price * quantity
+			order.AveragePrice = order.ExecutedValue / order.FilledQuantity
+
+			if order.RemainingQuantity == 0 {
+				order.Status = pbTypes.OrderStatus_FILLED
+				me.removeFromBook(order)
+
+				data, _ := EncodeOrderStatusEvent(order, StrPtr(""), false)
+				events = append(events, &pb.EngineEvent{
+					EventType: pbTypes.EventType_ORDER_FILLED,
+					UserId:    order.UserID,
+					Data:      data,
+				})
+			}
+		}
+	}
+
+	// The auction price is discovered, not a move the circuit breaker should halt on
+	me.trip = nil
+
+	return append(events, me.auctionEvent(pbTypes.EventType_AUCTION_UNCROSSED, result))
+}
+
+// auctionIndicative publishes the current equilibrium while an auction collects orders.
+func (me *MatchingEngine) auctionIndicative() []*pb.EngineEvent {
+	if me.TradingState != pbTypes.TradingState_TRADING_STATE_AUCTION {
+		return nil
+	}
+
+	return []*pb.EngineEvent{me.auctionEvent(pbTypes.EventType_AUCTION_INDICATIVE, me.equilibrium())}
+}
+
+func (me *MatchingEngine) auctionEvent(eventType pbTypes.EventType, result auctionResult) *pb.EngineEvent {
+	data, _ := proto.Marshal(me.auctionProto(result))
+	return &pb.EngineEvent{
+		EventType: eventType,
+		Data:      data,
+	}
+}
+
+func (me *MatchingEngine) auctionProto(result auctionResult) *pb.AuctionEvent {
+	return &pb.AuctionEvent{
+		Symbol:        me.Symbol,
+		AuctionNumber: me.AuctionNumber,
+		Price:         result.price,
+		Volume:        result.volume,
+		BuySurplus:    result.buySurplus,
+		SellSurplus:   result.sellSurplus,
+		Timestamp:     me.timestamp(),
+	}
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+// auctionTestActor is a running actor whose symbol is in an auction.
+func auctionTestActor(t *testing.T, dir string) (*SymbolActor, func()) {
+	t.Helper()
+
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+	if _, err := a.setTradingState(t.Context(), pbTypes.TradingState_TRADING_STATE_AUCTION, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return a, stop
+}
+
+func TestEquilibrium(t *testing.T) {
+	type order struct {
+		side     pbTypes.Side
+		price    int64
+		quantity int64
+	}
+	buy := func(price int64, quantity int64) order { return order{pbTypes.Side_BUY, price, quantity} }
+	sell := func(price int64, quantity int64) order { return order{pbTypes.Side_SELL, price, quantity} }
+
+	tests := []struct {
+		name      string
+		reference int64
+		book      []order
+		want      auctionResult
+	}{
+		{
+			// 100: buy 7 sell 6 → 6; 99: 7/2 → 2; 101: 4/6 → 4
+			name: "most volume",
+			book: []order{buy(101, 4), buy(100, 3), sell(99, 2), sell(100, 4)},
+			want: auctionResult{price: 100, volume: 6, buySurplus: 1},
+		},
+		{
+			// 100: buy 5 sell 4 → 4, imbalance 1; 101: 4/7 → 4, imbalance 3
+			name: "smallest imbalance",
+			book: []order{buy(101, 4), buy(100, 1), sell(100, 4), sell(101, 3)},
+			want: auctionResult{price: 100, volume: 4, buySurplus: 1},
+		},
+		{
+			// 100 and 101: buy 6 sell 4; 102 and 103: buy 4 sell 7. Buyers are left over at both
+			// survivors, so the higher price
+			name: "buy pressure takes the highest price",
+			book: []order{buy(103, 4), buy(101, 2), sell(100, 4), sell(102, 3)},
+			want: auctionResult{price: 101, volume: 4, buySurplus: 2},
+		},
+		{
+			// 101 and 102: buy 5 sell 9, sellers left over at both, so the lower price
+			name: "sell pressure takes the lowest price",
+			book: []order{buy(102, 5), buy(100, 5), sell(99, 3), sell(101, 6)},
+			want: auctionResult{price: 101, volume: 5, sellSurplus: 4},
+		},
+		{
+			// 100 and 101 both match 5 with nothing left over
+			name:      "closest to the reference price",
+			reference: 105,
+			book:      []order{buy(101, 5), sell(100, 5)},
+			want:      auctionResult{price: 101, volume: 5},
+		},
+		{
+			name:      "lower price when the reference is halfway",
+			reference: 101,
+			book:      []order{buy(102, 5), sell(100, 5)},
+			want:      auctionResult{price: 100, volume: 5},
+		},
+		{
+			name: "no cross",
+			book: []order{buy(99, 5), sell(100, 5)},
+			want: auctionResult{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, _ := auctionTestActor(t, t.TempDir())
+			a.engine.StartingPrice = test.reference
+
+			for i, o := range test.book {
+				placeTestOrder(t, a, limitOrder(fmt.Sprintf("o%d", i), fmt.Sprintf("u%d", i), o.side, o.price, o.quantity))
+			}
+
+			if got := a.engine.equilibrium(); got != test.want {
+				t.Fatalf("equilibrium %+v, want %+v", got, test.want)
+			}
+			if a.engine.TotalMatches != 0 {
+				t.Fatal("orders matched during the auction")
+			}
+		})
+	}
+}
+
+func TestUncross(t *testing.T) {
+	dir := t.TempDir()
+	a, stop := auctionTestActor(t, dir)
+
+	// 100 and 101 both execute 5 with 2 buyers left over, so 101
+	placeTestOrder(t, a, limitOrder("b1", "u1", pbTypes.Side_BUY, 102, 3))
+	placeTestOrder(t, a, limitOrder("b2", "u2", pbTypes.Side_BUY, 101, 4))
+	placeTestOrder(t, a, limitOrder("a1", "u3", pbTypes.Side_SELL, 100, 2))
+	placeTestOrder(t, a, limitOrder("a2", "u4", pbTypes.Side_SELL, 100, 3))
+	placeTestOrder(t, a, limitOrder("a3", "u5", pbTypes.Side_SELL, 103, 5))
+
+	if _, err := a.setTradingState(t.Context(), pbTypes.TradingState_TRADING_STATE_OPEN, "open"); err != nil {
+		t.Fatal(err)
+	}
+	if b2 := a.engine.AllOrders["b2"]; b2 == nil || b2.RemainingQuantity != 2 || len(a.engine.AllOrders) != 2 {
+		t.Fatalf("left after the uncross:\n%s", checkBook(t, a.engine))
+	}
+	want := checkBook(t, a.engine)
+	stop()
+
+	// The heads of the best levels pair up, all at 101, the earlier order as the maker
+	trades := []string{}
+	var uncrossed *pb.AuctionEvent
+	for _, event := range walEvents(t, a) {
+		switch event.GetEventType() {
+		case pbTypes.EventType_TRADE_EXECUTED:
+			var trade pb.TradeEvent
+			if err := proto.Unmarshal(event.GetData(), &trade); err != nil {
+				t.Fatal(err)
+			}
+			trades = append(trades, fmt.Sprintf("%s/%s %d@%d maker=%v auction=%v", trade.GetBuyOrderId(), trade.GetSellOrderId(), trade.GetQuantity(), trade.GetPrice(), trade.GetIsBuyerMaker(), trade.GetAuction()))
+		case pbTypes.EventType_AUCTION_UNCROSSED:
+			uncrossed = &pb.AuctionEvent{}
+			if err := proto.Unmarshal(event.GetData(), uncrossed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wantTrades := "[b1/a1 2@101 maker=true auction=true b1/a2 1@101 maker=true auction=true b2/a2 2@101 maker=true auction=true]"
+	if got := fmt.Sprint(trades); got != wantTrades {
+		t.Fatalf("trades %s\nwant %s", got, wantTrades)
+	}
+	if uncrossed.GetPrice() != 101 || uncrossed.GetVolume() != 5 || uncrossed.GetBuySurplus() != 2 || uncrossed.GetSellSurplus() != 0 {
+		t.Fatalf("uncrossed %v", uncrossed)
+	}
+
+	if got := replayedBook(t, dir); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAuctionRunsUntilTheStateChanges(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	clock := newTestClock()
+	a.engine.Clock = clock
+	runTestActor(t, a)
+	if _, err := a.setTradingState(t.Context(), pbTypes.TradingState_TRADING_STATE_AUCTION, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	placeTestOrder(t, a, limitOrder("b1", "u1", pbTypes.Side_BUY, 101, 5))
+	placeTestOrder(t, a, limitOrder("a1", "u2", pbTypes.Side_SELL, 100, 5))
+
+	// There is no timer: a day later the book is still crossed and waiting
+	clock.Advance(24 * time.Hour)
+	placeTestOrder(t, a, limitOrder("b2", "u1", pbTypes.Side_BUY, 90, 1))
+	if a.engine.TradingState != pbTypes.TradingState_TRADING_STATE_AUCTION || a.engine.TotalMatches != 0 {
+		t.Fatalf("state %v, %d matches", a.engine.TradingState, a.engine.TotalMatches)
+	}
+
+	// Moving to HALTED ends it as well, and the book still uncrosses
+	if _, err := a.setTradingState(t.Context(), pbTypes.TradingState_TRADING_STATE_HALTED, "close"); err != nil {
+		t.Fatal(err)
+	}
+	if a.engine.TotalMatches != 1 || a.engine.LastTradePrice != 100 {
+		t.Fatalf("%d matches at %d", a.engine.TotalMatches, a.engine.LastTradePrice)
+	}
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"context"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/status"
+)
+
+/*
+==================================================================
+========================== Batch Orders ==========================
+==================================================================
+*/
+
+// Most orders one PlaceOrders / CancelReplaceOrders call may carry
+const maxBatchSize = 100
+
+var errBatchRejected = failedPrecondition(pbTypes.RejectReason_REJECT_REASON_BATCH_REJECTED, "not processed: another order of the all-or-nothing batch failed its checks")
+
+// PlaceOrdersMsg places a batch of orders in one actor step: the orders run one after the
+// other, their events go to the WAL back to back and the book changes go out as one update.
+type PlaceOrdersMsg struct {
+	ctx          context.Context
+	Orders       []*Order
+	AllOrNothing bool
+	replay       chan []PlaceOrderResult
+	Err          chan error
+}
+
+// CancelReplaceOrdersMsg is PlaceOrdersMsg for modifies.
+type CancelReplaceOrdersMsg struct {
+	ctx          context.Context
+	Modifies     []ModifyRequest
+	AllOrNothing bool
+	replay       chan []ModifyOrderResult
+	Err          chan error
+}
+
+type ModifyRequest struct {
+	OrderID        string
+	UserID         string
+	ClientModifyID string
+	NewPrice       *int64
+	NewQuantity    *int64
+}
+
+// PlaceOrderResult is what one order of a batch got; Err is set when it was not processed.
+type PlaceOrderResult struct {
+	Response *AddOrderInternalResponse
+	Err      error
+}
+
+type ModifyOrderResult struct {
+	Response *ModifyOrderInternalResponse
+	Err      error
+}
+
+// PlaceOrdersInternal places the orders in the given order. A client_order_id used twice in
+// the batch fails its later use, as the idempotency window only learns about the batch once
+// it is written. In all-or-nothing mode every order must first pass the checks that do not
+// depend on the book (duplicate ids, instrument rules, trading state, risk limits, iceberg
+// settings, stop price); if one fails, nothing is placed. How an order meets the book (post-only, FOK, a
+// MARKET order without liquidity) is still decided per order.
+func (me *MatchingEngine) PlaceOrdersInternal(orders []*Order, allOrNothing bool) ([]PlaceOrderResult, []*pb.EngineEvent) {
+	results := make([]PlaceOrderResult, len(orders))
+	failed := false
+
+	seen := map[string]bool{}
+	pending := map[string]int{} // orders of each user that passed the checks so far
+	for i, order := range orders {
+		if seen[order.ClientOrderID] {
+			results[i].Err = duplicateID("client_order_id %s is used twice in the batch", order.ClientOrderID)
+			failed = true
+			continue
+		}
+		seen[order.ClientOrderID] = true
+
+		if allOrNothing {
+			if err := me.checkNewOrder(order, pending[order.UserID]); err != nil {
+				results[i].Err = err
+				failed = true
+				continue
+			}
+			pending[order.UserID]++
+		}
+	}
+
+	if allOrNothing && failed {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = errBatchRejected
+			}
+		}
+		return results, nil
+	}
+
+	events := []*pb.EngineEvent{}
+	for i, order := range orders {
+		if results[i].Err != nil {
+			continue
+		}
+
+		response, orderEvents, err := me.placeOrder(order)
+		results[i] = PlaceOrderResult{Response: response, Err: err}
+		events = append(events, orderEvents...)
+	}
+
+	return results, events
+}
+
+// checkNewOrder runs the checks of AddOrderInternal that do not depend on the book, and the
+// risk checks, without changing anything. pending is how many orders of the same user passed
+// ahead of it in the batch. A retry of an order the user already placed passes: it returns
+// the original result as usual.
+func (me *MatchingEngine) checkNewOrder(order *Order, pending int) error {
+	if _, duplicate, err := me.duplicateOrder(order); duplicate {
+		return err
+	}
+
+	if reason, message := me.Instrument.check(order); reason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		return invalidArgument(reason, "%s", message)
+	}
+
+	if message := me.checkTradingState(order); message != "" {
+		return failedPrecondition(pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, "%s", message)
+	}
+
+	if reason, message := me.checkRisk(order, pending); reason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		return failedPrecondition(reason, "%s", message)
+	}
+
+	if isStopOrder(order.Type) {
+		if order.StopPrice <= 0 {
+			return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_STOP_PRICE, "stop price is required")
+		}
+		return nil
+	}
+
+	if message := checkDisplay(order); message != "" {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_DISPLAY, "%s", message)
+	}
+	return nil
+}
+
+// CancelReplaceOrdersInternal modifies the orders in the given order, like
+// PlaceOrdersInternal. All-or-nothing checks every modify against the book as it is before
+// the batch, so two modifies of the same order fail the batch.
+func (me *MatchingEngine) CancelReplaceOrdersInternal(modifies []ModifyRequest, allOrNothing bool) ([]ModifyOrderResult, []*pb.EngineEvent) {
+	results := make([]ModifyOrderResult, len(modifies))
+	failed := false
+
+	seenOrders, seenModifies := map[string]bool{}, map[string]bool{}
+	for i, modify := range modifies {
+		switch {
+		case modify.ClientModifyID != "" && seenModifies[modify.ClientModifyID]:
+			results[i].Err = duplicateID("client_modify_id %s is used twice in the batch", modify.ClientModifyID)
+		case allOrNothing && seenOrders[modify.OrderID]:
+			results[i].Err = invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "order %s is modified twice in the batch", modify.OrderID)
+		case allOrNothing:
+			if _, duplicate, err := me.duplicateModify(modify.ClientModifyID, modify.UserID); duplicate {
+				results[i].Err = err
+			} else if _, _, _, err := me.checkModify(me.Symbol, modify.OrderID, modify.UserID, modify.ClientModifyID, modify.NewPrice, modify.NewQuantity); err != nil {
+				results[i].Err = err
+			}
+		}
+
+		seenOrders[modify.OrderID] = true
+		seenModifies[modify.ClientModifyID] = true
+		if results[i].Err != nil {
+			failed = true
+		}
+	}
+
+	if allOrNothing && failed {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = errBatchRejected
+			}
+		}
+		return results, nil
+	}
+
+	events := []*pb.EngineEvent{}
+	for i, modify := range modifies {
+		if results[i].Err != nil {
+			continue
+		}
+
+		response, modifyEvents, err := me.ModifyOrderInternal(me.Symbol, modify.OrderID, modify.UserID, modify.ClientModifyID, modify.NewPrice, modify.NewQuantity)
+		if err == nil && response == nil {
+			err = invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "nothing to modify")
+		}
+		results[i] = ModifyOrderResult{Response: response, Err: err}
+		events = append(events, modifyEvents...)
+	}
+
+	return results, events
+}
+
+func checkBatchSize(size int) error {
+	if size == 0 {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "the batch is empty")
+	}
+	if size > maxBatchSize {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "a batch carries at most %d orders, got %d", maxBatchSize, size)
+	}
+	return nil
+}
+
+// PlaceOrders places a batch of orders on one symbol as one message; the results are in the
+// order of the orders.
+func PlaceOrders(ctx context.Context, symbol string, orders []*Order, allOrNothing bool) ([]PlaceOrderResult, error) {
+	if err := checkBatchSize(len(orders)); err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		if order.Symbol != symbol {
+			return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "order %s is for %s, not %s", order.ClientOrderID, order.Symbol, symbol)
+		}
+		if err := checkTimeInForceValue(order); err != nil {
+			return nil, err
+		}
+	}
+
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	replayCh := make(chan []PlaceOrderResult, 1)
+	errCh := make(chan error, 1)
+	if err := actor.send(ctx, PlaceOrdersMsg{ctx: ctx, Orders: orders, AllOrNothing: allOrNothing, replay: replayCh, Err: errCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// CancelReplaceOrders modifies a batch of orders on one symbol as one message.
+func CancelReplaceOrders(ctx context.Context, symbol string, modifies []ModifyRequest, allOrNothing bool) ([]ModifyOrderResult, error) {
+	if err := checkBatchSize(len(modifies)); err != nil {
+		return nil, err
+	}
+
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	replayCh := make(chan []ModifyOrderResult, 1)
+	errCh := make(chan error, 1)
+	if err := actor.send(ctx, CancelReplaceOrdersMsg{ctx: ctx, Modifies: modifies, AllOrNothing: allOrNothing, replay: replayCh, Err: errCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func batchOrder(id string, side pbTypes.Side, price int64, quantity int64) *Order {
+	order := limitOrder(id, "mm", side, price, quantity)
+	order.Symbol = testSymbol
+	order.RemainingQuantity = quantity
+	return order
+}
+
+func TestPlaceOrders(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	a.engine.Instrument = InstrumentSpec{LotSize: 1, MaxQuantity: 1000}
+	stop := runTestActor(t, a)
+	registerTestActor(t, a)
+	ctx := context.Background()
+
+	orders := []*Order{}
+	for i := range 20 {
+		orders = append(orders, batchOrder(fmt.Sprintf("b%d", i), pbTypes.Side_BUY, int64(90+i%5), 5))
+		orders = append(orders, batchOrder(fmt.Sprintf("s%d", i), pbTypes.Side_SELL, int64(100+i%5), 5))
+	}
+	results, err := PlaceOrders(ctx, testSymbol, orders, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Err != nil || result.Response.Order.ClientOrderID != orders[i].ClientOrderID {
+			t.Fatalf("order %d: %v", i, result.Err)
+		}
+	}
+
+	// All-or-nothing: one order over the max quantity and a reused id, so nothing is placed
+	// and the ids stay free
+	results, err = PlaceOrders(ctx, testSymbol, []*Order{
+		batchOrder("x1", pbTypes.Side_BUY, 91, 5),
+		batchOrder("x2", pbTypes.Side_BUY, 91, 5000),
+		batchOrder("x1", pbTypes.Side_BUY, 91, 1),
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != errBatchRejected || results[1].Err == nil || status.Code(results[2].Err) != codes.AlreadyExists {
+		t.Fatalf("all-or-nothing results: %v, %v, %v", results[0].Err, results[1].Err, results[2].Err)
+	}
+	if a.engine.AllOrders["x1"] != nil {
+		t.Fatal("x1 was placed by a rejected batch")
+	}
+	results, err = PlaceOrders(ctx, testSymbol, []*Order{batchOrder("x1", pbTypes.Side_BUY, 91, 5)}, true)
+	if err != nil || results[0].Err != nil || a.engine.AllOrders["x1"] == nil {
+		t.Fatalf("x1 after the rejected batch: %v, %v", err, results[0].Err)
+	}
+
+	// Without all-or-nothing only the later use of an id fails
+	results, err = PlaceOrders(ctx, testSymbol, []*Order{batchOrder("y1", pbTypes.Side_BUY, 101, 5), batchOrder("y1", pbTypes.Side_BUY, 101, 5)}, false)
+	if err != nil || results[0].Err != nil || status.Code(results[1].Err) != codes.AlreadyExists {
+		t.Fatalf("y1 twice: %v", results)
+	}
+
+	if _, err := PlaceOrders(ctx, testSymbol, []*Order{{Symbol: "OTHER", ClientOrderID: "z"}}, false); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("order for another symbol: %v", err)
+	}
+
+	stop()
+
+	live := checkBook(t, a.engine)
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
+
+func TestCancelReplaceOrders(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+	registerTestActor(t, a)
+	ctx := context.Background()
+
+	orders := []*Order{}
+	for i := range 6 {
+		orders = append(orders, batchOrder(fmt.Sprintf("b%d", i), pbTypes.Side_BUY, 90, 5))
+	}
+	if _, err := PlaceOrders(ctx, testSymbol, orders, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requote five orders; b1 also appears twice, so the all-or-nothing batch does nothing
+	modifies := []ModifyRequest{}
+	for i := range 5 {
+		modifies = append(modifies, ModifyRequest{OrderID: fmt.Sprintf("b%d", i), UserID: "mm", ClientModifyID: fmt.Sprintf("b%d-r", i), NewPrice: int64Ptr(int64(91 + i))})
+	}
+	rejected := append(append([]ModifyRequest{}, modifies...), ModifyRequest{OrderID: "b1", UserID: "mm", ClientModifyID: "b1-r2", NewPrice: int64Ptr(80)})
+
+	results, err := CancelReplaceOrders(ctx, testSymbol, rejected, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != errBatchRejected || results[5].Err == nil {
+		t.Fatalf("all-or-nothing results: %v, %v", results[0].Err, results[5].Err)
+	}
+	if a.engine.AllOrders["b0"] == nil || a.engine.AllOrders["b0-r"] != nil {
+		t.Fatal("b0 was replaced by a rejected batch")
+	}
+
+	results, err = CancelReplaceOrders(ctx, testSymbol, modifies, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Err != nil {
+			t.Fatalf("modify %d: %v", i, result.Err)
+		}
+		if replaced := a.engine.AllOrders[fmt.Sprintf("b%d-r", i)]; replaced == nil || replaced.Price != int64(91+i) {
+			t.Fatalf("b%d-r: %+v", i, replaced)
+		}
+	}
+
+	// Without all-or-nothing an unknown order fails alone
+	results, err = CancelReplaceOrders(ctx, testSymbol, []ModifyRequest{
+		{OrderID: "nope", UserID: "mm", ClientModifyID: "q", NewPrice: int64Ptr(1)},
+		{OrderID: "b5", UserID: "mm", ClientModifyID: "b5-r", NewQuantity: int64Ptr(2)},
+	}, false)
+	if err != nil || status.Code(results[0].Err) != codes.NotFound || results[1].Err != nil {
+		t.Fatalf("partial batch: %v", results)
+	}
+	if b5 := a.engine.AllOrders["b5"]; b5 == nil || b5.RemainingQuantity != 2 {
+		t.Fatalf("b5: %+v", b5)
+	}
+
+	stop()
+
+	live := checkBook(t, a.engine)
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+/*
+==================================================================
+=================== Cancel-All-After (Dead Man's Switch) =========
+==================================================================
+*/
+
+// How long a fired countdown waits for a busy symbol to take its mass cancel. Longer than a
+// client request gets, as nobody is there to retry it.
+const cancelAllAfterWait = 30 * time.Second
+
+// How long a fired countdown waits before it retries the symbols that failed
+const cancelAllAfterRetry = 5 * time.Second
+
+// cancelAllAfter holds the armed countdowns. Deadlines are wall-clock times and are written
+// to disk on every change, so a restart re-arms them with whatever time is left. A fired
+// countdown stays until every symbol cancelled the user's orders, so a restart fires it again.
+type cancelAllAfter struct {
+	mu        sync.Mutex
+	path      string
+	deadlines map[string]time.Time
+	timers    map[string]*time.Timer
+}
+
+var deadMansSwitch = &cancelAllAfter{
+	deadlines: map[string]time.Time{},
+	timers:    map[string]*time.Timer{},
+}
+
+// LoadCancelAllAfter reads the armed countdowns from path and keeps path as the file later
+// changes are written to. Countdowns that ran out while the engine was down fire right
+// away, so call it once the actors are running. A missing file is a fresh start.
+func LoadCancelAllAfter(path string) error {
+	deadMansSwitch.mu.Lock()
+	defer deadMansSwitch.mu.Unlock()
+
+	deadMansSwitch.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	deadlines := map[string]time.Time{}
+	if err := json.Unmarshal(data, &deadlines); err != nil {
+		return err
+	}
+
+	for userID, deadline := range deadlines {
+		deadMansSwitch.arm(userID, deadline)
+		slog.Info("cancel-all-after restored", "userId", userID, "deadline", deadline)
+	}
+
+	return nil
+}
+
+// SetCancelAllAfter (re)starts a user's countdown; a zero timeout disarms it. The returned
+// deadline is zero when disarmed.
+func SetCancelAllAfter(userID string, timeout time.Duration) (time.Time, error) {
+	if userID == "" {
+		return time.Time{}, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "user id is required")
+	}
+	if timeout < 0 {
+		return time.Time{}, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "timeout cannot be negative")
+	}
+
+	deadMansSwitch.mu.Lock()
+	defer deadMansSwitch.mu.Unlock()
+
+	previous, existed := deadMansSwitch.deadlines[userID]
+
+	var deadline time.Time
+	if timeout == 0 {
+		deadMansSwitch.disarm(userID)
+	} else {
+		deadline = time.Now().Add(timeout)
+		deadMansSwitch.arm(userID, deadline)
+	}
+
+	if err := deadMansSwitch.save(); err != nil {
+		// Keep memory and disk in agreement
+		if existed {
+			deadMansSwitch.arm(userID, previous)
+		} else {
+			deadMansSwitch.disarm(userID)
+		}
+		return time.Time{}, err
+	}
+
+	return deadline, nil
+}
+
+// arm replaces the user's timer. Callers hold the lock.
+func (c *cancelAllAfter) arm(userID string, deadline time.Time) {
+	c.disarm(userID)
+
+	c.deadlines[userID] = deadline
+	c.timers[userID] = time.AfterFunc(time.Until(deadline), func() { c.expire(userID, deadline, nil) })
+}
+
+// disarm stops the user's timer. Callers hold the lock.
+func (c *cancelAllAfter) disarm(userID string) {
+	if timer, ok := c.timers[userID]; ok {
+		timer.Stop()
+	}
+	delete(c.timers, userID)
+	delete(c.deadlines, userID)
+}
+
+// expire cancels the user's orders in symbols (nil = every symbol) unless the countdown was
+// refreshed meanwhile. The deadline is dropped once every symbol succeeded; until then the
+// timer comes back for the symbols that failed.
+func (c *cancelAllAfter) expire(userID string, deadline time.Time, symbols []string) {
+	c.mu.Lock()
+	armed := c.armedAt(userID, deadline)
+	c.mu.Unlock()
+	if !armed {
+		return
+	}
+	if symbols == nil {
+		symbols = runningSymbols()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelAllAfterWait)
+	defer cancel()
+
+	response := massCancelSymbols(ctx, userID, symbols, nil, pbTypes.CancelReason_CANCEL_REASON_CANCEL_ALL_AFTER)
+	slog.Warn("cancel-all-after expired, orders cancelled",
+		"userId", userID,
+		"deadline", deadline,
+		"cancelled", len(response.GetOrders()),
+	)
+
+	failed := []string{}
+	for _, failure := range response.GetFailures() {
+		// A symbol delisted meanwhile has no orders left
+		if failure.GetRejectReason() == pbTypes.RejectReason_REJECT_REASON_UNKNOWN_SYMBOL {
+			continue
+		}
+		slog.Error("cancel-all-after could not cancel a symbol, retrying", "userId", userID, "symbol", failure.GetSymbol(), "err", failure.GetMessage())
+		failed = append(failed, failure.GetSymbol())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Re-armed or disarmed while the symbols were cancelling
+	if !c.armedAt(userID, deadline) {
+		return
+	}
+
+	if len(failed) > 0 {
+		c.timers[userID] = time.AfterFunc(cancelAllAfterRetry, func() { c.expire(userID, deadline, failed) })
+		return
+	}
+
+	delete(c.timers, userID)
+	delete(c.deadlines, userID)
+	if err := c.save(); err != nil {
+		slog.Error("failed to save cancel-all-after countdowns", "err", err)
+	}
+}
+
+// armedAt tells whether the user's countdown is still the one that ends at deadline. Callers
+// hold the lock.
+func (c *cancelAllAfter) armedAt(userID string, deadline time.Time) bool {
+	current, ok := c.deadlines[userID]
+	return ok && current.Equal(deadline)
+}
+
+// save writes the deadlines atomically. Callers hold the lock.
+func (c *cancelAllAfter) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.deadlines, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.path, data)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+// firedCountdown is a countdown of userID that ran out a second ago, saved to a file in dir.
+func firedCountdown(t *testing.T, dir string, userID string) (*cancelAllAfter, time.Time) {
+	t.Helper()
+
+	c := &cancelAllAfter{
+		path:      filepath.Join(dir, "cancel_all_after.json"),
+		deadlines: map[string]time.Time{},
+		timers:    map[string]*time.Timer{},
+	}
+	deadline := time.Now().Add(-time.Second)
+	c.deadlines[userID] = deadline
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	return c, deadline
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func savedDeadlines(t *testing.T, c *cancelAllAfter) map[string]time.Time {
+	t.Helper()
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadlines := map[string]time.Time{}
+	if err := json.Unmarshal(data, &deadlines); err != nil {
+		t.Fatal(err)
+	}
+	return deadlines
+}
+
+func TestCancelAllAfterCancelsInHaltedSymbol(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	runTestActor(t, a)
+	registerTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("b1", "gone", pbTypes.Side_BUY, 99, 5))
+	placeTestOrder(t, a, limitOrder("b2", "other", pbTypes.Side_BUY, 98, 5))
+	if _, err := SetTradingState(t.Context(), testSymbol, pbTypes.TradingState_TRADING_STATE_HALTED, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A user's own mass cancel still waits for the symbol to reopen
+	if _, err := MassCancel(t.Context(), "gone", testSymbol, nil); rejectReason(err) != pbTypes.RejectReason_REJECT_REASON_TRADING_STATE {
+		t.Fatalf("mass cancel while halted: %v", err)
+	}
+
+	c, deadline := firedCountdown(t, dir, "gone")
+	c.expire("gone", deadline, nil)
+
+	if order := a.engine.AllOrders["b1"]; order != nil {
+		t.Fatalf("b1 is still open: %+v", order)
+	}
+	if a.engine.AllOrders["b2"] == nil {
+		t.Fatal("b2 of another user was cancelled")
+	}
+	if _, ok := c.deadlines["gone"]; ok {
+		t.Fatal("the countdown is still armed after every symbol cancelled")
+	}
+	if _, ok := savedDeadlines(t, c)["gone"]; ok {
+		t.Fatal("the countdown is still saved after every symbol cancelled")
+	}
+}
+
+func TestCancelAllAfterKeepsDeadlineUntilEverySymbolCancelled(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+	registerTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("b1", "gone", pbTypes.Side_BUY, 99, 5))
+
+	// The WAL refuses the cancel, so the symbol fails
+	a.wal.mu.Lock()
+	writer := a.wal.bufferWriter
+	a.wal.bufferWriter = bufio.NewWriterSize(failingWriter{}, 16)
+	a.wal.mu.Unlock()
+	t.Cleanup(func() {
+		a.wal.mu.Lock()
+		a.wal.bufferWriter = writer
+		a.wal.mu.Unlock()
+		stop()
+	})
+
+	c, deadline := firedCountdown(t, dir, "gone")
+	c.expire("gone", deadline, nil)
+
+	c.mu.Lock()
+	_, armed := c.deadlines["gone"]
+	retry := c.timers["gone"]
+	c.mu.Unlock()
+	if !armed || retry == nil {
+		t.Fatal("the countdown was dropped although the symbol failed")
+	}
+	if saved, ok := savedDeadlines(t, c)["gone"]; !ok || !saved.Equal(deadline) {
+		t.Fatal("the countdown is no longer saved although the symbol failed")
+	}
+
+	// Disarming stops the retry
+	c.mu.Lock()
+	c.disarm("gone")
+	c.mu.Unlock()
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+==================================================================
+========================== Engine Clock ==========================
+==================================================================
+*/
+
+// Clock is where the engine reads time from. Tests and standby engines inject their own.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Tick fixes the engine time for the inbound message about to be processed. Every
+// timestamp the message produces is this one, so re-running it gives identical events.
+func (me *MatchingEngine) Tick() {
+	me.now = me.Clock.Now()
+}
+
+// SetTime moves the engine time to a recorded one, as replay does for each WAL event.
+func (me *MatchingEngine) SetTime(t time.Time) {
+	me.now = t
+}
+
+func (me *MatchingEngine) timestamp() *timestamppb.Timestamp {
+	return timestamppb.New(me.now)
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"sort"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+==================================================================
+======================= Incremental Depth ========================
+==================================================================
+*/
+
+// levelView is what depth shows of a price level. A level without displayed volume is not
+// shown at all, so it is the zero view.
+type levelView struct {
+	quantity int64
+	orders   int64
+}
+
+func (pl *PriceLevel) view() levelView {
+	if pl.DisplayedVolume == 0 {
+		return levelView{}
+	}
+	return levelView{quantity: int64(pl.DisplayedVolume), orders: int64(pl.OrderCount - pl.HiddenOrderCount)}
+}
+
+// touch records the level as changed by the current message, keeping the view it had
+// before the first change. Called before every change to the level's orders.
+func (pl *PriceLevel) touch() {
+	if pl.book == nil || pl.book.changes == nil {
+		return
+	}
+	if _, seen := pl.book.changes[pl.Price]; !seen {
+		pl.book.changes[pl.Price] = pl.view()
+	}
+}
+
+// newDepthSide is a bid or ask side that tracks its changed levels; trigger book sides do not.
+func newDepthSide(side pbTypes.Side) *OrderBookSide {
+	obs := NewOrderBookSide(side)
+	obs.changes = make(map[int64]levelView)
+	return obs
+}
+
+// changedLevels lists the levels whose view differs from the one before the message, best
+// price first, and starts tracking the next message.
+func (obs *OrderBookSide) changedLevels() []*pb.PriceLevel {
+	levels := []*pb.PriceLevel{}
+
+	for price, before := range obs.changes {
+		var now levelView
+		if level, ok := obs.PriceLevels[price]; ok {
+			now = level.view()
+		}
+		if now == before {
+			continue
+		}
+
+		levels = append(levels, &pb.PriceLevel{Price: price, Quantity: now.quantity, OrderCount: now.orders})
+	}
+	clear(obs.changes)
+
+	sort.Slice(levels, func(i, j int) bool {
+		if obs.Side == pbTypes.Side_BUY {
+			return levels[i].Price > levels[j].Price
+		}
+		return levels[i].Price < levels[j].Price
+	})
+
+	return levels
+}
+
+// depthEvents closes the depth of the current message, whose engine events are given: one
+// DEPTH_DIFF when the displayed book changed, its L3 event when the symbol has an L3 feed, and
+// a full DEPTH snapshot once the snapshot interval has passed. Both feeds share the book
+// sequence, so a message that only moved an order in its queue sends a diff without levels.
+// The new sequence goes on the last event of the message bound for the WAL, so replay picks
+// it up where the message left it.
+func (me *MatchingEngine) depthEvents(messageEvents []*pb.EngineEvent) []*pb.EngineEvent {
+	events := []*pb.EngineEvent{}
+
+	var orders []*pb.L3Update
+	if me.l3 != nil {
+		orders = me.l3.translate(messageEvents)
+	}
+
+	bids, asks := me.Bids.changedLevels(), me.Asks.changedLevels()
+	if len(bids) > 0 || len(asks) > 0 || len(orders) > 0 {
+		me.BookSequence++
+		for i := len(messageEvents) - 1; i >= 0; i-- {
+			if !isMarketDataEvent(messageEvents[i].EventType) {
+				messageEvents[i].BookSequence = me.BookSequence
+				break
+			}
+		}
+
+		data, _ := proto.Marshal(&pb.DepthDiffEvent{
+			Symbol:           me.Symbol,
+			Bids:             bids,
+			Asks:             asks,
+			Timestamp:        me.timestamp(),
+			Sequence:         me.BookSequence,
+			PreviousSequence: me.BookSequence - 1,
+		})
+		events = append(events, &pb.EngineEvent{
+			EventType: pbTypes.EventType_DEPTH_DIFF,
+			Data:      data,
+		})
+	}
+
+	if len(orders) > 0 {
+		data, _ := proto.Marshal(&pb.L3Event{
+			Symbol:           me.Symbol,
+			Updates:          orders,
+			Timestamp:        me.timestamp(),
+			Sequence:         me.BookSequence,
+			PreviousSequence: me.BookSequence - 1,
+		})
+		events = append(events, &pb.EngineEvent{
+			EventType: pbTypes.EventType_L3,
+			Data:      data,
+		})
+	}
+
+	if me.depthSnapshotInterval > 0 && me.now.Sub(me.lastDepthSnapshot) >= me.depthSnapshotInterval {
+		if depth, err := me.getDepthEvent(); err == nil {
+			events = append(events, depth)
+			me.lastDepthSnapshot = me.now
+		}
+	}
+
+	return events
+}
+
+// resetDepthTracking starts the depth feeds over once the book is rebuilt: the book sequence
+// carries on from the snapshot and the WAL, and the L3 feed starts from that book. A book
+// restored from data written before the sequence was kept starts at walSequence instead:
+// every diff comes from a message that wrote to the WAL, so no earlier diff had a higher one.
+//
+// The L3 feed gives out public ids afresh, so its sequence skips one: the first event after a
+// restart does not follow the last one before it, and clients resync before they see an id
+// used again.
+func (me *MatchingEngine) resetDepthTracking(walSequence uint64) {
+	if me.BookSequence == 0 {
+		me.BookSequence = walSequence
+	}
+	clear(me.Bids.changes)
+	clear(me.Asks.changes)
+
+	if me.l3 != nil {
+		me.l3.rebuild(me)
+		me.BookSequence++
+	}
+}
+
+func isMarketDataEvent(eventType pbTypes.EventType) bool {
+	switch eventType {
+	case pbTypes.EventType_DEPTH,
+		pbTypes.EventType_DEPTH_DIFF,
+		pbTypes.EventType_L3,
+		pbTypes.EventType_TICKER,
+		pbTypes.EventType_AUCTION_INDICATIVE:
+		return true
+	}
+	return false
+}
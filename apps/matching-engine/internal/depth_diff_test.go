@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+func depthDiffs(t *testing.T, sub *subscriber) []*pb.DepthDiffEvent {
+	t.Helper()
+
+	diffs := []*pb.DepthDiffEvent{}
+	for _, event := range receivedEvents(sub, pbTypes.EventType_DEPTH_DIFF) {
+		var diff pb.DepthDiffEvent
+		if err := proto.Unmarshal(event.Data, &diff); err != nil {
+			t.Fatal(err)
+		}
+		diffs = append(diffs, &diff)
+	}
+	return diffs
+}
+
+// diffLevels prints the levels of a diff as price:quantity/orders.
+func diffLevels(diff *pb.DepthDiffEvent) string {
+	side := func(levels []*pb.PriceLevel) string {
+		printed := []string{}
+		for _, level := range levels {
+			printed = append(printed, fmt.Sprintf("%d:%d/%d", level.GetPrice(), level.GetQuantity(), level.GetOrderCount()))
+		}
+		return strings.Join(printed, " ")
+	}
+	return fmt.Sprintf("bids[%s] asks[%s]", side(diff.GetBids()), side(diff.GetAsks()))
+}
+
+// checkDiffSequence fails the test unless every diff follows the one before it, the first
+// following after.
+func checkDiffSequence(t *testing.T, diffs []*pb.DepthDiffEvent, after uint64) {
+	t.Helper()
+
+	for _, diff := range diffs {
+		if diff.GetPreviousSequence() != after || diff.GetSequence() != after+1 {
+			t.Fatalf("diff %d after %d, want after %d", diff.GetSequence(), diff.GetPreviousSequence(), after)
+		}
+		after = diff.GetSequence()
+	}
+}
+
+func TestDepthDiffs(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	sub := subscribeTestActor(a)
+	runTestActor(t, a)
+
+	steps := []struct {
+		name string
+		run  func()
+		want string
+	}{
+		{"new bid level", func() { placeTestOrder(t, a, limitOrder("b1", "u1", pbTypes.Side_BUY, 99, 5)) }, "bids[99:5/1] asks[]"},
+		{"second order at the level", func() { placeTestOrder(t, a, limitOrder("b2", "u2", pbTypes.Side_BUY, 99, 3)) }, "bids[99:8/2] asks[]"},
+		{"both sides, best first", func() {
+			placeTestOrder(t, a, limitOrder("s1", "u3", pbTypes.Side_SELL, 102, 4))
+			placeTestOrder(t, a, limitOrder("s2", "u3", pbTypes.Side_SELL, 101, 4))
+		}, "bids[] asks[102:4/1] | bids[] asks[101:4/1]"},
+		{"cancel", func() { cancelTestOrder(t, a, "b1", "u1") }, "bids[99:3/1] asks[]"},
+		{"trades remove the level with quantity 0", func() { placeTestOrder(t, a, marketOrder("m1", "u4", pbTypes.Side_SELL, 3)) }, "bids[99:0/0] asks[]"},
+		{"taking the ask and resting the rest is one diff", func() {
+			placeTestOrder(t, a, limitOrder("b3", "u4", pbTypes.Side_BUY, 101, 6))
+		}, "bids[101:2/1] asks[101:0/0]"},
+		{"hidden orders do not show", func() { placeTestOrder(t, a, hiddenOrder("h1", "u5", pbTypes.Side_BUY, 98, 5)) }, ""},
+		{"an iceberg shows its slice", func() { placeTestOrder(t, a, icebergOrder("i1", "u5", pbTypes.Side_BUY, 97, 9, 2)) }, "bids[97:2/1] asks[]"},
+	}
+
+	var last uint64
+	for _, step := range steps {
+		step.run()
+
+		diffs := depthDiffs(t, sub)
+		checkDiffSequence(t, diffs, last)
+		if len(diffs) > 0 {
+			last = diffs[len(diffs)-1].GetSequence()
+		}
+
+		printed := []string{}
+		for _, diff := range diffs {
+			printed = append(printed, diffLevels(diff))
+		}
+		if got := strings.Join(printed, " | "); got != step.want {
+			t.Fatalf("%s: %s, want %s", step.name, got, step.want)
+		}
+	}
+
+	if a.engine.BookSequence != last {
+		t.Fatalf("book sequence %d, last diff %d", a.engine.BookSequence, last)
+	}
+}
+
+func TestBatchSendsOneDepthDiff(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	sub := subscribeTestActor(a)
+	runTestActor(t, a)
+	registerTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("s1", "u", pbTypes.Side_SELL, 105, 2))
+	before := depthDiffs(t, sub)
+
+	// b3 rests at 100 and s2 takes it within the batch, so 100 does not change at all
+	s2 := batchOrder("s2", pbTypes.Side_SELL, 100, 5)
+	s2.UserID = "other"
+	_, err := PlaceOrders(context.Background(), testSymbol, []*Order{
+		batchOrder("b1", pbTypes.Side_BUY, 99, 5),
+		batchOrder("b2", pbTypes.Side_BUY, 98, 5),
+		batchOrder("b3", pbTypes.Side_BUY, 100, 5),
+		s2,
+		batchOrder("s3", pbTypes.Side_SELL, 105, 3),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := depthDiffs(t, sub)
+	if len(diffs) != 1 {
+		t.Fatalf("%d diffs for one batch", len(diffs))
+	}
+	checkDiffSequence(t, diffs, before[len(before)-1].GetSequence())
+	if got := diffLevels(diffs[0]); got != "bids[99:5/1 98:5/1] asks[105:5/2]" {
+		t.Fatalf("batch diff %s", got)
+	}
+}
+
+func TestDepthSequenceCarriesOnAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	sub := subscribeTestActor(a)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("b1", "u1", pbTypes.Side_BUY, 99, 5))
+	placeTestOrder(t, a, limitOrder("s1", "u2", pbTypes.Side_SELL, 101, 5))
+	placeTestOrder(t, a, marketOrder("m1", "u3", pbTypes.Side_BUY, 2))
+	stop()
+
+	before := depthDiffs(t, sub)
+	checkDiffSequence(t, before, 0)
+	last := before[len(before)-1].GetSequence()
+
+	// From the WAL alone, then from a snapshot and the WAL tail
+	for _, withSnapshot := range []bool{false, true} {
+		b := newTestActor(t, dir)
+		recoverTestActor(t, b)
+		if b.engine.BookSequence != last {
+			t.Fatalf("recovered at %d, last diff %d", b.engine.BookSequence, last)
+		}
+
+		sub := subscribeTestActor(b)
+		stop := runTestActor(t, b)
+		if withSnapshot {
+			if err := b.snapshots.Write(takeTestSnapshot(t, b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		placeTestOrder(t, b, limitOrder(fmt.Sprintf("b-%v", withSnapshot), "u1", pbTypes.Side_BUY, 98, 1))
+		stop()
+
+		after := depthDiffs(t, sub)
+		checkDiffSequence(t, after, last)
+		last = after[len(after)-1].GetSequence()
+	}
+}
@@ -1,11 +1,16 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
 	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -13,22 +18,38 @@ import (
 type Order struct {
 	Symbol        string
 	Price         int64
+	StopPrice     int64
 	AveragePrice  int64
 	ExecutedValue int64
 
-	Quantity          int64
-	FilledQuantity    int64
-	RemainingQuantity int64
-	CancelledQuantity int64
-	Side              pbTypes.Side
-	Type              pbTypes.OrderType
-	UserID            string
-	ClientOrderID     string
-	Status            pbTypes.OrderStatus
-	StatusMessage     string
-	ClientTimestamp   *timestamppb.Timestamp
-	GatewayTimestamp  *timestamppb.Timestamp
-	EngineTimestamp   *timestamppb.Timestamp
+	Quantity            int64
+	FilledQuantity      int64
+	RemainingQuantity   int64
+	CancelledQuantity   int64
+	Side                pbTypes.Side
+	Type                pbTypes.OrderType
+	TimeInForce         pbTypes.TimeInForce
+	SelfTradePrevention pbTypes.SelfTradePrevention
+
+	// Iceberg orders show DisplayQuantity at a time; VisibleQuantity is what is left of that slice.
+	// Hidden orders match normally but never show in depth.
+	DisplayQuantity int64
+	VisibleQuantity int64
+	Hidden          bool
+
+	// Last modify applied to the order, and the order it replaced when created by a cancel-replace
+	ClientModifyID  string
+	ReplacedOrderID string
+
+	UserID           string
+	ClientOrderID    string
+	Status           pbTypes.OrderStatus
+	StatusMessage    string
+	CancelReason     pbTypes.CancelReason
+	RejectReason     pbTypes.RejectReason
+	ClientTimestamp  *timestamppb.Timestamp
+	GatewayTimestamp *timestamppb.Timestamp
+	EngineTimestamp  *timestamppb.Timestamp
 
 	Prev *Order
 	Next *Order
@@ -45,14 +66,23 @@ type PriceLevel struct {
 	Price       int64
 	TotalVolume uint64
 	OrderCount  uint64
-	HeadOrder   *Order
-	TailOrder   *Order
+
+	// What depth shows: iceberg reserves and hidden orders are left out
+	DisplayedVolume  uint64
+	HiddenOrderCount uint64
+
+	HeadOrder *Order
+	TailOrder *Order
 
 	PrevPrice *PriceLevel
 	NextPrice *PriceLevel
+
+	// Side the level belongs to, which tracks the levels a message changes
+	book *OrderBookSide
 }
 
 func (pl *PriceLevel) Push(order *Order) {
+	pl.touch()
 	order.PriceLevel = pl
 
 	if pl.TailOrder == nil {
@@ -64,11 +94,16 @@ func (pl *PriceLevel) Push(order *Order) {
 		pl.TailOrder = order
 	}
 
-	pl.TotalVolume += uint64(order.Quantity)
+	pl.TotalVolume += uint64(order.RemainingQuantity)
+	pl.DisplayedVolume += uint64(order.DisplayedQuantity())
 	pl.OrderCount++
+	if order.Hidden {
+		pl.HiddenOrderCount++
+	}
 }
 
 func (pl *PriceLevel) Remove(order *Order) {
+	pl.touch()
 	if order.Prev != nil {
 		order.Prev.Next = order.Next
 	} else {
@@ -82,7 +117,11 @@ func (pl *PriceLevel) Remove(order *Order) {
 	}
 
 	pl.TotalVolume -= uint64(order.RemainingQuantity)
+	pl.DisplayedVolume -= uint64(order.DisplayedQuantity())
 	pl.OrderCount--
+	if order.Hidden {
+		pl.HiddenOrderCount--
+	}
 
 	order.Prev = nil
 	order.Next = nil
@@ -103,12 +142,19 @@ type OrderBookSide struct {
 	PriceLevels map[int64]*PriceLevel
 
 	BestPriceLevel *PriceLevel
+
+	// Ordered index used to find where a new level goes without walking the list
+	index *priceIndex
+
+	// Displayed state of each level before the current message changed it; nil = not tracked
+	changes map[int64]levelView
 }
 
 func NewOrderBookSide(side pbTypes.Side) *OrderBookSide {
 	return &OrderBookSide{
 		Side:        side,
 		PriceLevels: make(map[int64]*PriceLevel),
+		index:       newPriceIndex(side),
 	}
 }
 
@@ -120,7 +166,7 @@ func (obs *OrderBookSide) GetOrCreatePriceLevel(price int64) *PriceLevel {
 	level, exists := obs.PriceLevels[price]
 
 	if !exists {
-		level = &PriceLevel{Price: int64(price)}
+		level = &PriceLevel{Price: int64(price), book: obs}
 		obs.PriceLevels[price] = level
 		obs.LinkPriceLevel(level)
 	}
@@ -128,59 +174,27 @@ func (obs *OrderBookSide) GetOrCreatePriceLevel(price int64) *PriceLevel {
 	return level
 }
 
+// LinkPriceLevel links a new level into the side. Bids are kept descending (100, 99, 98...)
+// and asks ascending; the index gives the level it goes after in O(log n).
 func (obs *OrderBookSide) LinkPriceLevel(newLevel *PriceLevel) {
-	if obs.BestPriceLevel == nil {
+	prevLevel := obs.index.insert(newLevel)
+
+	if prevLevel == nil {
+		newLevel.NextPrice = obs.BestPriceLevel
+		if obs.BestPriceLevel != nil {
+			obs.BestPriceLevel.PrevPrice = newLevel
+		}
 		obs.BestPriceLevel = newLevel
 		return
 	}
 
-	currentBestPriceLevel := obs.BestPriceLevel
-	if obs.Side == pbTypes.Side_BUY {
-		// Bid: descending order (100, 99, 98...)
-		if newLevel.Price > currentBestPriceLevel.Price {
-			newLevel.NextPrice = currentBestPriceLevel
-			currentBestPriceLevel.PrevPrice = newLevel
-			obs.BestPriceLevel = newLevel
-
-			return
-		}
+	newLevel.PrevPrice = prevLevel
+	newLevel.NextPrice = prevLevel.NextPrice
 
-		for currentBestPriceLevel != nil {
-			if currentBestPriceLevel.NextPrice == nil || newLevel.Price > currentBestPriceLevel.NextPrice.Price {
-				newLevel.PrevPrice = currentBestPriceLevel
-				newLevel.NextPrice = currentBestPriceLevel.NextPrice
-
-				if currentBestPriceLevel.NextPrice != nil {
-					currentBestPriceLevel.NextPrice.PrevPrice = newLevel
-				}
-				currentBestPriceLevel.NextPrice = newLevel
-				return
-			}
-
-			currentBestPriceLevel = currentBestPriceLevel.NextPrice
-		}
-	} else {
-		if newLevel.Price < currentBestPriceLevel.Price {
-			newLevel.NextPrice = currentBestPriceLevel
-			currentBestPriceLevel.PrevPrice = newLevel
-			obs.BestPriceLevel = newLevel
-			return
-		}
-
-		for currentBestPriceLevel != nil {
-			if currentBestPriceLevel.NextPrice == nil || newLevel.Price < currentBestPriceLevel.NextPrice.Price {
-				newLevel.PrevPrice = currentBestPriceLevel
-				newLevel.NextPrice = currentBestPriceLevel.NextPrice
-
-				if currentBestPriceLevel.NextPrice != nil {
-					currentBestPriceLevel.NextPrice.PrevPrice = newLevel
-				}
-				currentBestPriceLevel.NextPrice = newLevel
-				return
-			}
-			currentBestPriceLevel = currentBestPriceLevel.NextPrice
-		}
+	if prevLevel.NextPrice != nil {
+		prevLevel.NextPrice.PrevPrice = newLevel
 	}
+	prevLevel.NextPrice = newLevel
 }
 
 func (obs *OrderBookSide) RemovePriceLevel(level *PriceLevel) {
@@ -201,6 +215,7 @@ func (obs *OrderBookSide) RemovePriceLevel(level *PriceLevel) {
 	level.PrevPrice = nil
 
 	delete(obs.PriceLevels, level.Price)
+	obs.index.remove(level.Price)
 }
 
 /*
@@ -215,11 +230,58 @@ type MatchingEngine struct {
 	Asks   *OrderBookSide
 
 	AllOrders map[string]*Order
+	Stops     *TriggerBook
 
-	TotalMatches  uint64
-	TotalVolume   uint64
-	TradeSequence uint64
-	OrderSequence uint64
+	// Open orders and untriggered stops of each user, by order id
+	UserOrders map[string]map[string]*Order
+
+	TotalMatches   uint64
+	TotalVolume    uint64
+	TradeSequence  uint64
+	OrderSequence  uint64
+	LastTradePrice int64
+
+	// Recently seen client_order_ids / client_modify_ids, so retries do not execute twice
+	Idempotency *IdempotencyWindow
+
+	// Tick / lot size and quantity limits every new order is checked against
+	Instrument InstrumentSpec
+
+	// How an incoming order is shared among the orders of a price level
+	Matching MatchingSpec
+
+	// OPEN, HALTED, CANCEL_ONLY or POST_ONLY; changed by admins or the circuit breaker
+	TradingState pbTypes.TradingState
+	breaker      *circuitBreaker
+	trip         *breakerTrip // set by a trade that moved the price too far, applied once the message is done
+
+	// Incremented each time an auction starts; StartingPrice is the auction reference before the first trade
+	AuctionNumber uint64
+	StartingPrice int64
+
+	// Sequence of the last DEPTH_DIFF, and how often a full DEPTH snapshot goes out next to the diffs
+	BookSequence          uint64
+	depthSnapshotInterval time.Duration
+	lastDepthSnapshot     time.Time
+
+	// Order-by-order view of the book for the L3 feed; nil when the symbol has no L3 feed
+	l3 *l3Book
+
+	// 24h statistics, what the last TICKER showed, and how often an idle market sends one
+	stats               *tickerStats
+	tickerInterval      time.Duration
+	lastTicker          time.Time
+	tickerTradeSequence uint64
+	tickerBid           int64
+	tickerAsk           int64
+
+	// Times of each user's recent orders, for the orders-per-second risk limit
+	orderTimes         map[string][]time.Time
+	lastOrderRateSweep time.Time
+
+	// Source of time; now is fixed from it once per inbound message
+	Clock Clock
+	now   time.Time
 
 	wal *SymbolWAL
 }
@@ -227,9 +289,16 @@ type MatchingEngine struct {
 func NewMatchingEngine(symbol string, wal *SymbolWAL) *MatchingEngine {
 	return &MatchingEngine{
 		Symbol:        symbol,
-		Bids:          NewOrderBookSide(pbTypes.Side_BUY),
-		Asks:          NewOrderBookSide(pbTypes.Side_SELL),
+		Bids:          newDepthSide(pbTypes.Side_BUY),
+		Asks:          newDepthSide(pbTypes.Side_SELL),
 		AllOrders:     make(map[string]*Order),
+		Stops:         NewTriggerBook(),
+		UserOrders:    make(map[string]map[string]*Order),
+		Idempotency:   NewIdempotencyWindow(defaultIdempotencyWindowSize),
+		breaker:       newCircuitBreaker(CircuitBreakerSpec{}),
+		stats:         newTickerStats(),
+		orderTimes:    make(map[string][]time.Time),
+		Clock:         systemClock{},
 		TotalMatches:  0,
 		TotalVolume:   0,
 		TradeSequence: 0,
@@ -241,30 +310,90 @@ func NewMatchingEngine(symbol string, wal *SymbolWAL) *MatchingEngine {
 type AddOrderInternalResponse struct {
 	Order  *Order
 	Trades []Trade
+
+	// Duplicate is set when the order id was seen before and nothing was executed
+	Duplicate bool
+
+	// AuctionNumber is set when the order was placed during an auction
+	AuctionNumber uint64
 }
 
 func (me *MatchingEngine) AddOrderInternal(order *Order) (*AddOrderInternalResponse, []*pb.EngineEvent, error) {
-	if _, exists := me.AllOrders[order.ClientOrderID]; exists {
-		return nil, nil, fmt.Errorf("Duplicate Order ID: %s", order.ClientOrderID)
+	if response, duplicate, err := me.duplicateOrder(order); duplicate {
+		return response, nil, err
+	}
+
+	if order.EngineTimestamp == nil {
+		order.EngineTimestamp = me.timestamp()
+	}
+
+	if reason, message := me.Instrument.check(order); reason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		return &AddOrderInternalResponse{Order: order}, []*pb.EngineEvent{rejectedEvent(order, reason, message)}, nil
+	}
+
+	if message := me.checkTradingState(order); message != "" {
+		return &AddOrderInternalResponse{Order: order}, []*pb.EngineEvent{rejectedEvent(order, pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, message)}, nil
+	}
+
+	var trades []Trade
+	var events []*pb.EngineEvent
+
+	order.refillVisibleQuantity()
+
+	if isStopOrder(order.Type) {
+		events = me.addStopOrder(order)
+	} else {
+		trades, events = me.processOrder(order, pbTypes.EventType_ORDER_ACCEPTED)
+	}
+
+	// Trades above (or a stop placed behind the market) may have crossed resting stop prices
+	events = append(events, me.processTriggers()...)
+	events = append(events, me.applyCircuitBreaker()...)
+
+	response := &AddOrderInternalResponse{Order: order, Trades: trades}
+	if me.TradingState == pbTypes.TradingState_TRADING_STATE_AUCTION {
+		response.AuctionNumber = me.AuctionNumber
+	}
+
+	return response, events, nil
+}
+
+// processOrder matches a LIMIT or MARKET order, rests what is left of a LIMIT order and builds its
+// events. acceptEventType is ORDER_ACCEPTED for new orders and ORDER_TRIGGERED for fired stop orders.
+func (me *MatchingEngine) processOrder(order *Order, acceptEventType pbTypes.EventType) ([]Trade, []*pb.EngineEvent) {
+	auction := me.TradingState == pbTypes.TradingState_TRADING_STATE_AUCTION
+
+	rejectReason, rejectMessage := pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, checkDisplay(order)
+	if rejectMessage != "" {
+		rejectReason = pbTypes.RejectReason_REJECT_REASON_INVALID_DISPLAY
+	} else if !auction {
+		rejectReason, rejectMessage = me.checkTimeInForce(order)
 	}
 
-	trades, filledRestingOrders := me.MatchOrder(order)
+	if rejectMessage != "" {
+		order.Status = pbTypes.OrderStatus_REJECTED
+		order.RejectReason = rejectReason
+		order.StatusMessage = rejectMessage
+		return nil, me.buildEvents(order, nil, nil, nil, acceptEventType)
+	}
+
+	var trades []Trade
+	var filledRestingOrders []*Order
+	var selfTrades []selfTradeAction
+
+	if auction {
+		// Orders collect without matching until the auction uncrosses
+		order.Status = pbTypes.OrderStatus_OPEN
+	} else {
+		trades, filledRestingOrders, selfTrades = me.MatchOrder(order)
 
-	if order.Type == pbTypes.OrderType_MARKET {
 		// MARKET + no liquidity → already REJECTED inside MatchOrder
 		if order.Status == pbTypes.OrderStatus_REJECTED {
-			events := me.buildEvents(order, trades, filledRestingOrders)
-			return &AddOrderInternalResponse{Order: order, Trades: trades}, events, nil
+			return trades, me.buildEvents(order, trades, filledRestingOrders, selfTrades, acceptEventType)
 		}
 
-		// MARKET + partial fill → cancel remainder
-		if order.RemainingQuantity > 0 && order.FilledQuantity > 0 {
-			order.Status = pbTypes.OrderStatus_CANCELLED
-
-			order.StatusMessage = "Market order partially filled; remaining quantity cancelled"
-			order.CancelledQuantity = order.RemainingQuantity
-			order.RemainingQuantity = 0
-		}
+		// MARKET leftovers (filled or not), IOC / FOK leftovers → cancel remainder
+		cancelUnfilledRemainder(order, len(selfTrades) > 0)
 	}
 
 	if order.RemainingQuantity > 0 && order.Type == pbTypes.OrderType_LIMIT {
@@ -278,16 +407,56 @@ func (me *MatchingEngine) AddOrderInternal(order *Order) (*AddOrderInternalRespo
 
 		level := obs.GetOrCreatePriceLevel(order.Price)
 
+		// An iceberg rests with a fresh slice of what is left after matching
+		order.refillVisibleQuantity()
 		level.Push(order)
 		me.AllOrders[order.ClientOrderID] = order
+		me.indexOrder(order)
 	}
 
-	events := me.buildEvents(order, trades, filledRestingOrders)
-	return &AddOrderInternalResponse{Order: order, Trades: trades}, events, nil
+	return trades, me.buildEvents(order, trades, filledRestingOrders, selfTrades, acceptEventType)
+}
+
+// findOrder looks an order up in the visible book first and then in the trigger book.
+func (me *MatchingEngine) findOrder(id string) (*Order, bool) {
+	if order, ok := me.AllOrders[id]; ok {
+		return order, true
+	}
+
+	order, ok := me.Stops.Orders[id]
+	return order, ok
+}
+
+// bookSideFor returns the side an order rests on: the trigger book while it is an untriggered stop.
+func (me *MatchingEngine) bookSideFor(order *Order) *OrderBookSide {
+	if _, pending := me.Stops.Orders[order.ClientOrderID]; pending {
+		return me.Stops.sideFor(order)
+	}
+
+	if order.Side == pbTypes.Side_BUY {
+		return me.Bids
+	}
+	return me.Asks
+}
+
+// removeFromBook unlinks an order from its price level and drops the level once it is empty.
+func (me *MatchingEngine) removeFromBook(order *Order) {
+	obs := me.bookSideFor(order)
+	level := order.PriceLevel
+
+	level.Remove(order)
+	delete(me.AllOrders, order.ClientOrderID)
+	delete(me.Stops.Orders, order.ClientOrderID)
+	me.unindexOrder(order)
+
+	if level.IsEmpty() {
+		obs.RemovePriceLevel(level)
+	}
 }
 
-func (me *MatchingEngine) MatchOrder(incoming *Order) ([]Trade, []*Order) {
+func (me *MatchingEngine) MatchOrder(incoming *Order) ([]Trade, []*Order, []selfTradeAction) {
 	filledRestingOrders := []*Order{}
+	selfTrades := []selfTradeAction{}
 	var oppositeBook *OrderBookSide
 
 	if incoming.Side == pbTypes.Side_BUY {
@@ -299,8 +468,9 @@ func (me *MatchingEngine) MatchOrder(incoming *Order) ([]Trade, []*Order) {
 	// MARKET + no liquidity → reject immediately
 	if incoming.Type == pbTypes.OrderType_MARKET && oppositeBook.IsEmpty() {
 		incoming.Status = pbTypes.OrderStatus_REJECTED
+		incoming.RejectReason = pbTypes.RejectReason_REJECT_REASON_NO_LIQUIDITY
 		incoming.StatusMessage = "Market order rejected: no liquidity on opposite side"
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if incoming.Type == pbTypes.OrderType_LIMIT && incoming.RemainingQuantity == incoming.Quantity {
@@ -311,73 +481,83 @@ func (me *MatchingEngine) MatchOrder(incoming *Order) ([]Trade, []*Order) {
 
 	for incoming.RemainingQuantity > 0 && me.CanMatch(oppositeBook, incoming) {
 		bestPriceLevel := oppositeBook.BestPriceLevel
-		restingOrder := bestPriceLevel.HeadOrder
 
 		// Self-trade prevention
-		// if incoming.UserID == restingOrder.UserID {
-		// 	break // skip resting order
-		// }
+		if restingOrder := me.selfTradeOrder(bestPriceLevel, incoming); restingOrder != nil {
+			selfTrades = append(selfTrades, me.preventSelfTrade(incoming, restingOrder)...)
+			continue
+		}
 
-		matchQuantity := min(incoming.RemainingQuantity, restingOrder.RemainingQuantity)
-		matchPrice := restingOrder.Price
+		for _, fill := range me.allocate(bestPriceLevel, incoming.RemainingQuantity) {
+			restingOrder, matchQuantity := fill.order, fill.quantity
+			matchPrice := restingOrder.Price
 
-		trade := me.ExecuteTrade(incoming, restingOrder, matchQuantity, matchPrice)
+			trade := me.ExecuteTrade(incoming, restingOrder, matchQuantity, matchPrice)
 
-		trades = append(trades, trade)
+			trades = append(trades, trade)
 
-		incoming.RemainingQuantity -= matchQuantity
-		restingOrder.RemainingQuantity -= matchQuantity
+			incoming.RemainingQuantity -= matchQuantity
+			bestPriceLevel.Fill(restingOrder, matchQuantity)
 
-		incoming.FilledQuantity += matchQuantity
-		restingOrder.FilledQuantity += matchQuantity
+			incoming.FilledQuantity += matchQuantity
+			restingOrder.FilledQuantity += matchQuantity
 
-		incoming.ExecutedValue += int64(matchPrice) * int64(matchQuantity)
-		restingOrder.ExecutedValue += int64(matchPrice) * int64(matchQuantity)
+			incoming.ExecutedValue += int64(matchPrice) * int64(matchQuantity)
+			restingOrder.ExecutedValue += int64(matchPrice) * int64(matchQuantity)
 
-		incoming.AveragePrice = incoming.ExecutedValue / int64(incoming.FilledQuantity)
-		restingOrder.AveragePrice = restingOrder.ExecutedValue / int64(restingOrder.FilledQuantity)
+			incoming.AveragePrice = incoming.ExecutedValue / int64(incoming.FilledQuantity)
+			restingOrder.AveragePrice = restingOrder.ExecutedValue / int64(restingOrder.FilledQuantity)
 
-		me.TotalMatches++
-		me.TotalVolume += uint64(matchQuantity)
+			me.TotalMatches++
+			me.TotalVolume += uint64(matchQuantity)
 
-		if restingOrder.RemainingQuantity == 0 {
-			restingOrder.Status = pbTypes.OrderStatus_FILLED
-			filledRestingOrders = append(filledRestingOrders, restingOrder)
+			if restingOrder.RemainingQuantity == 0 {
+				restingOrder.Status = pbTypes.OrderStatus_FILLED
+				filledRestingOrders = append(filledRestingOrders, restingOrder)
 
-			bestPriceLevel.Remove(restingOrder)
+				bestPriceLevel.Remove(restingOrder)
 
-			delete(me.AllOrders, restingOrder.ClientOrderID)
+				delete(me.AllOrders, restingOrder.ClientOrderID)
+				me.unindexOrder(restingOrder)
 
-			if bestPriceLevel.IsEmpty() {
+				if bestPriceLevel.IsEmpty() {
 
-				oppositeBook.RemovePriceLevel(bestPriceLevel)
+					oppositeBook.RemovePriceLevel(bestPriceLevel)
+				}
 			}
 		}
 	}
 
-	if incoming.RemainingQuantity == 0 {
+	switch {
+	case incoming.Status == pbTypes.OrderStatus_CANCELLED:
+		// cancelled by self-trade prevention
+	case incoming.RemainingQuantity == 0:
 		incoming.Status = pbTypes.OrderStatus_FILLED
-	} else {
+	default:
 		incoming.Status = pbTypes.OrderStatus_PARTIAL_FILLED
 	}
-	return trades, filledRestingOrders
+	return trades, filledRestingOrders, selfTrades
 }
 
 func (me *MatchingEngine) CanMatch(oppositeBook *OrderBookSide, incoming *Order) bool {
 	if oppositeBook.BestPriceLevel == nil {
 		return false
 	}
+
+	return crossesPrice(incoming, oppositeBook.BestPriceLevel.Price)
+}
+
+// crossesPrice reports whether the incoming order is willing to trade at the given opposite price.
+func crossesPrice(incoming *Order, price int64) bool {
 	if incoming.Type == pbTypes.OrderType_MARKET {
 		return true
 	}
 
-	bestPrice := oppositeBook.BestPriceLevel.Price
-
 	if incoming.Side == pbTypes.Side_BUY {
-		return bestPrice <= incoming.Price
+		return price <= incoming.Price
 	}
 
-	return bestPrice >= incoming.Price
+	return price >= incoming.Price
 }
 
 type Trade struct {
@@ -394,10 +574,19 @@ type Trade struct {
 	SellOrderID string
 
 	IsBuyerMaker bool
+
+	// Auction is set for trades of an auction uncross, where both orders were resting
+	Auction bool
 }
 
 func (me *MatchingEngine) ExecuteTrade(aggressor *Order, restingOrder *Order, matchQuantity int64, matchPrice int64) Trade {
 	me.TradeSequence++
+	me.LastTradePrice = matchPrice
+
+	if reference, tripped := me.breaker.observe(me.now, matchPrice); tripped && me.trip == nil {
+		me.trip = &breakerTrip{reference: reference, price: matchPrice}
+	}
+	me.stats.observe(me.now, matchPrice, matchQuantity)
 
 	tradeID := me.GenerateTradeID(me.TradeSequence)
 
@@ -426,7 +615,7 @@ func (me *MatchingEngine) ExecuteTrade(aggressor *Order, restingOrder *Order, ma
 		TradeSequence: me.TradeSequence,
 		Price:         matchPrice,
 		Quantity:      matchQuantity,
-		Timeline:      timestamppb.Now(),
+		Timeline:      me.timestamp(),
 
 		BuyOrderID:  BuyOrderID,
 		BuyerID:     BuyerID,
@@ -437,36 +626,49 @@ func (me *MatchingEngine) ExecuteTrade(aggressor *Order, restingOrder *Order, ma
 	}
 }
 
-// generateTradeID creates a unique trade ID
+// GenerateTradeID derives the trade ID from symbol and sequence only, so replay reproduces it
 func (me *MatchingEngine) GenerateTradeID(seq uint64) string {
-	return fmt.Sprintf("%s-T%d-%d", me.Symbol, time.Now().UnixNano(), seq)
+	return fmt.Sprintf("%s-T%d", me.Symbol, seq)
 }
 
 func (me *MatchingEngine) buildEvents(
 	order *Order,
 	trades []Trade,
 	filledRestingOrders []*Order,
+	selfTrades []selfTradeAction,
+	acceptEventType pbTypes.EventType,
 ) []*pb.EngineEvent {
 
 	events := []*pb.EngineEvent{}
 	data, _ := EncodeOrderStatusEvent(order, StrPtr(""), false)
-	acceptedData, _ := EncodeOrderStatusEvent(order, StrPtr(""), true)
+
+	acceptMessage := ""
+	if acceptEventType == pbTypes.EventType_ORDER_TRIGGERED {
+		acceptMessage = triggerMessage(order)
+	}
+	acceptedData, _ := EncodeOrderStatusEvent(order, StrPtr(acceptMessage), true)
 
 	// ---------- REJECT ----------
 	if order.Status == pbTypes.OrderStatus_REJECTED {
-
-		return []*pb.EngineEvent{
-			{
-				EventType: pbTypes.EventType_ORDER_REJECTED,
+		// A fired stop order has already left the trigger book; replay needs the TRIGGERED event to follow it
+		if acceptEventType == pbTypes.EventType_ORDER_TRIGGERED {
+			events = append(events, &pb.EngineEvent{
+				EventType: acceptEventType,
 				UserId:    order.UserID,
-				Data:      data,
-			},
+				Data:      acceptedData,
+			})
 		}
+
+		return append(events, &pb.EngineEvent{
+			EventType: pbTypes.EventType_ORDER_REJECTED,
+			UserId:    order.UserID,
+			Data:      data,
+		})
 	}
 
 	// ---------- ACCEPT ----------
 	events = append(events, &pb.EngineEvent{
-		EventType: pbTypes.EventType_ORDER_ACCEPTED,
+		EventType: acceptEventType,
 		UserId:    order.UserID,
 
 		Data: acceptedData,
@@ -480,23 +682,6 @@ func (me *MatchingEngine) buildEvents(
 			UserId:    order.UserID,
 			Data:      tradeData,
 		})
-
-		depth, err := me.getDepthEvent()
-		if err == nil {
-			events = append(events, depth)
-		}
-		if depth == nil {
-			fmt.Printf("%s", err.Error())
-		}
-
-		if me.Bids.BestPriceLevel != nil && me.Asks.BestPriceLevel != nil {
-			tikcer, err := me.getTickerEvent(trade.Price, me.Bids.BestPriceLevel.Price, me.Asks.BestPriceLevel.Price)
-			if err != nil {
-				fmt.Printf("%s", err.Error())
-			} else {
-				events = append(events, tikcer)
-			}
-		}
 	}
 
 	for _, o := range filledRestingOrders {
@@ -509,6 +694,11 @@ func (me *MatchingEngine) buildEvents(
 		})
 	}
 
+	// ---------- SELF-TRADE PREVENTION ----------
+	for _, action := range selfTrades {
+		events = append(events, selfTradeEvent(action))
+	}
+
 	// ---------- FINAL STATE ----------
 	switch order.Status {
 	case pbTypes.OrderStatus_FILLED:
@@ -526,14 +716,6 @@ func (me *MatchingEngine) buildEvents(
 		})
 	}
 
-	depth, err := me.getDepthEvent()
-	if err == nil {
-		events = append(events, depth)
-	}
-	if depth == nil {
-		fmt.Printf("%s", err.Error())
-	}
-
 	return events
 }
 
@@ -551,64 +733,54 @@ func (me *MatchingEngine) CancelOrderInternal(
 
 	events := []*pb.EngineEvent{}
 
-	order, ok := me.AllOrders[id]
+	if me.TradingState == pbTypes.TradingState_TRADING_STATE_HALTED {
+		return nil, nil, failedPrecondition(pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, "trading in %s is halted", me.Symbol)
+	}
+
+	order, ok := me.findOrder(id)
 	if !ok {
-		return nil, nil, fmt.Errorf("order not found")
+		return nil, nil, orderNotFound("order not found")
 	}
 
 	// ownership check
 	if order.UserID != userID {
-		return nil, nil, fmt.Errorf("unauthorized cancel")
+		return nil, nil, notOrderOwner("unauthorized cancel")
 	}
 
 	// already filled or already cancelled
 	if order.RemainingQuantity == 0 {
-		return nil, nil, fmt.Errorf("order already completed")
+		return nil, nil, failedPrecondition(pbTypes.RejectReason_REJECT_REASON_ORDER_CLOSED, "order already completed")
 	}
 
-	// determine book side
-	obs := me.Asks
-	if order.Side == pbTypes.Side_BUY {
-		obs = me.Bids
+	if order.PriceLevel == nil {
+		return nil, nil, engineError(codes.Internal, pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, "price level not found")
 	}
 
-	level, ok := obs.PriceLevels[order.Price]
-	if !ok {
-		return nil, nil, fmt.Errorf("price level not found")
-	}
+	events = append(events, me.cancelOrder(order, pbTypes.CancelReason_CANCEL_REASON_USER_REQUESTED))
+
+	return &CancelOrderInternalResponse{
+		ID:     order.ClientOrderID,
+		Status: "ORDER_CANCELLED",
+	}, events, nil
+}
+
+// cancelOrder takes a resting order or untriggered stop off the book and cancels what is left of it.
+func (me *MatchingEngine) cancelOrder(order *Order, reason pbTypes.CancelReason) *pb.EngineEvent {
+	// remove from book (before zeroing remaining so the level volume is released)
+	me.removeFromBook(order)
 
 	// cancel remaining quantity
 	order.CancelledQuantity += order.RemainingQuantity
 	order.RemainingQuantity = 0
 	order.Status = pbTypes.OrderStatus_CANCELLED
-
-	// remove from book
-	level.Remove(order)
-	delete(me.AllOrders, order.ClientOrderID)
-
-	if level.IsEmpty() {
-		obs.RemovePriceLevel(level)
-	}
+	order.CancelReason = reason
 
 	data, _ := EncodeOrderStatusEvent(order, StrPtr(""), false)
-	events = append(events, &pb.EngineEvent{
+	return &pb.EngineEvent{
 		EventType: pbTypes.EventType_ORDER_CANCELLED,
 		UserId:    order.UserID,
 		Data:      data,
-	})
-
-	depth, err := me.getDepthEvent()
-	if err == nil {
-		events = append(events, depth)
 	}
-	if depth == nil {
-		fmt.Printf("%s", err.Error())
-	}
-
-	return &CancelOrderInternalResponse{
-		ID:     order.ClientOrderID,
-		Status: "ORDER_CANCELLED",
-	}, events, nil
 }
 
 type ModifyOrderInternalResponse struct {
@@ -628,25 +800,73 @@ func (me *MatchingEngine) ModifyOrderInternal(
 	newQuantity *int64,
 ) (*ModifyOrderInternalResponse, []*pb.EngineEvent, error) {
 
-	order, ok := me.AllOrders[oldOrderID]
+	if response, duplicate, err := me.duplicateModify(newOrderID, userID); duplicate {
+		return response, nil, err
+	}
+
+	order, replace, reduce, err := me.checkModify(symbol, oldOrderID, userID, newOrderID, newPrice, newQuantity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case replace:
+		events, err := me.replaceOrder(order, newOrderID, newPrice, newQuantity)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		response := &ModifyOrderInternalResponse{OrderID: order.ClientOrderID, OldOrderId: order.ClientOrderID, NewOrderId: newOrderID, Status: "Success"}
+		return response, events, nil
+
+	case reduce:
+
+		events, err := me.reduceOrder(order, newOrderID, newQuantity)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		response := &ModifyOrderInternalResponse{OrderID: order.ClientOrderID, OldOrderId: "", NewOrderId: "", Status: "Success"}
+		return response, events, nil
+
+	default:
+		return nil, nil, nil
+	}
+}
+
+// checkModify runs every check of a modify before anything changes. A price change or a
+// quantity increase replaces the order; a quantity decrease reduces it in place.
+func (me *MatchingEngine) checkModify(
+	symbol string,
+	oldOrderID string,
+	userID string,
+	newOrderID string,
+	newPrice *int64,
+	newQuantity *int64,
+) (order *Order, replace bool, reduce bool, err error) {
+	order, ok := me.findOrder(oldOrderID)
 	if !ok {
-		return nil, nil, fmt.Errorf("order not found")
+		return nil, false, false, orderNotFound("order not found")
 	}
 	if order.UserID != userID {
-		return nil, nil, fmt.Errorf("unauthorized")
+		return nil, false, false, notOrderOwner("unauthorized")
 	}
 	if order.Symbol != symbol {
-		return nil, nil, fmt.Errorf("symbol mismatch")
+		return nil, false, false, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "symbol mismatch")
 	}
 	if order.Status == pbTypes.OrderStatus_FILLED || order.Status == pbTypes.OrderStatus_CANCELLED {
-		return nil, nil, fmt.Errorf("order not modifiable")
+		return nil, false, false, failedPrecondition(pbTypes.RejectReason_REJECT_REASON_ORDER_CLOSED, "order not modifiable")
 	}
 
 	// Here we used Qty - remainingQty instead of filledQty because filledQty doen't inculde cancelledQty but Qty - remainingQty does
 	executed := order.Quantity - order.RemainingQuantity // order.FilledQuantity + order.CancelledQuantity
 
 	if newQuantity != nil && *newQuantity < executed {
-		return nil, nil, fmt.Errorf("new quantity < executed quantity")
+		return nil, false, false, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_QUANTITY, "new quantity < executed quantity")
+	}
+
+	if err := me.Instrument.checkModify(order, newPrice, newQuantity); err != nil {
+		return nil, false, false, err
 	}
 
 	newRemaining := order.RemainingQuantity
@@ -658,43 +878,45 @@ func (me *MatchingEngine) ModifyOrderInternal(
 	qtyReduced := newRemaining < order.RemainingQuantity
 	qtyIncreased := newRemaining > order.RemainingQuantity
 
-	switch {
-	case priceChanged || qtyIncreased:
-		if _, exists := me.AllOrders[newOrderID]; exists {
-			return nil, nil, fmt.Errorf("new_order_id already exists")
+	if err := me.checkModifyTradingState(order, priceChanged || qtyIncreased, newPrice); err != nil {
+		return nil, false, false, err
+	}
+
+	if priceChanged || qtyIncreased {
+		if _, exists := me.findOrder(newOrderID); exists {
+			return nil, false, false, duplicateID("new_order_id already exists")
 		}
-		events, err := me.replaceOrder(order, newOrderID, newPrice, newQuantity)
-		if err != nil {
-			return nil, nil, err
+		if _, exists := me.Idempotency.order(newOrderID); exists {
+			return nil, false, false, duplicateID("new_order_id already used")
 		}
 
-		response := &ModifyOrderInternalResponse{OrderID: order.ClientOrderID, OldOrderId: order.ClientOrderID, NewOrderId: newOrderID, Status: "Success"}
-		return response, events, nil
-
-	case qtyReduced:
-
-		events, err := me.reduceOrder(order, newQuantity)
-		if err != nil {
-			return nil, nil, err
+		// The replacement is a new order on the book and is held to the risk limits like one
+		replacement := *order
+		replacement.ReplacedOrderID = order.ClientOrderID
+		if newPrice != nil {
+			replacement.Price = *newPrice
+		}
+		replacement.Quantity = replacementQuantity(order, newQuantity)
+		if replacement.Quantity > 0 {
+			if reason, message := me.checkRisk(&replacement, 0); reason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+				return nil, false, false, failedPrecondition(reason, "modify rejected: %s", message)
+			}
 		}
-
-		response := &ModifyOrderInternalResponse{OrderID: order.ClientOrderID, OldOrderId: "", NewOrderId: "", Status: "Success"}
-		return response, events, nil
-
-	default:
-		return nil, nil, nil
 	}
+
+	return order, priceChanged || qtyIncreased, qtyReduced, nil
 }
 
 func (me *MatchingEngine) reduceOrder(
 	order *Order,
+	clientModifyID string,
 	newQuantity *int64,
 ) ([]*pb.EngineEvent, error) {
 
 	events := []*pb.EngineEvent{}
 
 	if newQuantity == nil {
-		return nil, fmt.Errorf("quantity required")
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_QUANTITY, "quantity required")
 	}
 
 	oldQuantity := order.Quantity
@@ -705,40 +927,33 @@ func (me *MatchingEngine) reduceOrder(
 	newRemaining := *newQuantity - executed
 
 	if newRemaining < 0 {
-		return nil, fmt.Errorf("invalid reduce")
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_QUANTITY, "invalid reduce")
 	}
 	volumeDelta := oldRemaining - newRemaining
 
 	newCancelledQuantity := oldCancelledQuantity + volumeDelta
 
-	order.RemainingQuantity = newRemaining
 	order.CancelledQuantity = newCancelledQuantity
+	order.ClientModifyID = clientModifyID
 
-	// update price level volume
+	// update remaining quantity and price level volume
 	if order.PriceLevel != nil {
-		order.PriceLevel.TotalVolume -= uint64(volumeDelta)
+		order.PriceLevel.Reduce(order, volumeDelta)
+	} else {
+		order.RemainingQuantity = newRemaining
 	}
 
 	// emit correct event
 	if order.RemainingQuantity == 0 {
+		order.Status = pbTypes.OrderStatus_CANCELLED
+		order.CancelReason = pbTypes.CancelReason_CANCEL_REASON_USER_REQUESTED
+
 		event, err := EncodeOrderStatusEvent(order, StrPtr("remaining quantity become 0"), false)
 		if err != nil {
 			return nil, err
 		}
 
-		level := order.PriceLevel
-
-		level.Remove(order)
-		delete(me.AllOrders, order.ClientOrderID)
-
-		obs := me.Asks
-		if order.Side == pbTypes.Side_BUY {
-			obs = me.Bids
-		}
-
-		if level.IsEmpty() {
-			obs.RemovePriceLevel(level)
-		}
+		me.removeFromBook(order)
 
 		events = append(events, &pb.EngineEvent{
 			EventType: pbTypes.EventType_ORDER_CANCELLED,
@@ -746,16 +961,10 @@ func (me *MatchingEngine) reduceOrder(
 			Data:      event,
 		})
 
-		depth, err := me.getDepthEvent()
-		if err == nil {
-			events = append(events, depth)
-		}
-		if depth == nil {
-			fmt.Printf("%s", err.Error())
-		}
-
 	} else {
-		event, err := EncodeOrderReducedEvent(order, oldQuantity, *newQuantity, oldRemaining, newRemaining, newCancelledQuantity, oldCancelledQuantity)
+		order.CancelReason = pbTypes.CancelReason_CANCEL_REASON_USER_REQUESTED
+
+		event, err := EncodeOrderReducedEvent(order, order.CancelReason, nil, oldQuantity, *newQuantity, oldRemaining, newRemaining, newCancelledQuantity, oldCancelledQuantity)
 		if err != nil {
 			return nil, err
 		}
@@ -764,14 +973,6 @@ func (me *MatchingEngine) reduceOrder(
 			UserId:    order.UserID,
 			Data:      event,
 		})
-
-		depth, err := me.getDepthEvent()
-		if err == nil {
-			events = append(events, depth)
-		}
-		if depth == nil {
-			fmt.Printf("%s", err.Error())
-		}
 	}
 
 	return events, nil
@@ -785,8 +986,7 @@ func (me *MatchingEngine) replaceOrder(
 ) ([]*pb.EngineEvent, error) {
 
 	var events []*pb.EngineEvent
-	oldRemainingQuantity := order.RemainingQuantity
-	oldFilledQuantity := order.FilledQuantity
+	newOrderQuantity := replacementQuantity(order, newQuantity)
 
 	// ---------- cancel old ----------
 	_, cancelEvents, err := me.CancelOrderInternal(
@@ -804,28 +1004,30 @@ func (me *MatchingEngine) replaceOrder(
 		price = *newPrice
 	}
 
-	newOrderQuantity := oldRemainingQuantity
-	if newQuantity != nil {
-		newOrderQuantity = *newQuantity - oldFilledQuantity
-	}
-
 	if newOrderQuantity <= 0 {
-		return nil, fmt.Errorf("nothing remaining after accounting for executed quantity")
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_QUANTITY, "nothing remaining after accounting for executed quantity")
 	}
 
 	// ---------- create new ----------
 	newOrder := &Order{
-		Symbol:            order.Symbol,
-		Price:             price,
-		Quantity:          newOrderQuantity,
-		RemainingQuantity: newOrderQuantity,
-		Side:              order.Side,
-		Type:              order.Type,
-		ClientOrderID:     newOrderID,
-		UserID:            order.UserID,
-		EngineTimestamp:   timestamppb.New(time.Now()), // priority reset
-		GatewayTimestamp:  timestamppb.New(time.Now()),
-		ClientTimestamp:   timestamppb.New(time.Now()),
+		Symbol:              order.Symbol,
+		Price:               price,
+		StopPrice:           order.StopPrice,
+		Quantity:            newOrderQuantity,
+		RemainingQuantity:   newOrderQuantity,
+		Side:                order.Side,
+		Type:                order.Type,
+		TimeInForce:         order.TimeInForce,
+		SelfTradePrevention: order.SelfTradePrevention,
+		DisplayQuantity:     order.DisplayQuantity,
+		Hidden:              order.Hidden,
+		ClientOrderID:       newOrderID,
+		ClientModifyID:      newOrderID,
+		ReplacedOrderID:     order.ClientOrderID,
+		UserID:              order.UserID,
+		EngineTimestamp:     me.timestamp(), // priority reset
+		GatewayTimestamp:    me.timestamp(),
+		ClientTimestamp:     me.timestamp(),
 	}
 	_, addEvents, err := me.AddOrderInternal(newOrder)
 	if err != nil {
@@ -843,13 +1045,17 @@ func (me *MatchingEngine) replaceOrder(
 */
 type EngineMsg interface{}
 
+// The order messages carry the caller's context: a message whose caller already gave up is
+// answered with its context error instead of being matched.
 type PlaceOrderMsg struct {
+	ctx    context.Context
 	Order  *Order
 	replay chan *AddOrderInternalResponse
 	Err    chan error
 }
 
 type CancelOrderMsg struct {
+	ctx    context.Context
 	ID     string
 	UserID string
 	Symbol string
@@ -858,6 +1064,7 @@ type CancelOrderMsg struct {
 }
 
 type ModifyOrderMsg struct {
+	ctx            context.Context
 	OrderID        string
 	UserID         string
 	ClientModifyID string
@@ -868,16 +1075,91 @@ type ModifyOrderMsg struct {
 	Err            chan error
 }
 
+type SnapshotMsg struct {
+	replay chan *pb.EngineSnapshot
+}
+
+type StatusMsg struct {
+	replay chan *pb.SymbolStatus
+}
+
+// TickerMsg asks for a heartbeat ticker
+type TickerMsg struct{}
+
+type TradingStateMsg struct {
+	State  pbTypes.TradingState
+	Reason string
+	replay chan *pb.SetTradingStateResponse
+	Err    chan error
+}
+
 type SymbolActor struct {
-	symbol string
-	inbox  chan EngineMsg
-	engine *MatchingEngine
+	symbol      string
+	inbox       chan EngineMsg
+	cancelInbox chan EngineMsg // priority lane for cancels and mass cancels
+	engine      *MatchingEngine
+
+	// Places and modifies still queued, which their cancels must not overtake
+	queued *queuedOrders
+
+	// Senders hold inboxMu for reading while they enqueue; delisting takes it for writing
+	// to close the inbox, so nothing is ever sent on a closed channel.
+	inboxMu     sync.RWMutex
+	inboxClosed bool
+
+	// Requests turned away because the inbox stayed full, and requests dropped because their
+	// caller gave up before the actor got to them
+	inboxRejected atomic.Uint64
+	inboxExpired  atomic.Uint64
 
 	wal          *SymbolWAL
 	kafkaEmitter *KafkaProducerWorker
+	publisher    *redisPublisher
+	l3Feed       *kafkaFeed // nil when the symbol has no L3 feed
+
+	snapshots            *SnapshotStore
+	snapshotIntervalMM   int
+	lastSnapshotSequence uint64
+
+	// SubscribeSymbol streams by gateway_id; the actor broadcasts under a read lock
+	subscribersMu sync.RWMutex
+	subscribers   map[string]*subscriber
+
+	quit    chan struct{}  // stops the snapshot and ticker workers
+	workers sync.WaitGroup // snapshot, ticker, WAL sync and Kafka workers
+	done    chan struct{}  // closed when Run has drained the inbox
+}
+
+// replacementQuantity is the quantity of the new order a cancel-replace places.
+func replacementQuantity(order *Order, newQuantity *int64) int64 {
+	if newQuantity == nil {
+		return order.RemainingQuantity
+	}
+	return *newQuantity - order.FilledQuantity
+}
+
+// Validate checks the settings of a symbol a client can choose.
+func (symbol Symbol) Validate() error {
+	if err := symbol.Instrument.Validate(); err != nil {
+		return fmt.Errorf("invalid instrument spec for %s: %w", symbol.Name, err)
+	}
+	if err := symbol.CircuitBreaker.Validate(); err != nil {
+		return fmt.Errorf("invalid circuit breaker for %s: %w", symbol.Name, err)
+	}
+	if err := symbol.Matching.Validate(symbol.Instrument); err != nil {
+		return fmt.Errorf("invalid matching algorithm for %s: %w", symbol.Name, err)
+	}
+	if symbol.SnapshotIntervalMM < 0 || symbol.DepthSnapshotIntervalMM < 0 || symbol.TickerHeartbeatMM < 0 {
+		return fmt.Errorf("intervals of %s cannot be negative", symbol.Name)
+	}
+	return nil
 }
 
 func NewSymbolActor(symbol Symbol, buffer int) (*SymbolActor, error) {
+	if err := symbol.Validate(); err != nil {
+		return nil, err
+	}
+
 	wal, err := OpenWAL(symbol.WalDir, symbol.Name, int64(symbol.MaxWalFileSize), symbol.WalShouldFsync, symbol.WalSyncInterval)
 	if err != nil {
 		return nil, err
@@ -891,173 +1173,301 @@ func NewSymbolActor(symbol Symbol, buffer int) (*SymbolActor, error) {
 		symbol.KafkaEmitMM,
 	)
 	if err != nil {
+		closeWAL(wal)
+		return nil, err
+	}
+
+	snapshots, err := OpenSnapshotStore(symbol.WalDir, symbol.Name)
+	if err != nil {
+		kakfaWoker.cancel()
+		if closeErr := kakfaWoker.checkpointFile.Close(); closeErr != nil {
+			slog.Error("failed to close Kafka checkpoint", "symbol", symbol.Name, "err", closeErr)
+		}
+		closeWAL(wal)
 		return nil, err
 	}
 
+	engine := NewMatchingEngine(symbol.Name, wal)
+	engine.Idempotency = NewIdempotencyWindow(symbol.IdempotencyWindowSize)
+	engine.Instrument = symbol.Instrument
+	engine.Matching = symbol.Matching
+	engine.breaker = newCircuitBreaker(symbol.CircuitBreaker)
+	engine.StartingPrice = symbol.StartingPrice
+	engine.depthSnapshotInterval = time.Duration(symbol.DepthSnapshotIntervalMM) * time.Millisecond
+	engine.tickerInterval = time.Duration(symbol.TickerHeartbeatMM) * time.Millisecond
+
+	var l3Feed *kafkaFeed
+	if symbol.L3Feed {
+		engine.l3 = newL3Book()
+		l3Feed = newKafkaFeed(kakfaWoker.producer, l3Topic, symbol.Name)
+	}
+
 	return &SymbolActor{
-		symbol:       symbol.Name,
-		inbox:        make(chan EngineMsg, buffer),
-		engine:       NewMatchingEngine(symbol.Name, wal),
-		wal:          wal,
-		kafkaEmitter: kakfaWoker,
+		symbol:             symbol.Name,
+		inbox:              make(chan EngineMsg, buffer),
+		cancelInbox:        make(chan EngineMsg, buffer),
+		engine:             engine,
+		queued:             newQueuedOrders(),
+		wal:                wal,
+		kafkaEmitter:       kakfaWoker,
+		publisher:          newRedisPublisher(symbol.Name),
+		l3Feed:             l3Feed,
+		snapshots:          snapshots,
+		snapshotIntervalMM: symbol.SnapshotIntervalMM,
+		subscribers:        make(map[string]*subscriber),
+		quit:               make(chan struct{}),
+		done:               make(chan struct{}),
 	}, nil
 }
 
+// closeWAL releases the WAL of an actor that could not be built.
+func closeWAL(wal *SymbolWAL) {
+	if err := wal.Close(); err != nil {
+		slog.Error("failed to close WAL", "symbol", wal.symbol, "err", err)
+	}
+}
+
 func (a *SymbolActor) Run() {
-	for msg := range a.inbox {
+	lanes := &inboxLanes{cancels: a.cancelInbox, orders: a.inbox}
+	for {
+		msg, ok := lanes.next()
+		if !ok {
+			break
+		}
+		a.queued.remove(msg)
+
 		switch m := msg.(type) {
 		case PlaceOrderMsg:
-			response, events, err := a.engine.AddOrderInternal(m.Order)
+			if a.abandoned(m.ctx, m.Err) {
+				continue
+			}
+			a.engine.Tick()
+			response, events, err := a.engine.placeOrder(m.Order)
 			if err != nil {
 				m.Err <- err
 				continue
 			}
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
 
-			// depthEvent, err := a.getDepthEvent()
-			// if err != nil {
-			// 	fmt.Printf("%s", err.Error())
-			// }
-			// events = append(events, depthEvent)
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
+			}
 
-			// tickerEvent, err := a.getTickerEvent()
-			// if err != nil {
-			// 	fmt.Printf("%s", err.Error())
-			// }
-			// events = append(events, depthEvent)
-
-			for _, event := range events {
-				event.Symbol = a.symbol
-				data, err := proto.Marshal(event)
-				if err != nil {
-					m.Err <- err
-					continue
-				}
+			m.replay <- response
 
-				go PublishEngineEvent(event)
+		case CancelOrderMsg:
+			if a.abandoned(m.ctx, m.Err) {
+				continue
+			}
+			a.engine.Tick()
+			response, events, err := a.engine.CancelOrderInternal(m.ID, m.UserID, m.Symbol)
 
-				if event.EventType == pbTypes.EventType_DEPTH || event.EventType == pbTypes.EventType_TICKER {
-					continue
-				}
+			if err != nil {
+				m.Err <- err
+				continue
+			}
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
 
-				if err := a.wal.WriteEntry(data); err != nil {
-					m.Err <- err
-					continue
-				}
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
 			}
 
 			m.replay <- response
 
-		case CancelOrderMsg:
-			response, events, err := a.engine.CancelOrderInternal(m.ID, m.UserID, m.Symbol)
+		case ModifyOrderMsg:
+			if a.abandoned(m.ctx, m.Err) {
+				continue
+			}
+			a.engine.Tick()
+			response, events, err := a.engine.ModifyOrderInternal(m.Symbol, m.OrderID, m.UserID, m.ClientModifyID, m.NewPrice, m.NewQuantity)
 
 			if err != nil {
 				m.Err <- err
 				continue
 			}
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
 
-			for _, event := range events {
-				event.Symbol = a.symbol
-				data, err := proto.Marshal(event)
-				if err != nil {
-					m.Err <- err
-					continue
-				}
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
+			}
 
-				go PublishEngineEvent(event)
+			m.replay <- response
 
-				if event.EventType == pbTypes.EventType_DEPTH || event.EventType == pbTypes.EventType_TICKER {
-					continue
-				}
+		case PlaceOrdersMsg:
+			if a.abandoned(m.ctx, m.Err) {
+				continue
+			}
+			a.engine.Tick()
+			results, events := a.engine.PlaceOrdersInternal(m.Orders, m.AllOrNothing)
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
 
-				if err := a.wal.writeEntry(data); err != nil {
-					m.Err <- err
-					continue
-				}
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
 			}
 
-			m.replay <- response
+			m.replay <- results
 
-		case ModifyOrderMsg:
-			response, events, err := a.engine.ModifyOrderInternal(m.Symbol, m.OrderID, m.UserID, m.ClientModifyID, m.NewPrice, m.NewQuantity)
+		case CancelReplaceOrdersMsg:
+			if a.abandoned(m.ctx, m.Err) {
+				continue
+			}
+			a.engine.Tick()
+			results, events := a.engine.CancelReplaceOrdersInternal(m.Modifies, m.AllOrNothing)
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
+
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
+			}
+
+			m.replay <- results
+
+		case MassCancelMsg:
+			if a.abandoned(m.ctx, m.Err) {
+				continue
+			}
+			a.engine.Tick()
+			cancelled, events, err := a.engine.MassCancelInternal(m.UserID, m.Side, m.Reason)
 
 			if err != nil {
 				m.Err <- err
 				continue
 			}
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
 
-			for _, event := range events {
-				event.Symbol = a.symbol
-				data, err := proto.Marshal(event)
-				if err != nil {
-					m.Err <- err
-					continue
-				}
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
+			}
 
-				go PublishEngineEvent(event)
+			m.replay <- cancelled
 
-				if event.EventType == pbTypes.EventType_DEPTH || event.EventType == pbTypes.EventType_TICKER {
-					continue
-				}
+		case TradingStateMsg:
+			a.engine.Tick()
+			response, events, err := a.engine.SetTradingState(m.State, m.Reason)
 
-				if err := a.wal.writeEntry(data); err != nil {
-					m.Err <- err
-					continue
-				}
+			if err != nil {
+				m.Err <- err
+				continue
+			}
+			events = append(events, a.engine.auctionIndicative()...)
+			events = append(events, a.engine.depthEvents(events)...)
+			events = append(events, a.engine.tickerEvents()...)
+
+			if err := a.writeEvents(events); err != nil {
+				m.Err <- err
+				continue
+			}
 
+			m.replay <- response
+
+		case SubscribeMsg:
+			a.engine.Tick()
+			a.addSubscriber(m.subscriber)
+			m.replay <- struct{}{}
+
+		case GetOrderMsg:
+			response, err := a.engine.getOrder(m.OrderID, m.UserID)
+			if err != nil {
+				m.Err <- err
+				continue
 			}
+			m.replay <- response
+
+		case ListOpenOrdersMsg:
+			m.replay <- a.engine.openOrders(m.UserID)
 
+		case OrderBookMsg:
+			a.engine.Tick()
+			response, err := a.engine.orderBook(m.Depth, m.Orders)
+			if err != nil {
+				m.Err <- err
+				continue
+			}
 			m.replay <- response
 
+		case SnapshotMsg:
+			m.replay <- a.engine.Snapshot(a.wal.LastSequenceNumber())
+
+		case TickerMsg:
+			a.engine.Tick()
+			if err := a.writeEvents(a.engine.tickerHeartbeat()); err != nil {
+				slog.Error("ticker heartbeat failed", "symbol", a.symbol, "err", err)
+			}
+
+		case StatusMsg:
+			m.replay <- a.engine.Status()
+
 		default:
 			panic("unknown actor message")
 		}
 
 	}
-}
 
-func (me *MatchingEngine) getDepthEvent() (*pb.EngineEvent, error) {
-	depthLevel := 100
-	bids := make([]*pb.PriceLevel, 0, depthLevel)
-	asks := make([]*pb.PriceLevel, 0, depthLevel)
+	close(a.done)
+}
 
-	temp := me.Bids.BestPriceLevel
-	for range depthLevel {
-		if temp == nil {
-			break
+// writeEvents stamps the events of one message, publishes them and appends all but the
+// market data (DEPTH, DEPTH_DIFF, L3, TICKER, AUCTION_INDICATIVE) to the WAL. It stops at the first event that fails.
+func (a *SymbolActor) writeEvents(events []*pb.EngineEvent) error {
+	for _, event := range events {
+		event.Symbol = a.symbol
+		event.EngineTimestamp = a.engine.timestamp()
+		data, err := proto.Marshal(event)
+		if err != nil {
+			return err
 		}
 
-		level := &pb.PriceLevel{
-			Price:      temp.Price,
-			OrderCount: int64(temp.OrderCount),
-			Quantity:   int64(temp.TotalVolume),
+		if err := a.engine.Idempotency.Record(event); err != nil {
+			slog.Error("failed to record event in the idempotency window", "symbol", a.symbol, "err", err)
 		}
-		bids = append(bids, level)
 
-		temp = temp.NextPrice
-	}
-
-	temp = me.Asks.BestPriceLevel
-	for range depthLevel {
-		if temp == nil {
-			break
+		a.publisher.publish(event)
+		a.broadcast(event)
+		if event.EventType == pbTypes.EventType_L3 && a.l3Feed != nil {
+			a.l3Feed.publish(event)
 		}
 
-		level := &pb.PriceLevel{
-			Price:      temp.Price,
-			OrderCount: int64(temp.OrderCount),
-			Quantity:   int64(temp.TotalVolume),
+		if isMarketDataEvent(event.EventType) {
+			continue
 		}
-		asks = append(asks, level)
 
-		temp = temp.NextPrice
+		if err := a.wal.WriteEntry(data); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+func (me *MatchingEngine) getDepthEvent() (*pb.EngineEvent, error) {
+	depthLevel := 100
+	bids := depthLevels(me.Bids, depthLevel)
+	asks := depthLevels(me.Asks, depthLevel)
+
 	depth := &pb.DepthEvent{
-		Symbol:    me.Symbol,
-		Sequence:  int64(me.TradeSequence),
-		Timestamp: timestamppb.Now(),
-		Bids:      bids,
-		Asks:      asks,
+		Symbol:       me.Symbol,
+		Sequence:     int64(me.TradeSequence),
+		BookSequence: me.BookSequence,
+		Timestamp:    me.timestamp(),
+		Bids:         bids,
+		Asks:         asks,
 	}
 
 	dataByte, err := proto.Marshal(depth)
@@ -1073,25 +1483,24 @@ func (me *MatchingEngine) getDepthEvent() (*pb.EngineEvent, error) {
 	return event, nil
 }
 
-func (me *MatchingEngine) getTickerEvent(lastPrice int64, bidPrice int64, askPrice int64) (*pb.EngineEvent, error) {
-	ticker := &pb.TickerEvent{
-		Symbol:    me.Symbol,
-		LastPrice: lastPrice,
-		BidPrice:  bidPrice,
-		AskPrice:  askPrice,
-	}
+// depthLevels lists the displayed part of the best levels. Levels holding only
+// hidden orders or iceberg reserves are skipped.
+func depthLevels(obs *OrderBookSide, depthLevel int) []*pb.PriceLevel {
+	levels := make([]*pb.PriceLevel, 0, depthLevel)
 
-	byteData, err := proto.Marshal(ticker)
-	if err != nil {
-		return nil, fmt.Errorf("failed to emit ticker event of symbol:%s", me.Symbol)
-	}
+	for temp := obs.BestPriceLevel; temp != nil && len(levels) < depthLevel; temp = temp.NextPrice {
+		if temp.DisplayedVolume == 0 {
+			continue
+		}
 
-	event := &pb.EngineEvent{
-		EventType: pbTypes.EventType_TICKER,
-		Data:      byteData,
+		levels = append(levels, &pb.PriceLevel{
+			Price:      temp.Price,
+			OrderCount: int64(temp.OrderCount - temp.HiddenOrderCount),
+			Quantity:   int64(temp.DisplayedVolume),
+		})
 	}
 
-	return event, nil
+	return levels
 }
 
 func (a *SymbolActor) replayWal(from uint64) error {
@@ -1107,6 +1516,18 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			return err
 		}
 
+		if logData.EngineTimestamp != nil {
+			a.engine.SetTime(logData.EngineTimestamp.AsTime())
+		}
+
+		if logData.BookSequence > 0 {
+			a.engine.BookSequence = logData.BookSequence
+		}
+
+		if err := a.engine.Idempotency.Record(&logData); err != nil {
+			return err
+		}
+
 		switch logData.EventType {
 		case pbTypes.EventType_ORDER_ACCEPTED:
 			var event pb.OrderStatusEvent
@@ -1117,26 +1538,12 @@ func (a *SymbolActor) replayWal(from uint64) error {
 
 			fmt.Println("SequenceNumber", log.SequenceNumber, "EventType", logData.EventType, "orderid", event.OrderId)
 
-			order := &Order{
-				Symbol:        event.Symbol,
-				Status:        event.Status,
-				UserID:        event.UserId,
-				ClientOrderID: event.OrderId,
-				Side:          event.Side,
-				Type:          event.Type,
-
-				Price:         event.Price,
-				AveragePrice:  event.AveragePrice,
-				ExecutedValue: event.ExecutedValue,
-
-				Quantity:          event.Quantity,
-				FilledQuantity:    event.FilledQuantity,
-				RemainingQuantity: event.RemainingQuantity,
-				CancelledQuantity: event.CancelledQuantity,
-
-				ClientTimestamp:  event.ClientTimestamp,
-				GatewayTimestamp: event.GatewayTimestamp,
-				EngineTimestamp:  event.EngineTimestamp,
+			order := OrderFromStatusEvent(&event)
+
+			if isStopOrder(order.Type) {
+				a.engine.Stops.Add(order)
+				a.engine.indexOrder(order)
+				continue
 			}
 
 			obs := a.engine.Asks
@@ -1147,6 +1554,34 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			priceLevel := obs.GetOrCreatePriceLevel(order.Price)
 			priceLevel.Push(order)
 			a.engine.AllOrders[order.ClientOrderID] = order
+			a.engine.indexOrder(order)
+
+		case pbTypes.EventType_ORDER_TRIGGERED:
+			var event pb.OrderStatusEvent
+
+			if err := proto.Unmarshal(logData.GetData(), &event); err != nil {
+				return err
+			}
+
+			order, exists := a.engine.Stops.Orders[event.OrderId]
+			if !exists {
+				return fmt.Errorf("Failed to process ORDER_TRIGGERED event %s", event.OrderId)
+			}
+
+			// Move it from the trigger book to the visible book, the same way ORDER_ACCEPTED does
+			a.engine.removeFromBook(order)
+			order.Type = event.Type
+			order.Status = event.Status
+
+			obs := a.engine.Asks
+			if order.Side == pbTypes.Side_BUY {
+				obs = a.engine.Bids
+			}
+
+			priceLevel := obs.GetOrCreatePriceLevel(order.Price)
+			priceLevel.Push(order)
+			a.engine.AllOrders[order.ClientOrderID] = order
+			a.engine.indexOrder(order)
 
 		case pbTypes.EventType_TRADE_EXECUTED:
 			var event pb.TradeEvent
@@ -1172,8 +1607,26 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			}
 			fmt.Println("SequenceNumber", log.SequenceNumber, "EventType", logData.EventType, "buyerorder", buyOrder, "sellerorder", sellOrder, "tradeQuantity", event.Quantity)
 
-			restingOrder.RemainingQuantity -= event.Quantity
-			order.RemainingQuantity -= event.Quantity
+			// Both sides are in the book during replay, so release the volume from each level.
+			// The resting side is filled like live matching (same iceberg refreshes); the aggressor
+			// only shrinks, since live it rests with a fresh slice after matching.
+			switch {
+			case event.Auction:
+				// Uncross trades fill both resting orders the same way
+				order.PriceLevel.Fill(order, event.Quantity)
+				restingOrder.PriceLevel.Fill(restingOrder, event.Quantity)
+			default:
+				if restingOrder.PriceLevel != nil {
+					restingOrder.PriceLevel.Fill(restingOrder, event.Quantity)
+				} else {
+					restingOrder.RemainingQuantity -= event.Quantity
+				}
+				if order.PriceLevel != nil {
+					order.PriceLevel.Reduce(order, event.Quantity)
+				} else {
+					order.RemainingQuantity -= event.Quantity
+				}
+			}
 
 			restingOrder.FilledQuantity += event.Quantity
 			order.FilledQuantity += event.Quantity
@@ -1187,6 +1640,9 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			a.engine.TotalMatches++
 			a.engine.TotalVolume += uint64(event.Quantity)
 			a.engine.TradeSequence++
+			a.engine.LastTradePrice = event.Price
+			a.engine.breaker.observe(a.engine.now, event.Price)
+			a.engine.stats.observe(a.engine.now, event.Price, event.Quantity)
 
 			// We emit the Filled event separately and perform the same handling there.
 			// If we process it here as well, the Filled handler will run after the order
@@ -1236,26 +1692,18 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			}
 			fmt.Println("SequenceNumber", log.SequenceNumber, "EventType", logData.EventType, "orderid", event.OrderId)
 
-			order := a.engine.AllOrders[event.OrderId]
-			level := order.PriceLevel
+			order, exists := a.engine.findOrder(event.OrderId)
+			if !exists {
+				return fmt.Errorf("Failed to process ORDER_CANCELLED event %s", event.OrderId)
+			}
+
+			a.engine.removeFromBook(order)
 
 			order.CancelledQuantity = event.CancelledQuantity
 			order.RemainingQuantity = 0
 
 			order.Status = pbTypes.OrderStatus_CANCELLED
 
-			level.Remove(order)
-			delete(a.engine.AllOrders, order.ClientOrderID)
-
-			obs := a.engine.Asks
-			if order.Side == pbTypes.Side_BUY {
-				obs = a.engine.Bids
-			}
-
-			if level.IsEmpty() {
-				obs.RemovePriceLevel(level)
-			}
-
 		case pbTypes.EventType_ORDER_REDUCED:
 			var event pb.OrderReducedEvent
 
@@ -1264,15 +1712,17 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			}
 			fmt.Println("SequenceNumber", log.SequenceNumber, "EventType", logData.EventType, "orderid", event.Order.OrderId)
 
-			order := a.engine.AllOrders[event.Order.OrderId]
+			order, exists := a.engine.findOrder(event.Order.OrderId)
+			if !exists {
+				return fmt.Errorf("Failed to process ORDER_REDUCED event %s", event.Order.OrderId)
+			}
 			// level := order.PriceLevel
 
-			// order.Quantity = event.NewQuantity
-			order.RemainingQuantity = event.NewRemainingQuantity
-			order.CancelledQuantity = event.NewCancelledQuantity
-
+			// Applied as deltas: a self-trade reduce is logged after the trades of the same order
 			volumeDelta := event.OldRemainingQuantity - event.NewRemainingQuantity
-			order.PriceLevel.TotalVolume -= uint64(volumeDelta)
+			order.CancelledQuantity += event.NewCancelledQuantity - event.OldCancelledQuantity
+			order.CancelReason = event.Order.CancelReason
+			order.PriceLevel.Reduce(order, volumeDelta)
 			fmt.Println("At the end of reduced replay function", "SequenceNumber", log.SequenceNumber, "EventType", logData.EventType, "order", order)
 
 			// if order.RemainingQuantity == 0 {
@@ -1297,24 +1747,21 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			}
 			fmt.Println("SequenceNumber", log.SequenceNumber, "EventType", logData.EventType, "orderid", event.OrderId)
 
-			order, exists := a.engine.AllOrders[event.OrderId]
+			order, exists := a.engine.findOrder(event.OrderId)
 			if !exists {
 				continue
 			}
 
-			level := order.PriceLevel
+			a.engine.removeFromBook(order)
 
-			level.Remove(order)
-			delete(a.engine.AllOrders, order.ClientOrderID)
+		case pbTypes.EventType_TRADING_STATE_CHANGED:
+			var event pb.TradingStateEvent
 
-			obs := a.engine.Asks
-			if order.Side == pbTypes.Side_BUY {
-				obs = a.engine.Bids
+			if err := proto.Unmarshal(logData.GetData(), &event); err != nil {
+				return err
 			}
 
-			if level.IsEmpty() {
-				obs.RemovePriceLevel(level)
-			}
+			a.engine.applyTradingState(event.State)
 
 		case pbTypes.EventType_ORDER_FILLED:
 			var event pb.OrderStatusEvent
@@ -1328,19 +1775,8 @@ func (a *SymbolActor) replayWal(from uint64) error {
 			if !exists {
 				return fmt.Errorf("Failed to process ORDER_FILLED event %s", event.OrderId)
 			}
-			level := order.PriceLevel
-
-			level.Remove(order)
-			delete(a.engine.AllOrders, order.ClientOrderID)
 
-			obs := a.engine.Asks
-			if order.Side == pbTypes.Side_BUY {
-				obs = a.engine.Bids
-			}
-
-			if level.IsEmpty() {
-				obs.RemovePriceLevel(level)
-			}
+			a.engine.removeFromBook(order)
 
 		default:
 			continue
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+==================================================================
+========================= Engine Errors ==========================
+==================================================================
+*/
+
+// EngineError is a request the engine refused. The gRPC server turns it into a status with
+// Code and an EngineError detail carrying Reason, so clients can tell a retry that may
+// succeed from one that never will without parsing Message.
+type EngineError struct {
+	Code    codes.Code
+	Reason  pbTypes.RejectReason
+	Message string
+}
+
+func (e *EngineError) Error() string {
+	return e.Message
+}
+
+func (e *EngineError) GRPCStatus() *status.Status {
+	st := status.New(e.Code, e.Message)
+	detailed, err := st.WithDetails(&pb.EngineError{RejectReason: e.Reason, Message: e.Message})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+func engineError(code codes.Code, reason pbTypes.RejectReason, format string, args ...any) error {
+	return &EngineError{Code: code, Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidArgument(reason pbTypes.RejectReason, format string, args ...any) error {
+	return engineError(codes.InvalidArgument, reason, format, args...)
+}
+
+func failedPrecondition(reason pbTypes.RejectReason, format string, args ...any) error {
+	return engineError(codes.FailedPrecondition, reason, format, args...)
+}
+
+func unknownSymbol(symbol string) error {
+	return engineError(codes.NotFound, pbTypes.RejectReason_REJECT_REASON_UNKNOWN_SYMBOL, "unknown symbol %s", symbol)
+}
+
+func orderNotFound(format string, args ...any) error {
+	return engineError(codes.NotFound, pbTypes.RejectReason_REJECT_REASON_ORDER_NOT_FOUND, format, args...)
+}
+
+func notOrderOwner(format string, args ...any) error {
+	return engineError(codes.PermissionDenied, pbTypes.RejectReason_REJECT_REASON_NOT_ORDER_OWNER, format, args...)
+}
+
+func duplicateID(format string, args ...any) error {
+	return engineError(codes.AlreadyExists, pbTypes.RejectReason_REJECT_REASON_DUPLICATE_ID, format, args...)
+}
+
+// rejectReason is the reason behind err, for the responses that report failures per item.
+func rejectReason(err error) pbTypes.RejectReason {
+	var engineErr *EngineError
+	if errors.As(err, &engineErr) {
+		return engineErr.Reason
+	}
+	return pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED
+}
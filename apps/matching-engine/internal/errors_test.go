@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testClient is a client of a Server listening in memory.
+func testClient(t *testing.T) pb.MatchingEngineClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterMatchingEngineServer(server, &Server{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///engine",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMatchingEngineClient(conn)
+}
+
+func TestErrorsReachClientsWithCodeAndReason(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	runTestActor(t, a)
+	registerTestActor(t, a)
+
+	client := testClient(t)
+	ctx := context.Background()
+
+	place := func(id string, userID string, symbol string) error {
+		_, err := client.PlaceOrder(ctx, &pb.PlaceOrderRequest{Symbol: symbol, ClientOrderId: id, UserId: userID, Side: pbTypes.Side_BUY, Type: pbTypes.OrderType_LIMIT, Price: 99, Quantity: 5})
+		return err
+	}
+	if err := place("o1", "u", testSymbol); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		call   func() error
+		code   codes.Code
+		reason pbTypes.RejectReason
+	}{
+		{"place on an unknown symbol", func() error { return place("o2", "u", "NOPE") }, codes.NotFound, pbTypes.RejectReason_REJECT_REASON_UNKNOWN_SYMBOL},
+		{"place with the id of another user's order", func() error { return place("o1", "v", testSymbol) }, codes.AlreadyExists, pbTypes.RejectReason_REJECT_REASON_DUPLICATE_ID},
+		{"cancel an unknown order", func() error {
+			_, err := client.CancelOrder(ctx, &pb.CancelOrderRequest{Symbol: testSymbol, Id: "nope", UserId: "u"})
+			return err
+		}, codes.NotFound, pbTypes.RejectReason_REJECT_REASON_ORDER_NOT_FOUND},
+		{"cancel another user's order", func() error {
+			_, err := client.CancelOrder(ctx, &pb.CancelOrderRequest{Symbol: testSymbol, Id: "o1", UserId: "v"})
+			return err
+		}, codes.PermissionDenied, pbTypes.RejectReason_REJECT_REASON_NOT_ORDER_OWNER},
+		{"modify below the executed quantity", func() error {
+			_, err := client.ModifyOrder(ctx, &pb.ModifyOrderRequest{Symbol: testSymbol, OrderId: "o1", UserId: "u", ClientModifyId: "m1", NewQuantity: int64Ptr(-1)})
+			return err
+		}, codes.InvalidArgument, pbTypes.RejectReason_REJECT_REASON_INVALID_QUANTITY},
+		{"replace with the id of an open order", func() error {
+			_, err := client.ModifyOrder(ctx, &pb.ModifyOrderRequest{Symbol: testSymbol, OrderId: "o1", UserId: "u", ClientModifyId: "o1", NewPrice: int64Ptr(98)})
+			return err
+		}, codes.AlreadyExists, pbTypes.RejectReason_REJECT_REASON_DUPLICATE_ID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, ok := status.FromError(tt.call())
+			if !ok || st.Code() != tt.code {
+				t.Fatalf("status %v, want %v", st, tt.code)
+			}
+
+			details := st.Details()
+			if len(details) != 1 {
+				t.Fatalf("details %v", details)
+			}
+			detail, ok := details[0].(*pb.EngineError)
+			if !ok || detail.GetRejectReason() != tt.reason || detail.GetMessage() != st.Message() {
+				t.Fatalf("detail %v, want %v with the status message %q", details[0], tt.reason, st.Message())
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+const testSymbol = "TEST"
+
+// newTestActor is an actor for testSymbol on a WAL in dir, without Kafka or background
+// workers. Small segments make the tests rotate the WAL. It is not running.
+func newTestActor(t *testing.T, dir string) *SymbolActor {
+	t.Helper()
+
+	wal, err := OpenWAL(dir, testSymbol, 1024, false, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := OpenSnapshotStore(dir, testSymbol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &SymbolActor{
+		symbol:      testSymbol,
+		inbox:       make(chan EngineMsg, 128),
+		cancelInbox: make(chan EngineMsg, 128),
+		engine:      NewMatchingEngine(testSymbol, wal),
+		queued:      newQueuedOrders(),
+		wal:         wal,
+		publisher:   newRedisPublisher(testSymbol),
+		snapshots:   snapshots,
+		subscribers: make(map[string]*subscriber),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// runTestActor starts an actor and returns stop, which drains it and closes its WAL so the
+// WAL can be replayed. stop also runs at the end of the test.
+func runTestActor(t *testing.T, a *SymbolActor) func() {
+	t.Helper()
+
+	go a.publisher.run()
+	go a.Run()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(a.inbox)
+			close(a.cancelInbox)
+			<-a.done
+			a.publisher.close()
+			if err := a.wal.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// recoverTestActor restores a from the snapshots and the WAL in its directory the way start
+// does, without starting it.
+func recoverTestActor(t *testing.T, a *SymbolActor) {
+	t.Helper()
+
+	from, err := a.loadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.replayWal(from); err != nil {
+		t.Fatal(err)
+	}
+	a.engine.resetDepthTracking(a.wal.LastSequenceNumber())
+}
+
+// subscribeTestActor subscribes to the events a sends. Call it before the actor runs.
+func subscribeTestActor(a *SymbolActor) *subscriber {
+	sub := newSubscriber("test")
+	a.subscribers[sub.gatewayID] = sub
+	return sub
+}
+
+// receivedEvents takes the events of eventType the subscriber got so far.
+func receivedEvents(sub *subscriber, eventType pbTypes.EventType) []*pb.EngineEvent {
+	events := []*pb.EngineEvent{}
+	for {
+		select {
+		case event := <-sub.events:
+			if event.EventType == eventType {
+				events = append(events, event)
+			}
+		default:
+			return events
+		}
+	}
+}
+
+// registerTestActor makes a reachable through the package-level calls for testSymbol.
+func registerTestActor(t *testing.T, a *SymbolActor) {
+	t.Helper()
+
+	actorsMu.Lock()
+	actors[testSymbol] = a
+	actorsMu.Unlock()
+
+	t.Cleanup(func() {
+		actorsMu.Lock()
+		delete(actors, testSymbol)
+		actorsMu.Unlock()
+	})
+}
+
+// replayedBook is the book a fresh actor rebuilds from the WAL in dir.
+func replayedBook(t *testing.T, dir string) string {
+	t.Helper()
+
+	b := newTestActor(t, dir)
+	defer b.wal.Close()
+
+	if err := b.replayWal(0); err != nil {
+		t.Fatal(err)
+	}
+	return bookState(b.engine)
+}
+
+func placeTestOrder(t *testing.T, a *SymbolActor, order *Order) *AddOrderInternalResponse {
+	t.Helper()
+
+	order.Symbol = testSymbol
+	order.RemainingQuantity = order.Quantity
+
+	replay := make(chan *AddOrderInternalResponse, 1)
+	errCh := make(chan error, 1)
+	if err := a.send(context.Background(), PlaceOrderMsg{ctx: context.Background(), Order: order, replay: replay, Err: errCh}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-replay:
+		return res
+	case err := <-errCh:
+		t.Fatalf("place %s: %v", order.ClientOrderID, err)
+		return nil
+	}
+}
+
+func cancelTestOrder(t *testing.T, a *SymbolActor, id string, userID string) {
+	t.Helper()
+
+	replay := make(chan *CancelOrderInternalResponse, 1)
+	errCh := make(chan error, 1)
+	if err := a.send(context.Background(), CancelOrderMsg{ctx: context.Background(), ID: id, UserID: userID, Symbol: testSymbol, replay: replay, Err: errCh}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-replay:
+	case err := <-errCh:
+		t.Fatalf("cancel %s: %v", id, err)
+	}
+}
+
+func modifyTestOrder(t *testing.T, a *SymbolActor, id string, userID string, modifyID string, newPrice *int64, newQuantity *int64) {
+	t.Helper()
+
+	if _, err := tryModifyTestOrder(t, a, id, userID, modifyID, newPrice, newQuantity); err != nil {
+		t.Fatalf("modify %s: %v", id, err)
+	}
+}
+
+// tryModifyTestOrder is modifyTestOrder for modifies the test expects to fail.
+func tryModifyTestOrder(t *testing.T, a *SymbolActor, id string, userID string, modifyID string, newPrice *int64, newQuantity *int64) (*ModifyOrderInternalResponse, error) {
+	t.Helper()
+
+	replay := make(chan *ModifyOrderInternalResponse, 1)
+	errCh := make(chan error, 1)
+	if err := a.send(context.Background(), ModifyOrderMsg{ctx: context.Background(), OrderID: id, UserID: userID, ClientModifyID: modifyID, Symbol: testSymbol, NewPrice: newPrice, NewQuantity: newQuantity, replay: replay, Err: errCh}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case response := <-replay:
+		return response, nil
+	case err := <-errCh:
+		return nil, err
+	}
+}
+
+func limitOrder(id string, userID string, side pbTypes.Side, price int64, quantity int64) *Order {
+	return &Order{ClientOrderID: id, UserID: userID, Side: side, Type: pbTypes.OrderType_LIMIT, Price: price, Quantity: quantity}
+}
+
+func marketOrder(id string, userID string, side pbTypes.Side, quantity int64) *Order {
+	return &Order{ClientOrderID: id, UserID: userID, Side: side, Type: pbTypes.OrderType_MARKET, Quantity: quantity}
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+// testClock is an engine clock the test moves by hand.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// bookState prints everything replay and snapshots must rebuild: the levels of both sides
+// and of the trigger book with their orders, the idempotency window, the user index and the
+// counters, the book sequence among them. It flags volumes or index entries that disagree
+// with the orders.
+func bookState(me *MatchingEngine) string {
+	var b strings.Builder
+
+	for _, obs := range []*OrderBookSide{me.Bids, me.Asks, me.Stops.BuyStops, me.Stops.SellStops} {
+		for level := obs.BestPriceLevel; level != nil; level = level.NextPrice {
+			fmt.Fprintf(&b, "%d vol=%d displayed=%d orders=%d hidden=%d:", level.Price, level.TotalVolume, level.DisplayedVolume, level.OrderCount, level.HiddenOrderCount)
+
+			var volume, displayed int64
+			for order := level.HeadOrder; order != nil; order = order.Next {
+				fmt.Fprintf(&b, " %s(%d/%d/%d v%d)", order.ClientOrderID, order.Quantity, order.RemainingQuantity, order.FilledQuantity, order.VisibleQuantity)
+				volume += order.RemainingQuantity
+				displayed += order.DisplayedQuantity()
+			}
+			if uint64(volume) != level.TotalVolume || uint64(displayed) != level.DisplayedVolume {
+				fmt.Fprintf(&b, " VOLUME MISMATCH(%d, %d)", volume, displayed)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("--\n")
+	}
+
+	for _, record := range me.Idempotency.Snapshot() {
+		fmt.Fprintf(&b, "seen %s modify=%v %s %s %v %d\n", record.ClientId, record.IsModify, record.OrderId, record.NewOrderId, record.GetOrder().GetStatus(), record.GetOrder().GetRemainingQuantity())
+	}
+
+	indexed := 0
+	for userID, orders := range me.UserOrders {
+		for id, order := range orders {
+			indexed++
+			if found, ok := me.findOrder(id); !ok || found != order || order.UserID != userID {
+				fmt.Fprintf(&b, "INDEX MISMATCH %s\n", id)
+			}
+		}
+	}
+	if open := len(me.AllOrders) + len(me.Stops.Orders); indexed != open {
+		fmt.Fprintf(&b, "INDEX MISMATCH %d indexed, %d open\n", indexed, open)
+	}
+
+	ids := make([]string, 0, len(me.AllOrders))
+	for id := range me.AllOrders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	fmt.Fprintf(&b, "orders=%v trades=%d matches=%d volume=%d last=%d stops=%d book=%d\n", ids, me.TradeSequence, me.TotalMatches, me.TotalVolume, me.LastTradePrice, len(me.Stops.Orders), me.BookSequence)
+
+	return b.String()
+}
+
+// checkBook fails the test when bookState flags a mismatch.
+func checkBook(t *testing.T, me *MatchingEngine) string {
+	t.Helper()
+
+	state := bookState(me)
+	if strings.Contains(state, "MISMATCH") {
+		t.Fatalf("inconsistent book:\n%s", state)
+	}
+	return state
+}
+
+// walEvents decodes the engine events in the WAL of a stopped actor, in order.
+func walEvents(t *testing.T, a *SymbolActor) []*pb.EngineEvent {
+	t.Helper()
+
+	logs, err := a.wal.ReadFromToLast(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]*pb.EngineEvent, 0, len(logs))
+	for _, log := range logs {
+		var event pb.EngineEvent
+		if err := proto.Unmarshal(log.GetData(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &event)
+	}
+	return events
+}
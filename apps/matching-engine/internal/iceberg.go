@@ -0,0 +1,109 @@
+package internal
+
+import (
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+/*
+==================================================================
+================ Iceberg & Hidden Order Management ===============
+==================================================================
+*/
+
+func (o *Order) isIceberg() bool {
+	return o.DisplayQuantity > 0
+}
+
+// DisplayedQuantity is the part of a resting order that shows in depth.
+func (o *Order) DisplayedQuantity() int64 {
+	switch {
+	case o.Hidden:
+		return 0
+	case o.isIceberg():
+		return o.VisibleQuantity
+	default:
+		return o.RemainingQuantity
+	}
+}
+
+// matchableQuantity is how much a resting order trades before an iceberg has to refresh.
+func (o *Order) matchableQuantity() int64 {
+	if o.isIceberg() {
+		return o.VisibleQuantity
+	}
+	return o.RemainingQuantity
+}
+
+func (o *Order) refillVisibleQuantity() {
+	if o.isIceberg() {
+		o.VisibleQuantity = min(o.DisplayQuantity, o.RemainingQuantity)
+	}
+}
+
+// checkDisplay validates the iceberg / hidden settings and returns a reject message when they are invalid.
+func checkDisplay(order *Order) string {
+	if order.DisplayQuantity == 0 && !order.Hidden {
+		return ""
+	}
+
+	if order.Type != pbTypes.OrderType_LIMIT {
+		return "Iceberg and hidden orders must be LIMIT orders"
+	}
+
+	if order.Hidden && order.DisplayQuantity != 0 {
+		return "Hidden orders cannot have a display quantity"
+	}
+
+	if order.DisplayQuantity < 0 {
+		return "Display quantity cannot be negative"
+	}
+
+	return ""
+}
+
+// Fill takes traded quantity out of a resting order. An iceberg whose visible slice is used up
+// is refilled from its reserve and goes to the back of the FIFO, like a newly placed order.
+func (pl *PriceLevel) Fill(order *Order, quantity int64) {
+	pl.touch()
+	displayed := order.DisplayedQuantity()
+
+	order.RemainingQuantity -= quantity
+	if order.isIceberg() {
+		order.VisibleQuantity -= quantity
+	}
+
+	pl.TotalVolume -= uint64(quantity)
+	pl.DisplayedVolume -= uint64(displayed - order.DisplayedQuantity())
+
+	if order.isIceberg() && order.VisibleQuantity == 0 && order.RemainingQuantity > 0 {
+		pl.Remove(order)
+		order.refillVisibleQuantity()
+		pl.Push(order)
+	}
+}
+
+// Reduce takes cancelled quantity out of a resting order. An iceberg loses its reserve first,
+// so the displayed slice only shrinks once the reserve is gone.
+func (pl *PriceLevel) Reduce(order *Order, quantity int64) {
+	pl.touch()
+	displayed := order.DisplayedQuantity()
+
+	order.RemainingQuantity -= quantity
+	if order.isIceberg() {
+		order.VisibleQuantity = min(order.VisibleQuantity, order.RemainingQuantity)
+	}
+
+	pl.TotalVolume -= uint64(quantity)
+	pl.DisplayedVolume -= uint64(displayed - order.DisplayedQuantity())
+}
+
+// BestDisplayedPrice is the best price with displayed volume, so a level holding only
+// hidden orders does not leak through the ticker.
+func (obs *OrderBookSide) BestDisplayedPrice() (int64, bool) {
+	for level := obs.BestPriceLevel; level != nil; level = level.NextPrice {
+		if level.DisplayedVolume > 0 {
+			return level.Price, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+func icebergOrder(id string, userID string, side pbTypes.Side, price int64, quantity int64, display int64) *Order {
+	order := limitOrder(id, userID, side, price, quantity)
+	order.DisplayQuantity = display
+	return order
+}
+
+func hiddenOrder(id string, userID string, side pbTypes.Side, price int64, quantity int64) *Order {
+	order := limitOrder(id, userID, side, price, quantity)
+	order.Hidden = true
+	return order
+}
+
+// levelQueue lists the orders resting at price on obs, head first, each with its displayed
+// quantity, followed by the level's displayed volume.
+func levelQueue(obs *OrderBookSide, price int64) string {
+	for level := obs.BestPriceLevel; level != nil; level = level.NextPrice {
+		if level.Price != price {
+			continue
+		}
+		queue := []string{}
+		for order := level.HeadOrder; order != nil; order = order.Next {
+			queue = append(queue, fmt.Sprintf("%s:%d", order.ClientOrderID, order.DisplayedQuantity()))
+		}
+		return fmt.Sprintf("%v displayed=%d", queue, level.DisplayedVolume)
+	}
+	return "no level"
+}
+
+func TestIcebergRefillGoesToTheBack(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, icebergOrder("ice", "s", pbTypes.Side_SELL, 100, 10, 3))
+	placeTestOrder(t, a, limitOrder("plain", "s", pbTypes.Side_SELL, 100, 5))
+	if got := levelQueue(a.engine.Asks, 100); got != "[ice:3 plain:5] displayed=8" {
+		t.Fatalf("asks %s", got)
+	}
+
+	// Taking 2 of the slice keeps ice at the head
+	placeTestOrder(t, a, marketOrder("m1", "b", pbTypes.Side_BUY, 2))
+	if got := levelQueue(a.engine.Asks, 100); got != "[ice:1 plain:5] displayed=6" {
+		t.Fatalf("after m1 %s", got)
+	}
+
+	// Using up the slice refills it from the reserve behind plain; the rest of m2 goes to plain
+	res := placeTestOrder(t, a, marketOrder("m2", "b", pbTypes.Side_BUY, 3))
+	if len(res.Trades) != 2 || res.Trades[0].SellOrderID != "ice" || res.Trades[0].Quantity != 1 || res.Trades[1].SellOrderID != "plain" {
+		t.Fatalf("m2 trades %+v", res.Trades)
+	}
+	if got := levelQueue(a.engine.Asks, 100); got != "[plain:3 ice:3] displayed=6" {
+		t.Fatalf("after m2 %s", got)
+	}
+
+	// An incoming iceberg trades its full quantity before resting with a fresh slice
+	res = placeTestOrder(t, a, icebergOrder("ice2", "b", pbTypes.Side_BUY, 100, 12, 2))
+	if res.Order.FilledQuantity != 10 || a.engine.AllOrders["ice"] != nil {
+		t.Fatalf("ice2: %+v", res.Order)
+	}
+	if got := levelQueue(a.engine.Bids, 100); got != "[ice2:2] displayed=2" {
+		t.Fatalf("bids %s", got)
+	}
+
+	want := checkBook(t, a.engine)
+	stop()
+
+	if got := replayedBook(t, dir); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestIcebergReduceTakesTheReserveFirst(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, icebergOrder("ice", "s", pbTypes.Side_SELL, 100, 10, 4))
+	placeTestOrder(t, a, limitOrder("plain", "s", pbTypes.Side_SELL, 100, 5))
+
+	// 1 off the slice leaves ice showing 3 of its 4
+	placeTestOrder(t, a, marketOrder("m1", "b", pbTypes.Side_BUY, 1))
+
+	// The new quantity counts what is already gone: 7 leaves 6, which only cuts the hidden
+	// reserve, so the slice still shows 3 and ice keeps its place
+	modifyTestOrder(t, a, "ice", "s", "ice-m1", nil, int64Ptr(7))
+	if got := levelQueue(a.engine.Asks, 100); got != "[ice:3 plain:5] displayed=8" {
+		t.Fatalf("after 7 %s", got)
+	}
+
+	// 6 leaves 2, past the reserve, so the slice shrinks with it
+	modifyTestOrder(t, a, "ice", "s", "ice-m2", nil, int64Ptr(6))
+	if got := levelQueue(a.engine.Asks, 100); got != "[ice:2 plain:5] displayed=7" {
+		t.Fatalf("after 6 %s", got)
+	}
+	if ice := a.engine.AllOrders["ice"]; ice.RemainingQuantity != 2 || ice.VisibleQuantity != 2 {
+		t.Fatalf("ice: %+v", ice)
+	}
+
+	// Self-trade decrement reduces the same way
+	placeTestOrder(t, a, icebergOrder("ice3", "u", pbTypes.Side_BUY, 90, 9, 2))
+	placeTestOrder(t, a, selfTradeOrder("own", "u", pbTypes.Side_SELL, 90, 4, pbTypes.SelfTradePrevention_STP_DECREMENT_AND_CANCEL))
+	if got := levelQueue(a.engine.Bids, 90); got != "[ice3:2] displayed=2" {
+		t.Fatalf("bids %s", got)
+	}
+	if ice3 := a.engine.AllOrders["ice3"]; ice3.RemainingQuantity != 5 {
+		t.Fatalf("ice3: %+v", ice3)
+	}
+
+	want := checkBook(t, a.engine)
+	stop()
+
+	if got := replayedBook(t, dir); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHiddenOrdersKeepTheirPlace(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, hiddenOrder("hidden", "s", pbTypes.Side_SELL, 100, 4))
+	placeTestOrder(t, a, limitOrder("shown", "s", pbTypes.Side_SELL, 100, 5))
+	placeTestOrder(t, a, hiddenOrder("only-hidden", "s", pbTypes.Side_SELL, 99, 2))
+
+	// The hidden level does not show as the best price, and hidden orders are left out of depth
+	if price, ok := a.engine.Asks.BestDisplayedPrice(); !ok || price != 100 {
+		t.Fatalf("best displayed %d %v", price, ok)
+	}
+	if got := levelQueue(a.engine.Asks, 100); got != "[hidden:0 shown:5] displayed=5" {
+		t.Fatalf("asks %s", got)
+	}
+	if level := a.engine.Asks.BestPriceLevel.NextPrice; level.OrderCount-level.HiddenOrderCount != 1 {
+		t.Fatalf("displayed orders %d", level.OrderCount-level.HiddenOrderCount)
+	}
+
+	// Hidden orders still trade first at the better price and in time order at their own
+	res := placeTestOrder(t, a, marketOrder("m1", "b", pbTypes.Side_BUY, 6))
+	if len(res.Trades) != 2 || res.Trades[0].SellOrderID != "only-hidden" || res.Trades[1].SellOrderID != "hidden" || res.Trades[1].Quantity != 4 {
+		t.Fatalf("m1 trades %+v", res.Trades)
+	}
+	if got := levelQueue(a.engine.Asks, 100); got != "[shown:5] displayed=5" {
+		t.Fatalf("after m1 %s", got)
+	}
+
+	want := checkBook(t, a.engine)
+	stop()
+
+	if got := replayedBook(t, dir); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestIcebergDisplayedVolumeAfterReplay(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, icebergOrder("ice1", "s", pbTypes.Side_SELL, 100, 20, 5))
+	placeTestOrder(t, a, icebergOrder("ice2", "s", pbTypes.Side_SELL, 100, 7, 3))
+	placeTestOrder(t, a, hiddenOrder("hidden", "s", pbTypes.Side_SELL, 100, 6))
+	placeTestOrder(t, a, limitOrder("plain", "s", pbTypes.Side_SELL, 101, 4))
+
+	placeTestOrder(t, a, marketOrder("m1", "b", pbTypes.Side_BUY, 7))
+	modifyTestOrder(t, a, "ice1", "s", "ice1-m3", nil, int64Ptr(12))
+	placeTestOrder(t, a, limitOrder("b1", "b", pbTypes.Side_BUY, 100, 9))
+	cancelTestOrder(t, a, "plain", "s")
+
+	want := checkBook(t, a.engine)
+	displayed := a.engine.Asks.BestPriceLevel.DisplayedVolume
+	stop()
+
+	b := newTestActor(t, dir)
+	defer b.wal.Close()
+	if err := b.replayWal(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkBook(t, b.engine); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+	if got := b.engine.Asks.BestPriceLevel.DisplayedVolume; got != displayed {
+		t.Fatalf("displayed volume %d, want %d", got, displayed)
+	}
+}
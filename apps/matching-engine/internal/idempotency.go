@@ -0,0 +1,186 @@
+package internal
+
+import (
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+const defaultIdempotencyWindowSize = 100_000
+
+/*
+==================================================================
+================ Order / Modify Idempotency Window ===============
+==================================================================
+*/
+
+type idempotencyKey struct {
+	clientID string
+	isModify bool
+}
+
+// IdempotencyWindow remembers the most recent client_order_ids and client_modify_ids of a
+// symbol, so a retry gets the original result back instead of executing again. It is fed
+// only from WAL events, live and in replay alike, so a restart rebuilds the same window.
+type IdempotencyWindow struct {
+	capacity int
+	ring     []idempotencyKey // insertion order, oldest at next once full
+	next     int
+	records  map[idempotencyKey]*pb.IdempotencyRecord
+}
+
+func NewIdempotencyWindow(capacity int) *IdempotencyWindow {
+	if capacity <= 0 {
+		capacity = defaultIdempotencyWindowSize
+	}
+
+	return &IdempotencyWindow{
+		capacity: capacity,
+		ring:     make([]idempotencyKey, 0, capacity),
+		records:  make(map[idempotencyKey]*pb.IdempotencyRecord),
+	}
+}
+
+func (iw *IdempotencyWindow) put(record *pb.IdempotencyRecord) {
+	key := idempotencyKey{clientID: record.GetClientId(), isModify: record.GetIsModify()}
+
+	// Already tracked: refresh the record but keep its place in the window
+	if _, exists := iw.records[key]; exists {
+		iw.records[key] = record
+		return
+	}
+
+	if len(iw.ring) < iw.capacity {
+		iw.ring = append(iw.ring, key)
+	} else {
+		delete(iw.records, iw.ring[iw.next])
+		iw.ring[iw.next] = key
+		iw.next = (iw.next + 1) % iw.capacity
+	}
+
+	iw.records[key] = record
+}
+
+// Record updates the window from one engine event. Events without order state are ignored.
+func (iw *IdempotencyWindow) Record(event *pb.EngineEvent) error {
+	var order *pb.OrderStatusEvent
+
+	switch event.GetEventType() {
+	case pbTypes.EventType_ORDER_ACCEPTED,
+		pbTypes.EventType_ORDER_TRIGGERED,
+		pbTypes.EventType_ORDER_FILLED,
+		pbTypes.EventType_ORDER_CANCELLED,
+		pbTypes.EventType_ORDER_REJECTED:
+		order = &pb.OrderStatusEvent{}
+		if err := proto.Unmarshal(event.GetData(), order); err != nil {
+			return err
+		}
+
+	case pbTypes.EventType_ORDER_REDUCED:
+		var reduced pb.OrderReducedEvent
+		if err := proto.Unmarshal(event.GetData(), &reduced); err != nil {
+			return err
+		}
+		order = reduced.GetOrder()
+
+	default:
+		return nil
+	}
+
+	iw.put(&pb.IdempotencyRecord{ClientId: order.GetOrderId(), Order: order})
+
+	if modifyID := order.GetClientModifyId(); modifyID != "" {
+		record := &pb.IdempotencyRecord{ClientId: modifyID, IsModify: true, OrderId: order.GetOrderId()}
+		// A replacement carries its own id as the modify id; a later reduce of it keeps
+		// ReplacedOrderId but is a modify of the replacement itself
+		if replaced := order.GetReplacedOrderId(); replaced != "" && modifyID == order.GetOrderId() {
+			record.OrderId = replaced
+			record.NewOrderId = order.GetOrderId()
+		}
+		iw.put(record)
+	}
+
+	return nil
+}
+
+func (iw *IdempotencyWindow) order(clientOrderID string) (*pb.IdempotencyRecord, bool) {
+	record, ok := iw.records[idempotencyKey{clientID: clientOrderID}]
+	return record, ok
+}
+
+func (iw *IdempotencyWindow) modify(clientModifyID string) (*pb.IdempotencyRecord, bool) {
+	record, ok := iw.records[idempotencyKey{clientID: clientModifyID, isModify: true}]
+	return record, ok
+}
+
+// Snapshot returns the records oldest first, the order Restore has to put them back in.
+func (iw *IdempotencyWindow) Snapshot() []*pb.IdempotencyRecord {
+	records := make([]*pb.IdempotencyRecord, 0, len(iw.ring))
+
+	for i := range iw.ring {
+		key := iw.ring[(iw.next+i)%len(iw.ring)]
+		records = append(records, iw.records[key])
+	}
+
+	return records
+}
+
+func (iw *IdempotencyWindow) Restore(records []*pb.IdempotencyRecord) {
+	for _, record := range records {
+		iw.put(record)
+	}
+}
+
+/*
+==================================================================
+==================== Duplicate Request Handling ==================
+==================================================================
+*/
+
+// duplicateOrder returns the result of an order id seen before: the live order while it is
+// still in the book, otherwise its last recorded state.
+func (me *MatchingEngine) duplicateOrder(order *Order) (*AddOrderInternalResponse, bool, error) {
+	var original *pb.OrderStatusEvent
+
+	if existing, exists := me.findOrder(order.ClientOrderID); exists {
+		// Copied so the gRPC handler never reads an order the actor keeps changing
+		original = NewOrderStatusEvent(existing)
+	} else if record, exists := me.Idempotency.order(order.ClientOrderID); exists {
+		original = record.GetOrder()
+	} else {
+		return nil, false, nil
+	}
+
+	if original.GetUserId() != order.UserID {
+		return nil, true, duplicateID("Duplicate Order ID: %s", order.ClientOrderID)
+	}
+
+	return &AddOrderInternalResponse{Order: OrderFromStatusEvent(original), Duplicate: true}, true, nil
+}
+
+func (me *MatchingEngine) duplicateModify(clientModifyID string, userID string) (*ModifyOrderInternalResponse, bool, error) {
+	if clientModifyID == "" {
+		return nil, false, nil
+	}
+
+	record, exists := me.Idempotency.modify(clientModifyID)
+	if !exists {
+		return nil, false, nil
+	}
+
+	if order, exists := me.Idempotency.order(record.GetOrderId()); exists && order.GetOrder().GetUserId() != userID {
+		return nil, true, duplicateID("client_modify_id already used: %s", clientModifyID)
+	}
+
+	response := &ModifyOrderInternalResponse{
+		OrderID:       record.GetOrderId(),
+		NewOrderId:    record.GetNewOrderId(),
+		Status:        "Success",
+		StatusMessage: "Duplicate client_modify_id; original result returned",
+	}
+	if record.GetNewOrderId() != "" {
+		response.OldOrderId = record.GetOrderId()
+	}
+
+	return response, true, nil
+}
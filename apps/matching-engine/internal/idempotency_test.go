@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+func TestRetriedPlaceReturnsTheOriginalResult(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("o1", "u", pbTypes.Side_BUY, 100, 5))
+
+	// While the order rests, the retry sees it as it is now, even at another price
+	res := placeTestOrder(t, a, limitOrder("o1", "u", pbTypes.Side_BUY, 105, 9))
+	if !res.Duplicate || res.Order.Price != 100 || res.Order.Quantity != 5 || len(res.Trades) != 0 {
+		t.Fatalf("resting retry: %+v", res.Order)
+	}
+
+	// Once filled it is out of the book and the window answers
+	placeTestOrder(t, a, marketOrder("m1", "v", pbTypes.Side_SELL, 5))
+	res = placeTestOrder(t, a, limitOrder("o1", "u", pbTypes.Side_BUY, 100, 5))
+	if !res.Duplicate || res.Order.Status != pbTypes.OrderStatus_FILLED || res.Order.FilledQuantity != 5 {
+		t.Fatalf("filled retry: %+v", res.Order)
+	}
+
+	// A rejected order is not run again either, even once the book could fill it
+	placeTestOrder(t, a, limitOrder("o2", "v", pbTypes.Side_SELL, 110, 1))
+	fok := timeInForceOrder("f1", "u", pbTypes.Side_BUY, 110, 3, pbTypes.TimeInForce_FOK)
+	if res := placeTestOrder(t, a, fok); res.Duplicate || res.Order.Status != pbTypes.OrderStatus_REJECTED {
+		t.Fatalf("f1: %+v", res.Order)
+	}
+	placeTestOrder(t, a, limitOrder("o3", "v", pbTypes.Side_SELL, 110, 5))
+	sequence := a.wal.LastSequenceNumber()
+
+	res = placeTestOrder(t, a, timeInForceOrder("f1", "u", pbTypes.Side_BUY, 110, 3, pbTypes.TimeInForce_FOK))
+	if !res.Duplicate || res.Order.Status != pbTypes.OrderStatus_REJECTED || res.Order.RejectReason != pbTypes.RejectReason_REJECT_REASON_FOK_NOT_FILLABLE {
+		t.Fatalf("rejected retry: %+v", res.Order)
+	}
+	if a.wal.LastSequenceNumber() != sequence || a.engine.TotalMatches != 1 {
+		t.Fatalf("a retry reached the WAL: sequence %d, want %d", a.wal.LastSequenceNumber(), sequence)
+	}
+}
+
+func TestRetriedModifyReturnsTheOriginalResult(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("o1", "u", pbTypes.Side_BUY, 100, 5))
+	placeTestOrder(t, a, limitOrder("o2", "u", pbTypes.Side_BUY, 100, 5))
+
+	// A replace answers with both ids, and the retry gets the same answer
+	modifyTestOrder(t, a, "o1", "u", "o1-r", int64Ptr(101), nil)
+	sequence := a.wal.LastSequenceNumber()
+
+	res, err := tryModifyTestOrder(t, a, "o1", "u", "o1-r", int64Ptr(102), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OldOrderId != "o1" || res.NewOrderId != "o1-r" || a.engine.AllOrders["o1-r"].Price != 101 {
+		t.Fatalf("replace retry: %+v", res)
+	}
+
+	// A reduce in place keeps the order id and is not applied twice
+	modifyTestOrder(t, a, "o2", "u", "o2-m", nil, int64Ptr(3))
+	sequence = a.wal.LastSequenceNumber()
+
+	res, err = tryModifyTestOrder(t, a, "o2", "u", "o2-m", nil, int64Ptr(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OrderID != "o2" || res.NewOrderId != "" || a.engine.AllOrders["o2"].RemainingQuantity != 3 {
+		t.Fatalf("reduce retry: %+v", res)
+	}
+	if a.wal.LastSequenceNumber() != sequence {
+		t.Fatalf("a retry reached the WAL: sequence %d, want %d", a.wal.LastSequenceNumber(), sequence)
+	}
+
+	// Reducing the replacement is a modify of the replacement, not another replace of o1
+	modifyTestOrder(t, a, "o1-r", "u", "o1-m", nil, int64Ptr(2))
+	res, err = tryModifyTestOrder(t, a, "o1-r", "u", "o1-m", nil, int64Ptr(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OrderID != "o1-r" || res.OldOrderId != "" || res.NewOrderId != "" {
+		t.Fatalf("reduce of the replacement retried: %+v", res)
+	}
+
+	// The modify id belongs to the user who used it
+	if _, err := tryModifyTestOrder(t, a, "o2", "v", "o2-m", nil, int64Ptr(1)); rejectReason(err) != pbTypes.RejectReason_REJECT_REASON_DUPLICATE_ID {
+		t.Fatalf("another user's retry: %v", err)
+	}
+}
+
+func TestIdempotencyWindowEvictsOldEntries(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	a.engine.Idempotency = NewIdempotencyWindow(3)
+	runTestActor(t, a)
+
+	// Unfillable FOK orders leave nothing in the book, only the window remembers them
+	for _, id := range []string{"f1", "f2", "f3", "f4"} {
+		placeTestOrder(t, a, timeInForceOrder(id, "u", pbTypes.Side_BUY, 100, 1, pbTypes.TimeInForce_FOK))
+	}
+
+	if res := placeTestOrder(t, a, timeInForceOrder("f4", "u", pbTypes.Side_BUY, 100, 1, pbTypes.TimeInForce_FOK)); !res.Duplicate {
+		t.Fatal("f4 was forgotten")
+	}
+	if res := placeTestOrder(t, a, timeInForceOrder("f2", "u", pbTypes.Side_BUY, 100, 1, pbTypes.TimeInForce_FOK)); !res.Duplicate {
+		t.Fatal("f2 was forgotten")
+	}
+	// f4 pushed f1 out, so it runs again and pushes out f2: the retry of f2 did not move it
+	// up the window
+	if res := placeTestOrder(t, a, timeInForceOrder("f1", "u", pbTypes.Side_BUY, 100, 1, pbTypes.TimeInForce_FOK)); res.Duplicate {
+		t.Fatal("f1 is still in the window")
+	}
+
+	got := []string{}
+	for _, record := range a.engine.Idempotency.Snapshot() {
+		got = append(got, record.GetClientId())
+	}
+	if len(got) != 3 || got[0] != "f3" || got[1] != "f4" || got[2] != "f1" {
+		t.Fatalf("window %v, want [f3 f4 f1]", got)
+	}
+}
+
+func TestIdempotencyWindowSurvivesSnapshotAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	// Seen before the snapshot
+	placeTestOrder(t, a, limitOrder("o1", "u", pbTypes.Side_BUY, 100, 5))
+	placeTestOrder(t, a, timeInForceOrder("f1", "u", pbTypes.Side_BUY, 100, 1, pbTypes.TimeInForce_FOK))
+	modifyTestOrder(t, a, "o1", "u", "o1-r", int64Ptr(99), nil)
+
+	snapshot := takeTestSnapshot(t, a)
+	if err := a.snapshots.Write(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seen only in the WAL tail
+	placeTestOrder(t, a, limitOrder("o2", "u", pbTypes.Side_SELL, 110, 2))
+	placeTestOrder(t, a, marketOrder("m1", "v", pbTypes.Side_BUY, 2))
+	modifyTestOrder(t, a, "o1-r", "u", "o1-m", nil, int64Ptr(4))
+	want := checkBook(t, a.engine)
+	stop()
+
+	b := newTestActor(t, dir)
+	recoverTestActor(t, b)
+	if got := checkBook(t, b.engine); got != want {
+		t.Fatalf("recovered book\n%s\nwant\n%s", got, want)
+	}
+	runTestActor(t, b)
+	sequence := b.wal.LastSequenceNumber()
+
+	for id, userID := range map[string]string{"o1": "u", "f1": "u", "o2": "u", "m1": "v"} {
+		if res := placeTestOrder(t, b, limitOrder(id, userID, pbTypes.Side_SELL, 90, 1)); !res.Duplicate {
+			t.Fatalf("%s was placed again after the restart", id)
+		}
+	}
+	if res, err := tryModifyTestOrder(t, b, "o1", "u", "o1-r", int64Ptr(98), nil); err != nil || res.NewOrderId != "o1-r" {
+		t.Fatalf("o1-r after the restart: %+v %v", res, err)
+	}
+	if res, err := tryModifyTestOrder(t, b, "o1-r", "u", "o1-m", nil, int64Ptr(2)); err != nil || res.OrderID != "o1-r" || b.engine.AllOrders["o1-r"].RemainingQuantity != 4 {
+		t.Fatalf("o1-m after the restart: %+v %v", res, err)
+	}
+	if b.wal.LastSequenceNumber() != sequence {
+		t.Fatalf("a retry reached the WAL after the restart")
+	}
+}
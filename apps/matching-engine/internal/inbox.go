@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+==================================================================
+========================== Actor Inbox ===========================
+==================================================================
+*/
+
+const (
+	// Longest a request without a deadline waits for room in a full inbox
+	maxEnqueueWait = time.Second
+
+	// Most cancels the actor takes in a row before a waiting order or modify goes through
+	maxCancelBurst = 32
+)
+
+// send queues a message for the actor loop. Cancels and mass cancels go to the priority
+// lane, unless a place or modify they could overtake is still queued (see queuedOrders).
+// When the lane is full it waits until ctx's deadline, or maxEnqueueWait without one, then
+// turns the caller away with RESOURCE_EXHAUSTED, so a stuck symbol cannot pile up
+// goroutines. A symbol being delisted fails with UNAVAILABLE.
+func (a *SymbolActor) send(ctx context.Context, msg EngineMsg) error {
+	a.inboxMu.RLock()
+	defer a.inboxMu.RUnlock()
+
+	if a.inboxClosed {
+		return status.Errorf(codes.Unavailable, "symbol %s is being delisted", a.symbol)
+	}
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+
+	lane := a.inbox
+	if a.queued.priority(msg) {
+		lane = a.cancelInbox
+	}
+
+	// Counted before the send, so the actor can never take the message before it is counted
+	a.queued.add(msg)
+
+	select {
+	case lane <- msg:
+		return nil
+	default:
+	}
+
+	wait := maxEnqueueWait
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case lane <- msg:
+		return nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	a.queued.remove(msg)
+	a.inboxRejected.Add(1)
+	return status.Errorf(codes.ResourceExhausted, "symbol %s is overloaded (%d requests queued), try again later", a.symbol, len(lane))
+}
+
+// abandoned answers a message whose caller gave up while it was queued, so it never reaches
+// the book. Whatever the caller gave up on is not applied.
+func (a *SymbolActor) abandoned(ctx context.Context, errCh chan error) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+
+	a.inboxExpired.Add(1)
+	errCh <- status.FromContextError(ctx.Err()).Err()
+	return true
+}
+
+// inboxLanes is the actor's side of its two inboxes. Cancels are taken first so market
+// makers can pull stale quotes while orders pile up, but after maxCancelBurst cancels in a
+// row a waiting order or modify goes through, so a cancel flood cannot starve trading.
+type inboxLanes struct {
+	cancels chan EngineMsg // nil once closed and drained
+	orders  chan EngineMsg
+	burst   int // cancels taken since the last order
+}
+
+// next is the next message to run; false once both lanes are closed and drained.
+func (l *inboxLanes) next() (EngineMsg, bool) {
+	for l.cancels != nil || l.orders != nil {
+		preferred := &l.cancels
+		if l.burst >= maxCancelBurst {
+			preferred = &l.orders
+		}
+
+		select {
+		case msg, ok := <-*preferred:
+			if l.take(preferred, ok) {
+				return msg, true
+			}
+			continue
+		default:
+		}
+
+		select {
+		case msg, ok := <-l.cancels:
+			if l.take(&l.cancels, ok) {
+				return msg, true
+			}
+		case msg, ok := <-l.orders:
+			if l.take(&l.orders, ok) {
+				return msg, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// take books a message received from lane, or retires the lane once it is closed and drained.
+func (l *inboxLanes) take(lane *chan EngineMsg, ok bool) bool {
+	if !ok {
+		*lane = nil
+		return false
+	}
+
+	if lane == &l.cancels {
+		l.burst++
+	} else {
+		l.burst = 0
+	}
+	return true
+}
+
+// queuedOrders counts the order ids and users of the places and modifies still waiting in
+// the inbox. A cancel of such an id, or a mass cancel of such a user, takes the inbox
+// behind them instead of the priority lane, so it never overtakes the order it cancels.
+type queuedOrders struct {
+	mu    sync.Mutex
+	ids   map[string]int
+	users map[string]int
+}
+
+func newQueuedOrders() *queuedOrders {
+	return &queuedOrders{ids: map[string]int{}, users: map[string]int{}}
+}
+
+// priority reports whether msg can take the priority lane.
+func (q *queuedOrders) priority(msg EngineMsg) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch m := msg.(type) {
+	case CancelOrderMsg:
+		return q.ids[m.ID] == 0
+	case MassCancelMsg:
+		return q.users[m.UserID] == 0
+	}
+	return false
+}
+
+func (q *queuedOrders) add(msg EngineMsg) {
+	q.count(msg, 1)
+}
+
+// remove uncounts a message the actor took off the inbox, or one that was never queued.
+func (q *queuedOrders) remove(msg EngineMsg) {
+	q.count(msg, -1)
+}
+
+func (q *queuedOrders) count(msg EngineMsg, delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	bump := func(counts map[string]int, key string) {
+		if counts[key] += delta; counts[key] == 0 {
+			delete(counts, key)
+		}
+	}
+
+	switch m := msg.(type) {
+	case PlaceOrderMsg:
+		bump(q.ids, m.Order.ClientOrderID)
+		bump(q.users, m.Order.UserID)
+	case ModifyOrderMsg:
+		bump(q.ids, m.OrderID)
+		bump(q.ids, m.ClientModifyID)
+		bump(q.users, m.UserID)
+	case PlaceOrdersMsg:
+		for _, order := range m.Orders {
+			bump(q.ids, order.ClientOrderID)
+			bump(q.users, order.UserID)
+		}
+	case CancelReplaceOrdersMsg:
+		for _, modify := range m.Modifies {
+			bump(q.ids, modify.OrderID)
+			bump(q.ids, modify.ClientModifyID)
+			bump(q.users, modify.UserID)
+		}
+	}
+}
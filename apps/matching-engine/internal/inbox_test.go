@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testPlaceMsg is a place of a resting buy for the actor, with its reply channels.
+func testPlaceMsg(ctx context.Context, id string, userID string) PlaceOrderMsg {
+	order := limitOrder(id, userID, pbTypes.Side_BUY, 99, 1)
+	order.Symbol = testSymbol
+	order.RemainingQuantity = order.Quantity
+	return PlaceOrderMsg{ctx: ctx, Order: order, replay: make(chan *AddOrderInternalResponse, 1), Err: make(chan error, 1)}
+}
+
+func testCancelMsg(ctx context.Context, id string, userID string) CancelOrderMsg {
+	return CancelOrderMsg{ctx: ctx, ID: id, UserID: userID, Symbol: testSymbol, replay: make(chan *CancelOrderInternalResponse, 1), Err: make(chan error, 1)}
+}
+
+func TestFullInboxTurnsCallersAway(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	defer a.wal.Close()
+	a.inbox = make(chan EngineMsg, 1)
+
+	ctx := context.Background()
+	if err := a.send(ctx, testPlaceMsg(ctx, "o1", "u")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller's deadline bounds the wait for room
+	deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := a.send(deadline, testPlaceMsg(deadline, "o2", "u"))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("full inbox: %v", err)
+	}
+	if waited := time.Since(start); waited > maxEnqueueWait/2 {
+		t.Fatalf("waited %v past the deadline", waited)
+	}
+
+	// The turned away order is not counted as queued, so a cancel of it takes the priority lane
+	if a.inboxRejected.Load() != 1 || !a.queued.priority(testCancelMsg(ctx, "o2", "u")) || a.queued.priority(testCancelMsg(ctx, "o1", "u")) {
+		t.Fatalf("rejected %d, queued %v", a.inboxRejected.Load(), a.queued.ids)
+	}
+
+	// A caller that already gave up is turned away at once
+	<-deadline.Done()
+	if err := a.send(deadline, testPlaceMsg(deadline, "o3", "u")); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expired caller: %v", err)
+	}
+}
+
+func TestAbandonedMessagesAreDropped(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+
+	// Queued while the actor is busy, then the caller gives up before its turn
+	ctx, cancel := context.WithCancel(context.Background())
+	place := testPlaceMsg(ctx, "gone", "u")
+	if err := a.send(ctx, place); err != nil {
+		t.Fatal(err)
+	}
+	kept := testPlaceMsg(context.Background(), "kept", "u")
+	if err := a.send(context.Background(), kept); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	stop := runTestActor(t, a)
+	if err := <-place.Err; status.Code(err) != codes.Canceled {
+		t.Fatalf("abandoned place: %v", err)
+	}
+	if res := <-kept.replay; a.engine.AllOrders["kept"] == nil || res.Order.ClientOrderID != "kept" {
+		t.Fatal("kept was not placed")
+	}
+	stop()
+
+	if a.engine.AllOrders["gone"] != nil || a.inboxExpired.Load() != 1 {
+		t.Fatalf("gone in the book, %d expired", a.inboxExpired.Load())
+	}
+	if events := walEvents(t, a); len(events) != 1 {
+		t.Fatalf("%d WAL events, want kept's acceptance only", len(events))
+	}
+}
+
+func TestCancelBurstLetsOrdersThrough(t *testing.T) {
+	lanes := &inboxLanes{cancels: make(chan EngineMsg, 100), orders: make(chan EngineMsg, 100)}
+
+	for i := range maxCancelBurst + 10 {
+		lanes.cancels <- CancelOrderMsg{ID: fmt.Sprintf("c%d", i)}
+	}
+	lanes.orders <- PlaceOrderMsg{Order: &Order{ClientOrderID: "o1"}}
+	lanes.orders <- PlaceOrderMsg{Order: &Order{ClientOrderID: "o2"}}
+	close(lanes.cancels)
+	close(lanes.orders)
+
+	// maxCancelBurst cancels, one order, the other 10 cancels, then the other order
+	taken := []string{}
+	for {
+		msg, ok := lanes.next()
+		if !ok {
+			break
+		}
+		switch m := msg.(type) {
+		case CancelOrderMsg:
+			taken = append(taken, m.ID)
+		case PlaceOrderMsg:
+			taken = append(taken, m.Order.ClientOrderID)
+		}
+	}
+
+	if len(taken) != maxCancelBurst+12 {
+		t.Fatalf("took %d messages", len(taken))
+	}
+	if taken[maxCancelBurst-1] != fmt.Sprintf("c%d", maxCancelBurst-1) || taken[maxCancelBurst] != "o1" || taken[maxCancelBurst+1] != fmt.Sprintf("c%d", maxCancelBurst) {
+		t.Fatalf("around the burst: %v", taken[maxCancelBurst-1:maxCancelBurst+2])
+	}
+	if taken[len(taken)-1] != "o2" {
+		t.Fatalf("last %s", taken[len(taken)-1])
+	}
+}
+
+func TestCancelNeverOvertakesItsOrder(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	ctx := context.Background()
+
+	// Queued while the actor is busy: a place, then a cancel of it and a mass cancel of its user,
+	// which both wait behind it, and a cancel of another order, which goes first
+	place := testPlaceMsg(ctx, "o1", "u")
+	cancelOwn := testCancelMsg(ctx, "o1", "u")
+	cancelOther := testCancelMsg(ctx, "other", "v")
+	massCancel := MassCancelMsg{ctx: ctx, UserID: "u", replay: make(chan []*pb.CancelledOrder, 1), Err: make(chan error, 1)}
+	for _, msg := range []EngineMsg{place, cancelOwn, cancelOther, massCancel} {
+		if err := a.send(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.inbox) != 3 || len(a.cancelInbox) != 1 {
+		t.Fatalf("inbox %d, priority lane %d", len(a.inbox), len(a.cancelInbox))
+	}
+
+	runTestActor(t, a)
+	<-place.replay
+	select {
+	case <-cancelOwn.replay:
+	case err := <-cancelOwn.Err:
+		t.Fatalf("cancel overtook its order: %v", err)
+	}
+	if err := <-cancelOther.Err; status.Code(err) != codes.NotFound {
+		t.Fatalf("cancel of an unknown order: %v", err)
+	}
+	<-massCancel.replay
+
+	// Once the actor took them, nothing holds the user's cancels back
+	a.queued.mu.Lock()
+	defer a.queued.mu.Unlock()
+	if len(a.queued.ids) != 0 || len(a.queued.users) != 0 {
+		t.Fatalf("still counted: %v %v", a.queued.ids, a.queued.users)
+	}
+}
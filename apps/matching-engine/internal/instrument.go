@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+/*
+==================================================================
+===================== Instrument Trading Rules ===================
+==================================================================
+*/
+
+// InstrumentSpec holds the trading rules of a symbol. Zero tick / lot sizes mean 1,
+// a zero MaxQuantity or MinNotional means no limit.
+type InstrumentSpec struct {
+	TickSize    int64
+	LotSize     int64
+	MinQuantity int64
+	MaxQuantity int64
+	MinNotional int64
+
+	// Decimal places a price integer carries; used by clients to format prices
+	PricePrecision int32
+}
+
+func (spec InstrumentSpec) tickSize() int64 {
+	return max(spec.TickSize, 1)
+}
+
+func (spec InstrumentSpec) lotSize() int64 {
+	return max(spec.LotSize, 1)
+}
+
+// Validate rejects a spec the engine cannot enforce consistently.
+func (spec InstrumentSpec) Validate() error {
+	if spec.TickSize < 0 || spec.LotSize < 0 || spec.MinQuantity < 0 || spec.MaxQuantity < 0 || spec.MinNotional < 0 {
+		return fmt.Errorf("instrument sizes cannot be negative")
+	}
+	if spec.MaxQuantity > 0 && spec.MaxQuantity < spec.MinQuantity {
+		return fmt.Errorf("max quantity %d is below min quantity %d", spec.MaxQuantity, spec.MinQuantity)
+	}
+	if spec.MinQuantity%spec.lotSize() != 0 || spec.MaxQuantity%spec.lotSize() != 0 {
+		return fmt.Errorf("min and max quantity must be multiples of the lot size %d", spec.lotSize())
+	}
+	if spec.PricePrecision < 0 || spec.PricePrecision > 18 {
+		return fmt.Errorf("price precision %d is out of range 0-18", spec.PricePrecision)
+	}
+	return nil
+}
+
+func (spec InstrumentSpec) ToProto(symbol string) *pb.InstrumentSpec {
+	return &pb.InstrumentSpec{
+		Symbol:         symbol,
+		TickSize:       spec.tickSize(),
+		LotSize:        spec.lotSize(),
+		MinQuantity:    spec.MinQuantity,
+		MaxQuantity:    spec.MaxQuantity,
+		MinNotional:    spec.MinNotional,
+		PricePrecision: spec.PricePrecision,
+	}
+}
+
+func InstrumentSpecFromProto(spec *pb.InstrumentSpec) InstrumentSpec {
+	return InstrumentSpec{
+		TickSize:       spec.GetTickSize(),
+		LotSize:        spec.GetLotSize(),
+		MinQuantity:    spec.GetMinQuantity(),
+		MaxQuantity:    spec.GetMaxQuantity(),
+		MinNotional:    spec.GetMinNotional(),
+		PricePrecision: spec.GetPricePrecision(),
+	}
+}
+
+// check runs the instrument rules against an order before it reaches matching or the
+// trigger book. It returns REJECT_REASON_UNSPECIFIED when the order is valid.
+func (spec InstrumentSpec) check(order *Order) (pbTypes.RejectReason, string) {
+	// ---------- quantity ----------
+	if order.Quantity <= 0 {
+		return pbTypes.RejectReason_REJECT_REASON_INVALID_QUANTITY, "Quantity must be positive"
+	}
+	if order.Quantity%spec.lotSize() != 0 {
+		return pbTypes.RejectReason_REJECT_REASON_LOT_SIZE, fmt.Sprintf("Quantity %d is not a multiple of the lot size %d", order.Quantity, spec.lotSize())
+	}
+	if order.DisplayQuantity%spec.lotSize() != 0 {
+		return pbTypes.RejectReason_REJECT_REASON_LOT_SIZE, fmt.Sprintf("Display quantity %d is not a multiple of the lot size %d", order.DisplayQuantity, spec.lotSize())
+	}
+	if order.Quantity < spec.MinQuantity {
+		return pbTypes.RejectReason_REJECT_REASON_MIN_QUANTITY, fmt.Sprintf("Quantity %d is below the minimum %d", order.Quantity, spec.MinQuantity)
+	}
+	if spec.MaxQuantity > 0 && order.Quantity > spec.MaxQuantity {
+		return pbTypes.RejectReason_REJECT_REASON_MAX_QUANTITY, fmt.Sprintf("Quantity %d is above the maximum %d", order.Quantity, spec.MaxQuantity)
+	}
+
+	// ---------- price ----------
+	hasLimitPrice := order.Type == pbTypes.OrderType_LIMIT || order.Type == pbTypes.OrderType_STOP_LIMIT
+
+	if hasLimitPrice {
+		if order.Price <= 0 {
+			return pbTypes.RejectReason_REJECT_REASON_INVALID_PRICE, "Price must be positive"
+		}
+		if order.Price%spec.tickSize() != 0 {
+			return pbTypes.RejectReason_REJECT_REASON_TICK_SIZE, fmt.Sprintf("Price %d is not a multiple of the tick size %d", order.Price, spec.tickSize())
+		}
+	}
+
+	// A missing stop price is rejected by addStopOrder
+	if isStopOrder(order.Type) && order.StopPrice%spec.tickSize() != 0 {
+		return pbTypes.RejectReason_REJECT_REASON_TICK_SIZE, fmt.Sprintf("Stop price %d is not a multiple of the tick size %d", order.StopPrice, spec.tickSize())
+	}
+
+	// ---------- notional ----------
+	// MARKET orders have no price until they match, so only priced orders are checked
+	notionalPrice := int64(0)
+	switch {
+	case hasLimitPrice:
+		notionalPrice = order.Price
+	case order.Type == pbTypes.OrderType_STOP_MARKET:
+		notionalPrice = order.StopPrice
+	}
+
+	if spec.MinNotional > 0 && notionalPrice > 0 && !notionalAtLeast(notionalPrice, order.Quantity, spec.MinNotional) {
+		return pbTypes.RejectReason_REJECT_REASON_MIN_NOTIONAL, fmt.Sprintf("Notional %d is below the minimum %d", notionalPrice*order.Quantity, spec.MinNotional)
+	}
+
+	return pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, ""
+}
+
+// notionalAtLeast reports price * quantity >= minimum without overflowing int64.
+func notionalAtLeast(price int64, quantity int64, minimum int64) bool {
+	if quantity > math.MaxInt64/price {
+		return true
+	}
+	return price*quantity >= minimum
+}
+
+// checkModify validates a modify before the order is touched, so a replacement that would
+// be rejected never cancels the order it replaces.
+func (spec InstrumentSpec) checkModify(order *Order, newPrice *int64, newQuantity *int64) error {
+	if newQuantity != nil && *newQuantity%spec.lotSize() != 0 {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_LOT_SIZE, "new quantity %d is not a multiple of the lot size %d", *newQuantity, spec.lotSize())
+	}
+
+	priceChanged := newPrice != nil && *newPrice != order.Price
+	qtyIncreased := newQuantity != nil && *newQuantity-(order.Quantity-order.RemainingQuantity) > order.RemainingQuantity
+	if !priceChanged && !qtyIncreased {
+		return nil
+	}
+
+	replacement := *order
+	if newPrice != nil {
+		replacement.Price = *newPrice
+	}
+	replacement.Quantity = replacementQuantity(order, newQuantity)
+
+	// Nothing left to place is reported by replaceOrder
+	if replacement.Quantity <= 0 {
+		return nil
+	}
+
+	if reason, message := spec.check(&replacement); reason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		return invalidArgument(reason, "modify rejected: %s", message)
+	}
+
+	return nil
+}
+
+// rejectedEvent marks an order REJECTED and returns its ORDER_REJECTED event.
+func rejectedEvent(order *Order, reason pbTypes.RejectReason, message string) *pb.EngineEvent {
+	order.Status = pbTypes.OrderStatus_REJECTED
+	order.RejectReason = reason
+	order.StatusMessage = message
+
+	data, _ := EncodeOrderStatusEvent(order, StrPtr(""), false)
+	return &pb.EngineEvent{
+		EventType: pbTypes.EventType_ORDER_REJECTED,
+		UserId:    order.UserID,
+		Data:      data,
+	}
+}
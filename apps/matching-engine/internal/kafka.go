@@ -7,15 +7,18 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
 )
 
 var (
@@ -87,6 +90,10 @@ type KafkaProducerWorker struct {
 	wal            *SymbolWAL
 	checkpointFile *os.File
 	ctx            context.Context
+	cancel         context.CancelFunc
+
+	// committedOffset mirrors checkpoint.meta so other goroutines can read it without touching the file
+	committedOffset atomic.Uint64
 }
 
 func NewKafkaProducerWorker(symbol string, dirPath string, wal *SymbolWAL, batchSize int, emitTime int) (*KafkaProducerWorker, error) {
@@ -105,7 +112,9 @@ func NewKafkaProducerWorker(symbol string, dirPath string, wal *SymbolWAL, batch
 		return nil, err
 	}
 
-	return &KafkaProducerWorker{
+	ctx, cancel := context.WithCancel(context.Background())
+
+	kpw := &KafkaProducerWorker{
 		producer:       producer,
 		wal:            wal,
 		batchSize:      batchSize,
@@ -113,8 +122,17 @@ func NewKafkaProducerWorker(symbol string, dirPath string, wal *SymbolWAL, batch
 		dirPath:        dirPath,
 		Symbol:         symbol,
 		checkpointFile: file,
-		ctx:            context.Background(),
-	}, nil
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	kpw.committedOffset.Store(kpw.loadCheckpoint())
+
+	return kpw, nil
+}
+
+// CommittedOffset returns the last WAL sequence acknowledged by Kafka.
+func (kpw *KafkaProducerWorker) CommittedOffset() uint64 {
+	return kpw.committedOffset.Load()
 }
 
 func (kpw *KafkaProducerWorker) Run() {
@@ -133,6 +151,20 @@ func (kpw *KafkaProducerWorker) Run() {
 	}
 }
 
+// Close emits what is left of the WAL and closes the checkpoint file; Run must have returned.
+// When Kafka is unreachable the rest stays in the WAL and goes out on the next start.
+func (kpw *KafkaProducerWorker) Close() error {
+	for kpw.CommittedOffset() < kpw.wal.LastSequenceNumber() {
+		before := kpw.CommittedOffset()
+		kpw.processBatch()
+		if kpw.CommittedOffset() == before {
+			break
+		}
+	}
+
+	return kpw.checkpointFile.Close()
+}
+
 func (kpw *KafkaProducerWorker) processBatch() {
 	startOffset := kpw.loadCheckpoint()
 
@@ -227,5 +259,75 @@ func (kpw *KafkaProducerWorker) saveCheckpoint(offset uint64) error {
 		return err
 	}
 
-	return kpw.checkpointFile.Sync()
+	if err := kpw.checkpointFile.Sync(); err != nil {
+		return err
+	}
+
+	kpw.committedOffset.Store(offset)
+	return nil
+}
+
+// Events a symbol may have waiting for a kafkaFeed topic before new ones are dropped
+const kafkaFeedQueueSize = 8192
+
+// kafkaFeed sends market data that never goes through the WAL to its own topic, keyed by
+// symbol and in the order it was produced. Like redisPublisher the actor never waits on it;
+// consumers find dropped events through the gap in the event sequence.
+type kafkaFeed struct {
+	producer sarama.SyncProducer
+	topic    string
+	symbol   string
+	queue    chan *pb.EngineEvent
+	done     chan struct{}
+}
+
+func newKafkaFeed(producer sarama.SyncProducer, topic string, symbol string) *kafkaFeed {
+	return &kafkaFeed{
+		producer: producer,
+		topic:    topic,
+		symbol:   symbol,
+		queue:    make(chan *pb.EngineEvent, kafkaFeedQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+func (f *kafkaFeed) publish(event *pb.EngineEvent) {
+	select {
+	case f.queue <- event:
+	default:
+		slog.Warn("kafka feed queue full, dropping event", "topic", f.topic, "symbol", f.symbol, "eventType", event.EventType)
+	}
+}
+
+// run sends what has queued up since the last send as one batch.
+func (f *kafkaFeed) run() {
+	defer close(f.done)
+
+	for event := range f.queue {
+		msgs := []*sarama.ProducerMessage{f.message(event)}
+		for len(f.queue) > 0 && len(msgs) < kafkaFeedQueueSize {
+			msgs = append(msgs, f.message(<-f.queue))
+		}
+
+		if f.producer == nil {
+			continue
+		}
+		if err := f.producer.SendMessages(msgs); err != nil {
+			slog.Warn("kafka feed send failed", "topic", f.topic, "symbol", f.symbol, "events", len(msgs), "err", err)
+		}
+	}
+}
+
+func (f *kafkaFeed) message(event *pb.EngineEvent) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic: f.topic,
+		Key:   sarama.StringEncoder(f.symbol),
+		Value: sarama.ByteEncoder(event.GetData()),
+	}
+}
+
+// close sends what is still queued and stops. Called once the actor loop has exited.
+func (f *kafkaFeed) close() {
+	close(f.queue)
+	<-f.done
 }
@@ -0,0 +1,316 @@
+package internal
+
+import (
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+==================================================================
+===================== L3 (Order-by-Order) Feed ===================
+==================================================================
+*/
+
+// Kafka topic the L3 events of every symbol go to, keyed by symbol
+const l3Topic = "matching-engine.l3"
+
+// l3Order is what the L3 feed shows of a resting order. It follows the order through the
+// engine events the same way replay does, so it needs nothing from the matching code.
+type l3Order struct {
+	publicID        uint64
+	side            pbTypes.Side
+	price           int64
+	remaining       int64
+	visible         int64
+	displayQuantity int64
+	replacedOrderID string
+}
+
+func (o *l3Order) shown() int64 {
+	if o.displayQuantity > 0 {
+		return o.visible
+	}
+	return o.remaining
+}
+
+func (o *l3Order) update(action pb.L3Action) *pb.L3Update {
+	return &pb.L3Update{
+		Action:        action,
+		PublicOrderId: o.publicID,
+		Side:          o.side,
+		Price:         o.price,
+		Quantity:      o.shown(),
+	}
+}
+
+// l3Book translates the engine events of a message into L3 updates. It only knows displayed
+// orders by their client order id, so a hidden order, and the user behind any order, never
+// reach the feed.
+type l3Book struct {
+	orders       map[string]*l3Order
+	nextPublicID uint64
+
+	// Remaining quantity of untriggered STOP_LIMIT orders. A trigger event carries the
+	// original quantity, so a stop reduced while waiting is followed here.
+	stops map[string]int64
+
+	// The order of the current message that may still rest once its own trades are done
+	pendingID string
+	pending   *l3Order
+
+	// Public ids of the orders cancelled by the current message, for cancel-replace
+	cancelled map[string]uint64
+}
+
+func newL3Book() *l3Book {
+	return &l3Book{orders: make(map[string]*l3Order), stops: make(map[string]int64), cancelled: make(map[string]uint64)}
+}
+
+// rebuild starts the feed over from the book, in queue order. Public ids restart too, which
+// is fine: resetDepthTracking skips the book sequence ahead, so clients only see them after a
+// gap that makes them resync.
+func (l3 *l3Book) rebuild(me *MatchingEngine) {
+	l3.orders = make(map[string]*l3Order)
+	l3.stops = make(map[string]int64)
+	l3.nextPublicID = 0
+	l3.pendingID, l3.pending = "", nil
+
+	for orderID, order := range me.Stops.Orders {
+		if order.Type == pbTypes.OrderType_STOP_LIMIT {
+			l3.stops[orderID] = order.RemainingQuantity
+		}
+	}
+
+	for _, obs := range []*OrderBookSide{me.Bids, me.Asks} {
+		for level := obs.BestPriceLevel; level != nil; level = level.NextPrice {
+			for order := level.HeadOrder; order != nil; order = order.Next {
+				if order.Hidden {
+					continue
+				}
+				l3.rest(order.ClientOrderID, &l3Order{
+					side:            order.Side,
+					price:           order.Price,
+					remaining:       order.RemainingQuantity,
+					visible:         order.VisibleQuantity,
+					displayQuantity: order.DisplayQuantity,
+				})
+			}
+		}
+	}
+}
+
+func (l3 *l3Book) rest(orderID string, order *l3Order) {
+	l3.nextPublicID++
+	order.publicID = l3.nextPublicID
+	l3.orders[orderID] = order
+}
+
+// translate turns the events of one message into L3 updates, in the order they happened.
+func (l3 *l3Book) translate(events []*pb.EngineEvent) []*pb.L3Update {
+	updates := []*pb.L3Update{}
+	clear(l3.cancelled)
+
+	for _, event := range events {
+		switch event.EventType {
+		case pbTypes.EventType_ORDER_ACCEPTED, pbTypes.EventType_ORDER_TRIGGERED:
+			var order pb.OrderStatusEvent
+			if err := proto.Unmarshal(event.Data, &order); err != nil {
+				continue
+			}
+
+			updates = l3.flush(updates)
+			if order.Type == pbTypes.OrderType_STOP_LIMIT {
+				l3.stops[order.OrderId] = order.RemainingQuantity
+			}
+			if remaining, ok := l3.stops[order.OrderId]; ok && event.EventType == pbTypes.EventType_ORDER_TRIGGERED {
+				delete(l3.stops, order.OrderId)
+				order.RemainingQuantity = remaining
+			}
+
+			// Stops wait off the book and MARKET orders never rest
+			if order.Type == pbTypes.OrderType_LIMIT && !order.Hidden {
+				l3.pendingID = order.OrderId
+				l3.pending = &l3Order{
+					side:            order.Side,
+					price:           order.Price,
+					remaining:       order.RemainingQuantity,
+					displayQuantity: order.DisplayQuantity,
+					replacedOrderID: order.ReplacedOrderId,
+				}
+			}
+
+		case pbTypes.EventType_TRADE_EXECUTED:
+			var trade pb.TradeEvent
+			if err := proto.Unmarshal(event.Data, &trade); err != nil {
+				continue
+			}
+
+			makerID, takerID := trade.SellOrderId, trade.BuyOrderId
+			if trade.IsBuyerMaker {
+				makerID, takerID = trade.BuyOrderId, trade.SellOrderId
+			}
+			if makerID == l3.pendingID {
+				updates = l3.flush(updates)
+			}
+
+			updates = l3.execute(updates, makerID, trade.Quantity, trade.Price)
+			switch {
+			case trade.Auction:
+				// Both orders were resting
+				updates = l3.execute(updates, takerID, trade.Quantity, trade.Price)
+			case takerID == l3.pendingID && l3.pending != nil:
+				l3.pending.remaining -= trade.Quantity
+			}
+
+		case pbTypes.EventType_ORDER_REDUCED:
+			var reduced pb.OrderReducedEvent
+			if err := proto.Unmarshal(event.Data, &reduced); err != nil {
+				continue
+			}
+
+			quantity := reduced.OldRemainingQuantity - reduced.NewRemainingQuantity
+			orderID := reduced.GetOrder().GetOrderId()
+			if orderID == l3.pendingID && l3.pending != nil {
+				l3.pending.remaining -= quantity
+				continue
+			}
+			if _, ok := l3.stops[orderID]; ok {
+				l3.stops[orderID] -= quantity
+				continue
+			}
+
+			order, ok := l3.orders[orderID]
+			if !ok {
+				continue
+			}
+
+			// An iceberg loses its reserve first, which does not show
+			shown := order.shown()
+			order.remaining -= quantity
+			order.visible = min(order.visible, order.remaining)
+			if order.shown() != shown {
+				updates = append(updates, order.update(pb.L3Action_L3_REDUCE))
+			}
+
+		case pbTypes.EventType_ORDER_CANCELLED, pbTypes.EventType_ORDER_FILLED, pbTypes.EventType_ORDER_REJECTED:
+			var status pb.OrderStatusEvent
+			if err := proto.Unmarshal(event.Data, &status); err != nil {
+				continue
+			}
+
+			delete(l3.stops, status.OrderId)
+			if status.OrderId == l3.pendingID {
+				l3.pendingID, l3.pending = "", nil
+				continue
+			}
+
+			// A filled order already left with its last execution
+			order, ok := l3.orders[status.OrderId]
+			if !ok {
+				continue
+			}
+			delete(l3.orders, status.OrderId)
+			l3.cancelled[status.OrderId] = order.publicID
+
+			order.remaining, order.visible = 0, 0
+			updates = append(updates, order.update(pb.L3Action_L3_CANCEL))
+		}
+	}
+
+	return l3.flush(updates)
+}
+
+// execute takes a trade out of a resting order. An iceberg whose slice is used up goes to the
+// back of its level with a fresh slice, so it leaves and joins again under a new public id.
+func (l3 *l3Book) execute(updates []*pb.L3Update, orderID string, quantity int64, price int64) []*pb.L3Update {
+	order, ok := l3.orders[orderID]
+	if !ok {
+		return updates
+	}
+
+	order.remaining -= quantity
+	if order.displayQuantity > 0 {
+		order.visible -= quantity
+	}
+
+	update := order.update(pb.L3Action_L3_EXECUTE)
+	update.ExecutedQuantity = quantity
+	update.ExecutionPrice = price
+	updates = append(updates, update)
+
+	if order.shown() > 0 {
+		return updates
+	}
+
+	delete(l3.orders, orderID)
+	if order.remaining == 0 {
+		return updates
+	}
+
+	order.visible = min(order.displayQuantity, order.remaining)
+	l3.rest(orderID, order)
+	return append(updates, order.update(pb.L3Action_L3_ADD))
+}
+
+// flush rests the pending order with what its own trades left of it. The replacement of a
+// cancel-replace takes the place of the old order's cancel as one MODIFY.
+func (l3 *l3Book) flush(updates []*pb.L3Update) []*pb.L3Update {
+	order, orderID := l3.pending, l3.pendingID
+	l3.pendingID, l3.pending = "", nil
+
+	if order == nil || order.remaining <= 0 {
+		return updates
+	}
+
+	order.visible = order.remaining
+	if order.displayQuantity > 0 {
+		order.visible = min(order.displayQuantity, order.remaining)
+	}
+	l3.rest(orderID, order)
+
+	update := order.update(pb.L3Action_L3_ADD)
+	if publicID, ok := l3.cancelled[order.replacedOrderID]; ok {
+		for i, previous := range updates {
+			if previous.Action != pb.L3Action_L3_CANCEL || previous.PublicOrderId != publicID {
+				continue
+			}
+
+			update.Action = pb.L3Action_L3_MODIFY
+			update.PreviousPublicOrderId = publicID
+			updates = append(updates[:i], updates[i+1:]...)
+			break
+		}
+	}
+
+	return append(updates, update)
+}
+
+// bookOrders lists the displayed orders of the best depth displayed levels, in queue order.
+func (l3 *l3Book) bookOrders(obs *OrderBookSide, depth int) []*pb.L3Order {
+	orders := []*pb.L3Order{}
+
+	levels := 0
+	for level := obs.BestPriceLevel; level != nil && levels < depth; level = level.NextPrice {
+		if level.DisplayedVolume == 0 {
+			continue
+		}
+		levels++
+
+		for order := level.HeadOrder; order != nil; order = order.Next {
+			shown, ok := l3.orders[order.ClientOrderID]
+			if !ok {
+				continue
+			}
+
+			orders = append(orders, &pb.L3Order{
+				PublicOrderId: shown.publicID,
+				Side:          shown.side,
+				Price:         shown.price,
+				Quantity:      shown.shown(),
+			})
+		}
+	}
+
+	return orders
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+func l3Events(t *testing.T, sub *subscriber) []*pb.L3Event {
+	t.Helper()
+
+	events := []*pb.L3Event{}
+	for _, event := range receivedEvents(sub, pbTypes.EventType_L3) {
+		var l3 pb.L3Event
+		if err := proto.Unmarshal(event.Data, &l3); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &l3)
+	}
+	return events
+}
+
+func TestL3ClientsResyncBeforePublicIdsRestart(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	a.engine.l3 = newL3Book()
+	sub := subscribeTestActor(a)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("b1", "u1", pbTypes.Side_BUY, 99, 5))
+	placeTestOrder(t, a, limitOrder("b2", "u2", pbTypes.Side_BUY, 98, 5))
+	cancelTestOrder(t, a, "b1", "u1")
+	stop()
+
+	before := l3Events(t, sub)
+	if len(before) != 3 {
+		t.Fatalf("%d L3 events before the restart", len(before))
+	}
+	last := before[len(before)-1].GetSequence()
+
+	b := newTestActor(t, dir)
+	b.engine.l3 = newL3Book()
+	recoverTestActor(t, b)
+
+	// A client resyncing now gets b2 under a new public id, and the sequence to apply from
+	resync := b.engine.BookSequence
+	orders := b.engine.l3.bookOrders(b.engine.Bids, 10)
+	if resync <= last || len(orders) != 1 || orders[0].GetPublicOrderId() != 1 {
+		t.Fatalf("resync at %d after %d: %v", resync, last, orders)
+	}
+
+	sub = subscribeTestActor(b)
+	runTestActor(t, b)
+	placeTestOrder(t, b, limitOrder("b3", "u1", pbTypes.Side_BUY, 97, 5))
+
+	after := l3Events(t, sub)
+	if len(after) != 1 {
+		t.Fatalf("%d L3 events after the restart", len(after))
+	}
+
+	// The first event does not follow the last one a client saw, so it resyncs instead of
+	// taking public id 2 for the b2 it knew before
+	event := after[0]
+	if event.GetPreviousSequence() == last || event.GetPreviousSequence() != resync || event.GetSequence() != resync+1 {
+		t.Fatalf("first event after the restart: %d after %d, last before %d, resync at %d", event.GetSequence(), event.GetPreviousSequence(), last, resync)
+	}
+	if id := event.GetUpdates()[0].GetPublicOrderId(); id != 2 {
+		t.Fatalf("b3 has public id %d", id)
+	}
+}
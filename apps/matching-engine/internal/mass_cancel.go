@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/status"
+)
+
+/*
+==================================================================
+=========================== Mass Cancel ==========================
+==================================================================
+*/
+
+// MassCancelMsg cancels every order of a user in one actor step, so no order of the user can
+// trade between the first and the last cancel.
+type MassCancelMsg struct {
+	ctx    context.Context
+	UserID string
+	Side   *pbTypes.Side // nil = both sides
+	Reason pbTypes.CancelReason
+	replay chan []*pb.CancelledOrder
+	Err    chan error
+}
+
+// MassCancelInternal cancels a user's resting orders and untriggered stops, oldest first. Each
+// order gets its ORDER_CANCELLED event; the book changes go out as the message's one DEPTH_DIFF.
+// A halted symbol refuses it, except for a fired cancel-all-after: the user is gone and their
+// orders must not be left to trade when the symbol reopens.
+func (me *MatchingEngine) MassCancelInternal(userID string, side *pbTypes.Side, reason pbTypes.CancelReason) ([]*pb.CancelledOrder, []*pb.EngineEvent, error) {
+	if me.TradingState == pbTypes.TradingState_TRADING_STATE_HALTED && reason != pbTypes.CancelReason_CANCEL_REASON_CANCEL_ALL_AFTER {
+		return nil, nil, failedPrecondition(pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, "trading in %s is halted", me.Symbol)
+	}
+
+	cancelled := []*pb.CancelledOrder{}
+	events := []*pb.EngineEvent{}
+
+	for _, order := range me.userOrders(userID) {
+		if side != nil && order.Side != *side {
+			continue
+		}
+
+		quantity := order.RemainingQuantity
+		events = append(events, me.cancelOrder(order, reason))
+
+		cancelled = append(cancelled, &pb.CancelledOrder{
+			OrderId:           order.ClientOrderID,
+			Symbol:            me.Symbol,
+			Side:              order.Side,
+			CancelledQuantity: quantity,
+		})
+	}
+
+	return cancelled, events, nil
+}
+
+func (a *SymbolActor) massCancel(ctx context.Context, userID string, side *pbTypes.Side, reason pbTypes.CancelReason) ([]*pb.CancelledOrder, error) {
+	replayCh := make(chan []*pb.CancelledOrder, 1)
+	errCh := make(chan error, 1)
+	if err := a.send(ctx, MassCancelMsg{ctx: ctx, UserID: userID, Side: side, Reason: reason, replay: replayCh, Err: errCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// MassCancel cancels a user's orders in symbol, or in every symbol when symbol is empty. Each
+// symbol is cancelled atomically on its own; with every symbol requested, the symbols that
+// failed are reported next to the orders that were cancelled instead of failing the call.
+func MassCancel(ctx context.Context, userID string, symbol string, side *pbTypes.Side) (*pb.MassCancelResponse, error) {
+	if userID == "" {
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "user_id is required")
+	}
+
+	return massCancel(ctx, userID, symbol, side, pbTypes.CancelReason_CANCEL_REASON_MASS_CANCEL)
+}
+
+func massCancel(ctx context.Context, userID string, symbol string, side *pbTypes.Side, reason pbTypes.CancelReason) (*pb.MassCancelResponse, error) {
+	if symbol != "" {
+		actor, err := lookupActor(symbol)
+		if err != nil {
+			return nil, err
+		}
+
+		cancelled, err := actor.massCancel(ctx, userID, side, reason)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.MassCancelResponse{Orders: cancelled}, nil
+	}
+
+	return massCancelSymbols(ctx, userID, runningSymbols(), side, reason), nil
+}
+
+// massCancelSymbols cancels a user's orders in each of symbols, reporting the symbols that
+// failed next to the orders that were cancelled.
+func massCancelSymbols(ctx context.Context, userID string, symbols []string, side *pbTypes.Side, reason pbTypes.CancelReason) *pb.MassCancelResponse {
+	results := make([][]*pb.CancelledOrder, len(symbols))
+	errs := make([]error, len(symbols))
+
+	// Symbols are independent actors, so a busy inbox only delays its own symbol
+	var wg sync.WaitGroup
+	for i, name := range symbols {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			actor, err := lookupActor(name)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i], errs[i] = actor.massCancel(ctx, userID, side, reason)
+		}()
+	}
+	wg.Wait()
+
+	response := &pb.MassCancelResponse{}
+	for i, name := range symbols {
+		if errs[i] != nil {
+			response.Failures = append(response.Failures, &pb.MassCancelFailure{Symbol: name, Message: errs[i].Error(), RejectReason: rejectReason(errs[i])})
+			continue
+		}
+		response.Orders = append(response.Orders, results[i]...)
+	}
+
+	return response
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+// A skip list of height h holds ~2^h levels before searches start to degrade.
+const priceIndexMaxHeight = 32
+
+/*
+==================================================================
+================= Price Level Index (Skip List) ==================
+==================================================================
+*/
+
+type priceIndexNode struct {
+	level *PriceLevel
+	next  []*priceIndexNode
+}
+
+// priceIndex is a skip list over the price levels of one side, ordered best price first.
+// The PriceLevel linked list stays the source of truth for iteration; the index only finds
+// where a new level goes and forgets removed ones, both in O(log n).
+type priceIndex struct {
+	head   priceIndexNode
+	height int
+	better func(a, b int64) bool
+
+	// Fixed-seed xorshift, so the same sequence of prices builds the same index on every run
+	rng uint64
+}
+
+func newPriceIndex(side pbTypes.Side) *priceIndex {
+	better := func(a, b int64) bool { return a < b } // asks: lowest first
+	if side == pbTypes.Side_BUY {
+		better = func(a, b int64) bool { return a > b } // bids: highest first
+	}
+
+	return &priceIndex{
+		head:   priceIndexNode{next: make([]*priceIndexNode, priceIndexMaxHeight)},
+		height: 1,
+		better: better,
+		rng:    0x9E3779B97F4A7C15,
+	}
+}
+
+func (pi *priceIndex) randomHeight() int {
+	pi.rng ^= pi.rng << 13
+	pi.rng ^= pi.rng >> 7
+	pi.rng ^= pi.rng << 17
+
+	// Each extra level with probability 1/2
+	height := 1
+	for bits := pi.rng; height < priceIndexMaxHeight && bits&1 == 1; bits >>= 1 {
+		height++
+	}
+	return height
+}
+
+// findPredecessors fills update with the last node on each level whose price is better than price.
+func (pi *priceIndex) findPredecessors(price int64, update []*priceIndexNode) {
+	node := &pi.head
+	for i := pi.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && pi.better(node.next[i].level.Price, price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+}
+
+// insert adds level and returns the level right before it in priority order, or nil if it is the new best.
+func (pi *priceIndex) insert(level *PriceLevel) *PriceLevel {
+	var update [priceIndexMaxHeight]*priceIndexNode
+	pi.findPredecessors(level.Price, update[:])
+
+	height := pi.randomHeight()
+	for i := pi.height; i < height; i++ {
+		update[i] = &pi.head
+	}
+	pi.height = max(pi.height, height)
+
+	node := &priceIndexNode{level: level, next: make([]*priceIndexNode, height)}
+	for i := range height {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+
+	return update[0].level
+}
+
+func (pi *priceIndex) remove(price int64) {
+	var update [priceIndexMaxHeight]*priceIndexNode
+	pi.findPredecessors(price, update[:])
+
+	node := update[0].next[0]
+	if node == nil || node.level.Price != price {
+		return
+	}
+
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+
+	for pi.height > 1 && pi.head.next[pi.height-1] == nil {
+		pi.height--
+	}
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+func TestPriceLevelsStayOrdered(t *testing.T) {
+	for _, side := range []pbTypes.Side{pbTypes.Side_BUY, pbTypes.Side_SELL} {
+		obs := NewOrderBookSide(side)
+		rnd := rand.New(rand.NewSource(1))
+
+		for range 20000 {
+			price := int64(rnd.Intn(3000))
+			if level, ok := obs.PriceLevels[price]; ok && rnd.Intn(3) == 0 {
+				obs.RemovePriceLevel(level)
+				continue
+			}
+			obs.GetOrCreatePriceLevel(price)
+		}
+
+		want := make([]int64, 0, len(obs.PriceLevels))
+		for price := range obs.PriceLevels {
+			want = append(want, price)
+		}
+		sort.Slice(want, func(i, j int) bool {
+			if side == pbTypes.Side_BUY {
+				return want[i] > want[j]
+			}
+			return want[i] < want[j]
+		})
+
+		got := make([]int64, 0, len(want))
+		var prev *PriceLevel
+		for level := obs.BestPriceLevel; level != nil; level = level.NextPrice {
+			if level.PrevPrice != prev {
+				t.Fatalf("%v: level %d links back to the wrong level", side, level.Price)
+			}
+			got = append(got, level.Price)
+			prev = level
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%v: %d levels out of order, want %d", side, len(got), len(want))
+		}
+	}
+}
+
+/*
+==================================================================
+============ Benchmarks: Skip List vs the Linear Walk =============
+==================================================================
+*/
+
+var priceLevelBenchmarkSizes = []int{100, 1000, 10000}
+
+// linearLinkPriceLevel is how LinkPriceLevel found the place of a new level before the index:
+// a walk from the best price.
+func linearLinkPriceLevel(obs *OrderBookSide, newLevel *PriceLevel) {
+	obs.PriceLevels[newLevel.Price] = newLevel
+
+	prevLevel := linearFindPrevious(obs, newLevel.Price)
+	if prevLevel == nil {
+		newLevel.NextPrice = obs.BestPriceLevel
+		if obs.BestPriceLevel != nil {
+			obs.BestPriceLevel.PrevPrice = newLevel
+		}
+		obs.BestPriceLevel = newLevel
+		return
+	}
+
+	newLevel.PrevPrice = prevLevel
+	newLevel.NextPrice = prevLevel.NextPrice
+	if prevLevel.NextPrice != nil {
+		prevLevel.NextPrice.PrevPrice = newLevel
+	}
+	prevLevel.NextPrice = newLevel
+}
+
+// linearFindPrevious is the last level better than price, or nil if price would be the best.
+func linearFindPrevious(obs *OrderBookSide, price int64) *PriceLevel {
+	better := func(a, b int64) bool { return a < b }
+	if obs.Side == pbTypes.Side_BUY {
+		better = func(a, b int64) bool { return a > b }
+	}
+
+	if obs.BestPriceLevel == nil || !better(obs.BestPriceLevel.Price, price) {
+		return nil
+	}
+
+	level := obs.BestPriceLevel
+	for level.NextPrice != nil && better(level.NextPrice.Price, price) {
+		level = level.NextPrice
+	}
+	return level
+}
+
+// benchmarkPrices is n ask prices in a fixed random order, so most levels land mid-book.
+func benchmarkPrices(n int) []int64 {
+	prices := make([]int64, n)
+	for i, p := range rand.New(rand.NewSource(1)).Perm(n) {
+		prices[i] = int64(p * 2)
+	}
+	return prices
+}
+
+func BenchmarkPriceLevelInsert(b *testing.B) {
+	for _, n := range priceLevelBenchmarkSizes {
+		prices := benchmarkPrices(n)
+
+		b.Run(fmt.Sprintf("skiplist/%d", n), func(b *testing.B) {
+			for range b.N {
+				obs := NewOrderBookSide(pbTypes.Side_SELL)
+				for _, price := range prices {
+					obs.GetOrCreatePriceLevel(price)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for range b.N {
+				obs := &OrderBookSide{Side: pbTypes.Side_SELL, PriceLevels: make(map[int64]*PriceLevel)}
+				for _, price := range prices {
+					linearLinkPriceLevel(obs, &PriceLevel{Price: price, book: obs})
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPriceLevelLookup finds where a new price goes in a side that already has n levels.
+func BenchmarkPriceLevelLookup(b *testing.B) {
+	for _, n := range priceLevelBenchmarkSizes {
+		prices := benchmarkPrices(n)
+
+		b.Run(fmt.Sprintf("skiplist/%d", n), func(b *testing.B) {
+			obs := NewOrderBookSide(pbTypes.Side_SELL)
+			for _, price := range prices {
+				obs.GetOrCreatePriceLevel(price)
+			}
+
+			var update [priceIndexMaxHeight]*priceIndexNode
+			b.ResetTimer()
+			for i := range b.N {
+				obs.index.findPredecessors(prices[i%n]+1, update[:])
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			obs := &OrderBookSide{Side: pbTypes.Side_SELL, PriceLevels: make(map[int64]*PriceLevel)}
+			for _, price := range prices {
+				linearLinkPriceLevel(obs, &PriceLevel{Price: price, book: obs})
+			}
+
+			b.ResetTimer()
+			for i := range b.N {
+				linearFindPrevious(obs, prices[i%n]+1)
+			}
+		})
+	}
+}
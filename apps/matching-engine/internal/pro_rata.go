@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"math/bits"
+
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+/*
+==================================================================
+====================== Matching Algorithms =======================
+==================================================================
+*/
+
+// MatchingAlgorithm decides how an incoming order is shared among the orders of a price level.
+type MatchingAlgorithm int32
+
+const (
+	// MatchingFIFO fills the orders of a level in time priority; the default
+	MatchingFIFO MatchingAlgorithm = iota
+
+	// MatchingProRata shares the fill across the level in proportion to each order's size
+	MatchingProRata
+
+	// MatchingTopOrderProRata fills the head of the queue first, up to TopOrderQuantity, and
+	// shares the rest pro-rata
+	MatchingTopOrderProRata
+)
+
+// ProRataRounding turns a pro-rata share into whole lots.
+type ProRataRounding int32
+
+const (
+	// RoundDown rounds every share down; what is left over goes FIFO
+	RoundDown ProRataRounding = iota
+
+	// RoundNearest rounds every share to the nearest lot; when that adds up to more than the
+	// fill, the orders ahead in the queue get their share first
+	RoundNearest
+)
+
+// MatchingSpec is the matching algorithm of a symbol. The zero spec is FIFO.
+type MatchingSpec struct {
+	Algorithm MatchingAlgorithm
+	Rounding  ProRataRounding
+
+	// Smallest pro-rata share an order gets; a smaller share goes FIFO with the rounding
+	// rest. 0 = no minimum.
+	MinAllocation int64
+
+	// Most the head of the queue gets before the pro-rata pass of MatchingTopOrderProRata;
+	// 0 = all of it.
+	TopOrderQuantity int64
+}
+
+func (spec MatchingSpec) Validate(instrument InstrumentSpec) error {
+	if spec.Algorithm < MatchingFIFO || spec.Algorithm > MatchingTopOrderProRata {
+		return fmt.Errorf("unknown matching algorithm %d", spec.Algorithm)
+	}
+	if spec.Rounding < RoundDown || spec.Rounding > RoundNearest {
+		return fmt.Errorf("unknown pro-rata rounding %d", spec.Rounding)
+	}
+	if spec.MinAllocation < 0 || spec.TopOrderQuantity < 0 {
+		return fmt.Errorf("matching settings cannot be negative")
+	}
+	if spec.MinAllocation%instrument.lotSize() != 0 || spec.TopOrderQuantity%instrument.lotSize() != 0 {
+		return fmt.Errorf("min allocation and top order quantity must be multiples of the lot size %d", instrument.lotSize())
+	}
+	return nil
+}
+
+func MatchingSpecFromProto(spec *pb.MatchingSpec) MatchingSpec {
+	return MatchingSpec{
+		Algorithm:        MatchingAlgorithm(spec.GetAlgorithm()),
+		Rounding:         ProRataRounding(spec.GetRounding()),
+		MinAllocation:    spec.GetMinAllocation(),
+		TopOrderQuantity: spec.GetTopOrderQuantity(),
+	}
+}
+
+// allocation is what one resting order trades of an incoming order.
+type allocation struct {
+	order    *Order
+	quantity int64
+}
+
+// allocate shares quantity among the orders of a level, in queue order. Every order only
+// offers its matchable quantity, so an iceberg takes part with its visible slice and joins
+// the next round after it refreshes. The result only depends on the queue, so the same
+// book always gives the same trades.
+func (me *MatchingEngine) allocate(level *PriceLevel, quantity int64) []allocation {
+	spec := me.Matching
+
+	if spec.Algorithm == MatchingFIFO {
+		// An iceberg only trades its visible slice before it refreshes to the back of the level
+		head := level.HeadOrder
+		return []allocation{{order: head, quantity: min(quantity, head.matchableQuantity())}}
+	}
+
+	allocations := []allocation{}
+	var total int64
+	for order := level.HeadOrder; order != nil; order = order.Next {
+		allocations = append(allocations, allocation{order: order})
+		total += order.matchableQuantity()
+	}
+
+	// The whole level trades, so there is nothing to share
+	if total <= quantity {
+		for i := range allocations {
+			allocations[i].quantity = allocations[i].order.matchableQuantity()
+		}
+		return allocations
+	}
+
+	left := quantity
+	if spec.Algorithm == MatchingTopOrderProRata {
+		top := min(left, allocations[0].order.matchableQuantity())
+		if spec.TopOrderQuantity > 0 {
+			top = min(top, spec.TopOrderQuantity)
+		}
+		allocations[0].quantity = top
+		left -= top
+	}
+
+	// Pro-rata in whole lots over what each order still offers
+	lot := me.Instrument.lotSize()
+	var totalLots int64
+	for _, a := range allocations {
+		totalLots += (a.order.matchableQuantity() - a.quantity) / lot
+	}
+
+	if sharedLots := left / lot; totalLots > 0 {
+		for i := range allocations {
+			sizeLots := (allocations[i].order.matchableQuantity() - allocations[i].quantity) / lot
+
+			lots, rest := mulDiv(sizeLots, sharedLots, totalLots)
+			if spec.Rounding == RoundNearest && 2*uint64(rest) >= uint64(totalLots) {
+				lots++
+			}
+
+			share := min(lots*lot, left)
+			if share < spec.MinAllocation {
+				continue
+			}
+			allocations[i].quantity += share
+			left -= share
+		}
+	}
+
+	// The rounding rest and the shares below the minimum go FIFO
+	for i := range allocations {
+		if left == 0 {
+			break
+		}
+		take := min(left, allocations[i].order.matchableQuantity()-allocations[i].quantity)
+		allocations[i].quantity += take
+		left -= take
+	}
+
+	fills := allocations[:0]
+	for _, a := range allocations {
+		if a.quantity > 0 {
+			fills = append(fills, a)
+		}
+	}
+	return fills
+}
+
+// mulDiv is a*b/c and its remainder, without a*b overflowing; a must not exceed c.
+func mulDiv(a, b, c int64) (int64, int64) {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	quotient, remainder := bits.Div64(hi, lo, uint64(c))
+	return int64(quotient), int64(remainder)
+}
+
+// selfTradeOrder is the resting order of the incoming user the level would trade first, if
+// any. FIFO meets the head of the queue only; pro-rata meets the whole level at once.
+func (me *MatchingEngine) selfTradeOrder(level *PriceLevel, incoming *Order) *Order {
+	if me.Matching.Algorithm == MatchingFIFO {
+		if level.HeadOrder.UserID == incoming.UserID {
+			return level.HeadOrder
+		}
+		return nil
+	}
+
+	for order := level.HeadOrder; order != nil; order = order.Next {
+		if order.UserID == incoming.UserID {
+			return order
+		}
+	}
+	return nil
+}
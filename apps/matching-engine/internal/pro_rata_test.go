@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+func TestAllocateWorkedExamples(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     MatchingSpec
+		quantity int64
+		want     []string
+	}{
+		{
+			name:     "shares in proportion",
+			spec:     MatchingSpec{Algorithm: MatchingProRata},
+			quantity: 10,
+			want:     []string{"r10:1", "r20:2", "r70:7"},
+		},
+		{
+			// 0.5, 1 and 3.5: the two smaller shares are below the minimum and go FIFO
+			name:     "shares below the minimum go FIFO",
+			spec:     MatchingSpec{Algorithm: MatchingProRata, MinAllocation: 2},
+			quantity: 5,
+			want:     []string{"r10:2", "r70:3"},
+		},
+		{
+			// 0.5 → 1, 1 → 1 and 3.5 → 4 add up to 6, so the last order gets what is left
+			name:     "nearest rounding favours the queue",
+			spec:     MatchingSpec{Algorithm: MatchingProRata, Rounding: RoundNearest},
+			quantity: 5,
+			want:     []string{"r10:1", "r20:1", "r70:3"},
+		},
+		{
+			// 4 to the head, then 16 over 6/20/70 = 1, 3, 11 and the rest of 1 FIFO
+			name:     "top order then pro-rata",
+			spec:     MatchingSpec{Algorithm: MatchingTopOrderProRata, TopOrderQuantity: 4},
+			quantity: 20,
+			want:     []string{"r10:6", "r20:3", "r70:11"},
+		},
+		{
+			name:     "the whole level trades",
+			spec:     MatchingSpec{Algorithm: MatchingProRata},
+			quantity: 150,
+			want:     []string{"r10:10", "r20:20", "r70:70"},
+		},
+		{
+			name:     "fifo takes the head only",
+			spec:     MatchingSpec{},
+			quantity: 15,
+			want:     []string{"r10:10"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me := NewMatchingEngine(testSymbol, nil)
+			me.Matching = tt.spec
+
+			level := me.Asks.GetOrCreatePriceLevel(100)
+			for _, quantity := range []int64{10, 20, 70} {
+				level.Push(&Order{ClientOrderID: fmt.Sprintf("r%d", quantity), Side: pbTypes.Side_SELL, Price: 100, Quantity: quantity, RemainingQuantity: quantity})
+			}
+
+			got := []string{}
+			for _, fill := range me.allocate(level, tt.quantity) {
+				got = append(got, fmt.Sprintf("%s:%d", fill.order.ClientOrderID, fill.quantity))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("allocate %d = %v, want %v", tt.quantity, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProRataMatchingReplays(t *testing.T) {
+	for _, spec := range []MatchingSpec{
+		{Algorithm: MatchingProRata},
+		{Algorithm: MatchingProRata, Rounding: RoundNearest, MinAllocation: 2},
+		{Algorithm: MatchingTopOrderProRata, TopOrderQuantity: 4},
+		{Algorithm: MatchingTopOrderProRata, Rounding: RoundNearest},
+	} {
+		t.Run(fmt.Sprintf("%+v", spec), func(t *testing.T) {
+			dir := t.TempDir()
+			a := newTestActor(t, dir)
+			a.engine.Matching = spec
+			stop := runTestActor(t, a)
+
+			rnd := rand.New(rand.NewSource(5))
+			for i := range 1000 {
+				order := limitOrder(fmt.Sprintf("o%d", i), fmt.Sprintf("u%d", rnd.Intn(6)), pbTypes.Side(rnd.Intn(2)), int64(95+rnd.Intn(10)), int64(1+rnd.Intn(30)))
+				order.DisplayQuantity = int64(rnd.Intn(3) * 3)
+				if rnd.Intn(8) == 0 {
+					order.TimeInForce = pbTypes.TimeInForce_FOK
+					order.DisplayQuantity = 0
+				}
+
+				// Every share fits its order and the shares add up to what the level can trade
+				opposite := a.engine.Asks
+				if order.Side == pbTypes.Side_SELL {
+					opposite = a.engine.Bids
+				}
+				if level := opposite.BestPriceLevel; level != nil {
+					quantity := int64(1 + rnd.Intn(40))
+
+					var offered, allocated int64
+					for resting := level.HeadOrder; resting != nil; resting = resting.Next {
+						offered += resting.matchableQuantity()
+					}
+					for _, fill := range a.engine.allocate(level, quantity) {
+						if fill.quantity <= 0 || fill.quantity > fill.order.matchableQuantity() {
+							t.Fatalf("%s gets %d of %d", fill.order.ClientOrderID, fill.quantity, fill.order.matchableQuantity())
+						}
+						allocated += fill.quantity
+					}
+					if allocated != min(quantity, offered) {
+						t.Fatalf("allocated %d of %d, level offers %d", allocated, quantity, offered)
+					}
+				}
+
+				placeTestOrder(t, a, order)
+			}
+			if a.engine.TotalMatches == 0 {
+				t.Fatal("nothing traded")
+			}
+			stop()
+
+			live := checkBook(t, a.engine)
+			if replayed := replayedBook(t, dir); replayed != live {
+				t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"sort"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/status"
+)
+
+// Price levels per side GetOrderBook returns when the request does not set a depth
+const defaultOrderBookDepth = 100
+
+/*
+==================================================================
+==================== Open Orders By User Index ===================
+==================================================================
+*/
+
+// indexOrder adds an order to its user's open orders once it rests or waits for its trigger.
+func (me *MatchingEngine) indexOrder(order *Order) {
+	orders, ok := me.UserOrders[order.UserID]
+	if !ok {
+		orders = make(map[string]*Order)
+		me.UserOrders[order.UserID] = orders
+	}
+	orders[order.ClientOrderID] = order
+}
+
+func (me *MatchingEngine) unindexOrder(order *Order) {
+	orders, ok := me.UserOrders[order.UserID]
+	if !ok {
+		return
+	}
+
+	delete(orders, order.ClientOrderID)
+	if len(orders) == 0 {
+		delete(me.UserOrders, order.UserID)
+	}
+}
+
+/*
+==================================================================
+========================= Book Queries ===========================
+==================================================================
+*/
+
+// GetOrderMsg, ListOpenOrdersMsg and OrderBookMsg only read the engine. They go through the
+// inbox like every other message, so the answer is the state between two messages.
+type GetOrderMsg struct {
+	OrderID string
+	UserID  string
+	replay  chan *pb.GetOrderResponse
+	Err     chan error
+}
+
+type ListOpenOrdersMsg struct {
+	UserID string
+	replay chan *pb.ListOpenOrdersResponse
+}
+
+type OrderBookMsg struct {
+	Depth  int
+	Orders bool
+	replay chan *pb.GetOrderBookResponse
+	Err    chan error
+}
+
+// getOrder returns an open order or stop, or the last state of an order that has left the
+// book but is still in the idempotency window. Another user's order is reported as not found.
+func (me *MatchingEngine) getOrder(orderID string, userID string) (*pb.GetOrderResponse, error) {
+	var order *pb.OrderStatusEvent
+
+	if existing, exists := me.findOrder(orderID); exists {
+		order = NewOrderStatusEvent(existing)
+	} else if record, exists := me.Idempotency.order(orderID); exists {
+		order = record.GetOrder()
+	}
+
+	if order == nil || order.GetUserId() != userID {
+		return nil, orderNotFound("order %s not found in %s", orderID, me.Symbol)
+	}
+
+	return &pb.GetOrderResponse{Order: order}, nil
+}
+
+// userOrders returns a user's resting orders and untriggered stops, oldest first. The order
+// is fixed so that anything acting on all of them writes its events in the same sequence.
+func (me *MatchingEngine) userOrders(userID string) []*Order {
+	orders := make([]*Order, 0, len(me.UserOrders[userID]))
+	for _, order := range me.UserOrders[userID] {
+		orders = append(orders, order)
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		left, right := orders[i].EngineTimestamp.AsTime(), orders[j].EngineTimestamp.AsTime()
+		if !left.Equal(right) {
+			return left.Before(right)
+		}
+		return orders[i].ClientOrderID < orders[j].ClientOrderID
+	})
+
+	return orders
+}
+
+func (me *MatchingEngine) openOrders(userID string) *pb.ListOpenOrdersResponse {
+	orders := []*pb.OrderStatusEvent{}
+	for _, order := range me.userOrders(userID) {
+		orders = append(orders, NewOrderStatusEvent(order))
+	}
+
+	return &pb.ListOpenOrdersResponse{Orders: orders}
+}
+
+// orderBook returns the displayed book, depth levels per side, and with orders set the L3
+// view of those levels that the L3 feed continues from.
+func (me *MatchingEngine) orderBook(depth int, orders bool) (*pb.GetOrderBookResponse, error) {
+	if depth <= 0 {
+		depth = defaultOrderBookDepth
+	}
+	if orders && me.l3 == nil {
+		return nil, failedPrecondition(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "%s has no L3 feed", me.Symbol)
+	}
+
+	response := &pb.GetOrderBookResponse{
+		Symbol:       me.Symbol,
+		Bids:         depthLevels(me.Bids, depth),
+		Asks:         depthLevels(me.Asks, depth),
+		Sequence:     int64(me.TradeSequence),
+		Timestamp:    me.timestamp(),
+		TradingState: me.TradingState,
+		BookSequence: me.BookSequence,
+	}
+	if orders {
+		response.BidOrders = me.l3.bookOrders(me.Bids, depth)
+		response.AskOrders = me.l3.bookOrders(me.Asks, depth)
+	}
+
+	return response, nil
+}
+
+func GetOrder(ctx context.Context, symbol string, orderID string, userID string) (*pb.GetOrderResponse, error) {
+	if orderID == "" || userID == "" {
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "order_id and user_id are required")
+	}
+
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	replayCh := make(chan *pb.GetOrderResponse, 1)
+	errCh := make(chan error, 1)
+	if err := actor.send(ctx, GetOrderMsg{OrderID: orderID, UserID: userID, replay: replayCh, Err: errCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func ListOpenOrders(ctx context.Context, symbol string, userID string) (*pb.ListOpenOrdersResponse, error) {
+	if userID == "" {
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "user_id is required")
+	}
+
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	replayCh := make(chan *pb.ListOpenOrdersResponse, 1)
+	if err := actor.send(ctx, ListOpenOrdersMsg{UserID: userID, replay: replayCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func GetOrderBook(ctx context.Context, symbol string, depth int, orders bool) (*pb.GetOrderBookResponse, error) {
+	if depth < 0 {
+		return nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "depth cannot be negative")
+	}
+
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	replayCh := make(chan *pb.GetOrderBookResponse, 1)
+	errCh := make(chan error, 1)
+	if err := actor.send(ctx, OrderBookMsg{Depth: depth, Orders: orders, replay: replayCh, Err: errCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-replayCh:
+		return res, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
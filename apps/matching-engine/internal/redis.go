@@ -27,6 +27,48 @@ func InitRedis(url string) error {
 	return nil
 }
 
+// Events a symbol may have waiting for Redis before new ones are dropped
+const redisPublishQueueSize = 8192
+
+// redisPublisher publishes the events of one symbol in the order they were produced, so the
+// DEPTH_DIFF sequence reaches Redis unbroken. The actor never waits on it: when Redis falls
+// too far behind, events are dropped and the diff sequence gap tells clients to resync.
+type redisPublisher struct {
+	symbol string
+	queue  chan *pb.EngineEvent
+	done   chan struct{}
+}
+
+func newRedisPublisher(symbol string) *redisPublisher {
+	return &redisPublisher{
+		symbol: symbol,
+		queue:  make(chan *pb.EngineEvent, redisPublishQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+func (p *redisPublisher) publish(event *pb.EngineEvent) {
+	select {
+	case p.queue <- event:
+	default:
+		slog.Warn("redis publish queue full, dropping event", "symbol", p.symbol, "eventType", event.EventType)
+	}
+}
+
+func (p *redisPublisher) run() {
+	defer close(p.done)
+
+	for event := range p.queue {
+		PublishEngineEvent(event)
+	}
+}
+
+// close publishes what is still queued and stops. Called once the actor loop has exited.
+func (p *redisPublisher) close() {
+	close(p.queue)
+	<-p.done
+}
+
 // Non-fatal: logs warn on error so matching loop is never blocked.
 func PublishEngineEvent(event *pb.EngineEvent) {
 	if redisClient == nil {
@@ -41,11 +83,40 @@ func PublishEngineEvent(event *pb.EngineEvent) {
 			slog.Warn("redis publish depth failed", "symbol", sym, "err", err)
 		}
 
+	case pbTypes.EventType_DEPTH_DIFF:
+		if err := redisClient.Publish(ctx, "depth_diff:"+sym, event.Data).Err(); err != nil {
+			slog.Warn("redis publish depth diff failed", "symbol", sym, "err", err)
+		}
+
+	case pbTypes.EventType_L3:
+		if err := redisClient.Publish(ctx, "l3:"+sym, event.Data).Err(); err != nil {
+			slog.Warn("redis publish l3 failed", "symbol", sym, "err", err)
+		}
+
 	case pbTypes.EventType_TICKER:
 		if err := redisClient.Publish(ctx, "ticker:"+sym, event.Data).Err(); err != nil {
 			slog.Warn("redis publish ticker failed", "symbol", sym, "err", err)
 		}
 
+	case pbTypes.EventType_TRADING_STATE_CHANGED:
+		// Kept as a key too, so a gateway can send the current state to a new subscriber
+		if err := redisClient.Set(ctx, "trading_state:"+sym, event.Data, 0).Err(); err != nil {
+			slog.Warn("redis set trading state failed", "symbol", sym, "err", err)
+		}
+		if err := redisClient.Publish(ctx, "trading_state:"+sym, event.Data).Err(); err != nil {
+			slog.Warn("redis publish trading state failed", "symbol", sym, "err", err)
+		}
+
+	case pbTypes.EventType_AUCTION_INDICATIVE, pbTypes.EventType_AUCTION_UNCROSSED:
+		data, err := proto.Marshal(event)
+		if err != nil {
+			slog.Error("redis: marshal engine event failed", "err", err)
+			return
+		}
+		if err := redisClient.Publish(ctx, "auction:"+sym, data).Err(); err != nil {
+			slog.Warn("redis publish auction failed", "symbol", sym, "err", err)
+		}
+
 	case pbTypes.EventType_TRADE_EXECUTED:
 		var trade pb.TradeEvent
 		if err := proto.Unmarshal(event.Data, &trade); err != nil {
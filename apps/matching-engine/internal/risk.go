@@ -0,0 +1,406 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+/*
+==================================================================
+======================= Pre-Trade Risk Limits ====================
+==================================================================
+*/
+
+// RiskLimits caps what a single order, or a single user, can do on a symbol. 0 = no limit.
+type RiskLimits struct {
+	MaxOrderQuantity int64
+
+	// price * quantity; MARKET orders are priced at the risk reference
+	MaxNotional int64
+
+	// How far a LIMIT price may be from the risk reference, in basis points
+	MaxPriceDeviationBps int64
+
+	// Open orders and untriggered stops of one user; orders that cannot rest are not held to it
+	MaxOpenOrders int64
+
+	MaxOrdersPerSecond int64
+}
+
+func (l RiskLimits) Validate() error {
+	if l.MaxOrderQuantity < 0 || l.MaxNotional < 0 || l.MaxPriceDeviationBps < 0 || l.MaxOpenOrders < 0 || l.MaxOrdersPerSecond < 0 {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "risk limits cannot be negative")
+	}
+	return nil
+}
+
+// orDefaults is l with every limit it leaves at 0 taken from defaults.
+func (l RiskLimits) orDefaults(defaults RiskLimits) RiskLimits {
+	pick := func(value, fallback int64) int64 {
+		if value != 0 {
+			return value
+		}
+		return fallback
+	}
+
+	return RiskLimits{
+		MaxOrderQuantity:     pick(l.MaxOrderQuantity, defaults.MaxOrderQuantity),
+		MaxNotional:          pick(l.MaxNotional, defaults.MaxNotional),
+		MaxPriceDeviationBps: pick(l.MaxPriceDeviationBps, defaults.MaxPriceDeviationBps),
+		MaxOpenOrders:        pick(l.MaxOpenOrders, defaults.MaxOpenOrders),
+		MaxOrdersPerSecond:   pick(l.MaxOrdersPerSecond, defaults.MaxOrdersPerSecond),
+	}
+}
+
+func (l RiskLimits) ToProto() *pb.RiskLimits {
+	return &pb.RiskLimits{
+		MaxOrderQuantity:     l.MaxOrderQuantity,
+		MaxNotional:          l.MaxNotional,
+		MaxPriceDeviationBps: l.MaxPriceDeviationBps,
+		MaxOpenOrders:        l.MaxOpenOrders,
+		MaxOrdersPerSecond:   l.MaxOrdersPerSecond,
+	}
+}
+
+func RiskLimitsFromProto(limits *pb.RiskLimits) RiskLimits {
+	return RiskLimits{
+		MaxOrderQuantity:     limits.GetMaxOrderQuantity(),
+		MaxNotional:          limits.GetMaxNotional(),
+		MaxPriceDeviationBps: limits.GetMaxPriceDeviationBps(),
+		MaxOpenOrders:        limits.GetMaxOpenOrders(),
+		MaxOrdersPerSecond:   limits.GetMaxOrdersPerSecond(),
+	}
+}
+
+// symbolRiskLimits is the limits of one symbol. A user with limits of their own is held to
+// them field by field: every limit the user sets (non-zero) wins, every one left at 0 is the
+// symbol's. A market maker can be given more room on one limit and keep the others; a user
+// cannot be freed from a limit the symbol has.
+type symbolRiskLimits struct {
+	Limits RiskLimits
+	Users  map[string]RiskLimits `json:",omitempty"`
+}
+
+// riskRegistry holds the risk limits of every symbol. Like the STP defaults it is read by the
+// actors on every order and changed by admins at any time, so it sits behind a lock.
+type riskRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	symbols map[string]symbolRiskLimits
+}
+
+var riskLimits = &riskRegistry{symbols: map[string]symbolRiskLimits{}}
+
+// LoadRiskLimits reads the risk limits from path and keeps path as the file later changes are
+// written to. A missing file is a fresh start: no symbol has limits.
+func LoadRiskLimits(path string) error {
+	riskLimits.mu.Lock()
+	defer riskLimits.mu.Unlock()
+
+	riskLimits.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	symbols := map[string]symbolRiskLimits{}
+	if err := json.Unmarshal(data, &symbols); err != nil {
+		return err
+	}
+
+	for symbol, limits := range symbols {
+		if err := limits.Limits.Validate(); err != nil {
+			return fmt.Errorf("risk limits of %s: %w", symbol, err)
+		}
+		for userID, userLimits := range limits.Users {
+			if err := userLimits.Validate(); err != nil {
+				return fmt.Errorf("risk limits of %s for user %s: %w", symbol, userID, err)
+			}
+		}
+		riskLimits.symbols[symbol] = limits
+	}
+
+	return nil
+}
+
+// SetRiskLimits sets the limits of a symbol, or of one user on it when userID is set; clear
+// drops them instead. It returns the limits before and after. Orders the actor takes after
+// the call are checked against the new limits.
+func SetRiskLimits(symbol string, userID string, limits RiskLimits, clear bool) (RiskLimits, RiskLimits, error) {
+	if _, err := lookupActor(symbol); err != nil {
+		return RiskLimits{}, RiskLimits{}, err
+	}
+	if clear {
+		limits = RiskLimits{}
+	}
+	if err := limits.Validate(); err != nil {
+		return RiskLimits{}, RiskLimits{}, err
+	}
+
+	riskLimits.mu.Lock()
+	defer riskLimits.mu.Unlock()
+
+	previous, existed := riskLimits.symbols[symbol]
+
+	// Copied, so a failed save leaves the previous entry as it was
+	updated := symbolRiskLimits{Limits: previous.Limits, Users: map[string]RiskLimits{}}
+	for user, userLimits := range previous.Users {
+		updated.Users[user] = userLimits
+	}
+
+	var previousLimits RiskLimits
+	switch {
+	case userID == "":
+		previousLimits = previous.Limits
+		updated.Limits = limits
+	case clear:
+		previousLimits = previous.Users[userID]
+		delete(updated.Users, userID)
+	default:
+		previousLimits = previous.Users[userID]
+		updated.Users[userID] = limits
+	}
+
+	if updated.Limits == (RiskLimits{}) && len(updated.Users) == 0 {
+		delete(riskLimits.symbols, symbol)
+	} else {
+		riskLimits.symbols[symbol] = updated
+	}
+
+	if err := riskLimits.save(); err != nil {
+		// Keep memory and disk in agreement
+		if existed {
+			riskLimits.symbols[symbol] = previous
+		} else {
+			delete(riskLimits.symbols, symbol)
+		}
+		return RiskLimits{}, RiskLimits{}, err
+	}
+
+	return previousLimits, limits, nil
+}
+
+// GetRiskLimits returns the limits of a symbol and of the users that have their own.
+func GetRiskLimits(symbol string) (*pb.GetRiskLimitsResponse, error) {
+	if _, err := lookupActor(symbol); err != nil {
+		return nil, err
+	}
+
+	riskLimits.mu.RLock()
+	defer riskLimits.mu.RUnlock()
+
+	limits := riskLimits.symbols[symbol]
+	response := &pb.GetRiskLimitsResponse{Symbol: symbol, Limits: limits.Limits.ToProto()}
+	for userID, userLimits := range limits.Users {
+		response.Users = append(response.Users, &pb.UserRiskLimits{UserId: userID, Limits: userLimits.ToProto()})
+	}
+	sort.Slice(response.Users, func(i, j int) bool { return response.Users[i].UserId < response.Users[j].UserId })
+
+	return response, nil
+}
+
+// limits is what an order of userID on symbol is held to.
+func (r *riskRegistry) limits(symbol string, userID string) RiskLimits {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	limits := r.symbols[symbol]
+	if userLimits, ok := limits.Users[userID]; ok {
+		return userLimits.orDefaults(limits.Limits)
+	}
+	return limits.Limits
+}
+
+// save writes the limits atomically. Callers hold the lock.
+func (r *riskRegistry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.symbols, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.path, data)
+}
+
+/*
+==================================================================
+======================= Pre-Trade Risk Checks ====================
+==================================================================
+*/
+
+const (
+	orderRateWindow = time.Second
+
+	// How often the order times of users that went quiet are dropped
+	orderRateSweepInterval = time.Minute
+)
+
+// placeOrder is AddOrderInternal behind the risk checks, for new orders from clients. A retry,
+// and an order the instrument rules or the trading state turn away, go straight through so
+// they get their usual answer. The replacement of a modify is checked by checkModify.
+func (me *MatchingEngine) placeOrder(order *Order) (*AddOrderInternalResponse, []*pb.EngineEvent, error) {
+	_, duplicate, _ := me.duplicateOrder(order)
+	instrumentReason, _ := me.Instrument.check(order)
+	if duplicate || instrumentReason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED || me.checkTradingState(order) != "" {
+		return me.AddOrderInternal(order)
+	}
+
+	if reason, message := me.checkRisk(order, 0); reason != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		if order.EngineTimestamp == nil {
+			order.EngineTimestamp = me.timestamp()
+		}
+		return &AddOrderInternalResponse{Order: order}, []*pb.EngineEvent{rejectedEvent(order, reason, message)}, nil
+	}
+
+	me.recordOrderRate(order.UserID)
+	return me.AddOrderInternal(order)
+}
+
+// checkRisk holds an order to the risk limits of its user on the symbol, without changing
+// anything. pending is how many orders of the same user go in ahead of it in the same batch.
+// The replacement of a modify does not count the order it replaces as open, and a modify is
+// not held to the order rate. It returns REJECT_REASON_UNSPECIFIED when the order is within
+// the limits.
+func (me *MatchingEngine) checkRisk(order *Order, pending int) (pbTypes.RejectReason, string) {
+	limits := riskLimits.limits(me.Symbol, order.UserID)
+	if limits == (RiskLimits{}) {
+		return pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, ""
+	}
+
+	// ---------- size ----------
+	if limits.MaxOrderQuantity > 0 && order.Quantity > limits.MaxOrderQuantity {
+		return pbTypes.RejectReason_REJECT_REASON_RISK_MAX_QUANTITY, fmt.Sprintf("Quantity %d is above the risk limit %d", order.Quantity, limits.MaxOrderQuantity)
+	}
+
+	reference := me.riskReference(order.Side)
+
+	if limits.MaxNotional > 0 {
+		price := reference
+		switch order.Type {
+		case pbTypes.OrderType_LIMIT, pbTypes.OrderType_STOP_LIMIT:
+			price = order.Price
+		case pbTypes.OrderType_STOP_MARKET:
+			price = order.StopPrice
+		}
+
+		// price * quantity > limit, without overflowing int64
+		if price > 0 && order.Quantity > limits.MaxNotional/price {
+			return pbTypes.RejectReason_REJECT_REASON_RISK_MAX_NOTIONAL, fmt.Sprintf("Notional of %d at %d is above the risk limit %d", order.Quantity, price, limits.MaxNotional)
+		}
+	}
+
+	// ---------- price ----------
+	if limits.MaxPriceDeviationBps > 0 && order.Type == pbTypes.OrderType_LIMIT && reference > 0 {
+		deviation := order.Price - reference
+		if deviation < 0 {
+			deviation = -deviation
+		}
+
+		// deviation / reference > bps / 10000, compared in 128 bits
+		hi, lo := bits.Mul64(uint64(deviation), 10_000)
+		limitHi, limitLo := bits.Mul64(uint64(limits.MaxPriceDeviationBps), uint64(reference))
+		if hi > limitHi || (hi == limitHi && lo > limitLo) {
+			return pbTypes.RejectReason_REJECT_REASON_RISK_PRICE_DEVIATION, fmt.Sprintf("Price %d is more than %d bps away from the reference price %d", order.Price, limits.MaxPriceDeviationBps, reference)
+		}
+	}
+
+	// ---------- user activity ----------
+	if limits.MaxOpenOrders > 0 && canRest(order) {
+		open := int64(len(me.UserOrders[order.UserID]) + pending)
+		if _, ok := me.UserOrders[order.UserID][order.ReplacedOrderID]; ok {
+			open--
+		}
+		if open >= limits.MaxOpenOrders {
+			return pbTypes.RejectReason_REJECT_REASON_RISK_MAX_OPEN_ORDERS, fmt.Sprintf("User has %d open orders, the risk limit is %d", open, limits.MaxOpenOrders)
+		}
+	}
+
+	if limits.MaxOrdersPerSecond > 0 && order.ReplacedOrderID == "" {
+		if recent := int64(len(me.recentOrders(order.UserID)) + pending); recent >= limits.MaxOrdersPerSecond {
+			return pbTypes.RejectReason_REJECT_REASON_RISK_RATE_LIMIT, fmt.Sprintf("User sent %d orders in the last second, the risk limit is %d", recent, limits.MaxOrdersPerSecond)
+		}
+	}
+
+	return pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, ""
+}
+
+// riskReference is the price orders are held against: the last trade, else the best price on
+// the side the order would trade against, else the best price on its own side, else the
+// starting price. 0 when there is none.
+func (me *MatchingEngine) riskReference(side pbTypes.Side) int64 {
+	if me.LastTradePrice > 0 {
+		return me.LastTradePrice
+	}
+
+	opposite, own := me.Asks, me.Bids
+	if side == pbTypes.Side_SELL {
+		opposite, own = me.Bids, me.Asks
+	}
+	for _, bookSide := range []*OrderBookSide{opposite, own} {
+		if bookSide.BestPriceLevel != nil {
+			return bookSide.BestPriceLevel.Price
+		}
+	}
+
+	return me.StartingPrice
+}
+
+// canRest reports whether what is left of an order after matching would stay open.
+func canRest(order *Order) bool {
+	if order.Type == pbTypes.OrderType_MARKET {
+		return false
+	}
+	return order.TimeInForce != pbTypes.TimeInForce_IOC && order.TimeInForce != pbTypes.TimeInForce_FOK
+}
+
+// recentOrders is the times of the orders userID placed within the last second, oldest first.
+// Times come from the engine clock; they are not part of snapshots, so the window starts
+// empty after a restart.
+func (me *MatchingEngine) recentOrders(userID string) []time.Time {
+	times := me.orderTimes[userID]
+
+	cutoff := me.now.Add(-orderRateWindow)
+	expired := 0
+	for expired < len(times) && !times[expired].After(cutoff) {
+		expired++
+	}
+
+	if expired == len(times) {
+		delete(me.orderTimes, userID)
+		return nil
+	}
+
+	times = times[expired:]
+	me.orderTimes[userID] = times
+	return times
+}
+
+// recordOrderRate counts an order that passed the risk checks against its user's rate limit.
+func (me *MatchingEngine) recordOrderRate(userID string) {
+	if me.now.Sub(me.lastOrderRateSweep) >= orderRateSweepInterval {
+		for user := range me.orderTimes {
+			me.recentOrders(user)
+		}
+		me.lastOrderRateSweep = me.now
+	}
+
+	if riskLimits.limits(me.Symbol, userID).MaxOrdersPerSecond == 0 {
+		return
+	}
+	me.orderTimes[userID] = append(me.recentOrders(userID), me.now)
+}
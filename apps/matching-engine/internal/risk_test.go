@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// setTestRiskLimits gives testSymbol the limits for the rest of the test.
+func setTestRiskLimits(t *testing.T, limits symbolRiskLimits) {
+	t.Helper()
+
+	riskLimits.mu.Lock()
+	riskLimits.symbols[testSymbol] = limits
+	riskLimits.mu.Unlock()
+
+	t.Cleanup(func() {
+		riskLimits.mu.Lock()
+		delete(riskLimits.symbols, testSymbol)
+		riskLimits.mu.Unlock()
+	})
+}
+
+func TestUserRiskLimitsMergeWithSymbolLimits(t *testing.T) {
+	registry := &riskRegistry{symbols: map[string]symbolRiskLimits{
+		testSymbol: {
+			Limits: RiskLimits{MaxOrderQuantity: 100, MaxNotional: 10000, MaxOpenOrders: 5},
+			Users: map[string]RiskLimits{
+				"mm":    {MaxOrderQuantity: 1000, MaxOrdersPerSecond: 50},
+				"tight": {MaxNotional: 500},
+			},
+		},
+	}}
+
+	tests := []struct {
+		userID string
+		want   RiskLimits
+	}{
+		{"anyone", RiskLimits{MaxOrderQuantity: 100, MaxNotional: 10000, MaxOpenOrders: 5}},
+		{"mm", RiskLimits{MaxOrderQuantity: 1000, MaxNotional: 10000, MaxOpenOrders: 5, MaxOrdersPerSecond: 50}},
+		{"tight", RiskLimits{MaxOrderQuantity: 100, MaxNotional: 500, MaxOpenOrders: 5}},
+	}
+
+	for _, tt := range tests {
+		if got := registry.limits(testSymbol, tt.userID); got != tt.want {
+			t.Errorf("limits of %s = %+v, want %+v", tt.userID, got, tt.want)
+		}
+	}
+
+	if got := registry.limits("OTHER", "mm"); got != (RiskLimits{}) {
+		t.Errorf("limits on a symbol without any = %+v", got)
+	}
+}
+
+func TestCheckRisk(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits RiskLimits
+		order  *Order
+		want   pbTypes.RejectReason
+	}{
+		{"quantity", RiskLimits{MaxOrderQuantity: 10}, limitOrder("o", "u", pbTypes.Side_BUY, 99, 11), pbTypes.RejectReason_REJECT_REASON_RISK_MAX_QUANTITY},
+		{"quantity at the limit", RiskLimits{MaxOrderQuantity: 10}, limitOrder("o", "u", pbTypes.Side_BUY, 99, 10), pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED},
+		{"notional of a limit", RiskLimits{MaxNotional: 1000}, limitOrder("o", "u", pbTypes.Side_BUY, 101, 10), pbTypes.RejectReason_REJECT_REASON_RISK_MAX_NOTIONAL},
+		{"notional at the limit", RiskLimits{MaxNotional: 1000}, limitOrder("o", "u", pbTypes.Side_BUY, 100, 10), pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED},
+		// Priced at the reference, the last trade of 100
+		{"notional of a market", RiskLimits{MaxNotional: 999}, marketOrder("o", "u", pbTypes.Side_BUY, 10), pbTypes.RejectReason_REJECT_REASON_RISK_MAX_NOTIONAL},
+		{"notional of a stop market", RiskLimits{MaxNotional: 1000}, &Order{ClientOrderID: "o", UserID: "u", Side: pbTypes.Side_BUY, Type: pbTypes.OrderType_STOP_MARKET, StopPrice: 110, Quantity: 10}, pbTypes.RejectReason_REJECT_REASON_RISK_MAX_NOTIONAL},
+		// 5 away from 100 is 500 bps
+		{"price deviation", RiskLimits{MaxPriceDeviationBps: 499}, limitOrder("o", "u", pbTypes.Side_SELL, 95, 1), pbTypes.RejectReason_REJECT_REASON_RISK_PRICE_DEVIATION},
+		{"price deviation at the limit", RiskLimits{MaxPriceDeviationBps: 500}, limitOrder("o", "u", pbTypes.Side_SELL, 105, 1), pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED},
+		{"open orders", RiskLimits{MaxOpenOrders: 2}, limitOrder("o", "u", pbTypes.Side_BUY, 99, 1), pbTypes.RejectReason_REJECT_REASON_RISK_MAX_OPEN_ORDERS},
+		{"an IOC cannot rest", RiskLimits{MaxOpenOrders: 2}, &Order{ClientOrderID: "o", UserID: "u", Side: pbTypes.Side_BUY, Type: pbTypes.OrderType_LIMIT, TimeInForce: pbTypes.TimeInForce_IOC, Price: 99, Quantity: 1}, pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED},
+		{"open orders of another user", RiskLimits{MaxOpenOrders: 2}, limitOrder("o", "v", pbTypes.Side_BUY, 99, 1), pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestRiskLimits(t, symbolRiskLimits{Limits: tt.limits})
+
+			me := NewMatchingEngine(testSymbol, nil)
+			me.LastTradePrice = 100
+			for _, id := range []string{"u1", "u2"} {
+				me.indexOrder(&Order{ClientOrderID: id, UserID: "u"})
+			}
+
+			if got, message := me.checkRisk(tt.order, 0); got != tt.want {
+				t.Fatalf("checkRisk = %v (%s), want %v", got, message, tt.want)
+			}
+		})
+	}
+}
+
+func TestRiskRejectionIsAnOrderRejectedEvent(t *testing.T) {
+	setTestRiskLimits(t, symbolRiskLimits{Limits: RiskLimits{MaxOrderQuantity: 10}})
+
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("ok", "u", pbTypes.Side_BUY, 99, 10))
+	response := placeTestOrder(t, a, limitOrder("big", "u", pbTypes.Side_BUY, 99, 11))
+	if response.Order.Status != pbTypes.OrderStatus_REJECTED || response.Order.RejectReason != pbTypes.RejectReason_REJECT_REASON_RISK_MAX_QUANTITY {
+		t.Fatalf("big: %v %v", response.Order.Status, response.Order.RejectReason)
+	}
+	if a.engine.AllOrders["big"] != nil {
+		t.Fatal("the rejected order is on the book")
+	}
+	stop()
+
+	events := walEvents(t, a)
+	last := events[len(events)-1]
+	var rejected pb.OrderStatusEvent
+	if err := proto.Unmarshal(last.GetData(), &rejected); err != nil {
+		t.Fatal(err)
+	}
+	if last.GetEventType() != pbTypes.EventType_ORDER_REJECTED || rejected.GetOrderId() != "big" || rejected.GetRejectReason() != pbTypes.RejectReason_REJECT_REASON_RISK_MAX_QUANTITY {
+		t.Fatalf("last WAL event: %v %s %v", last.GetEventType(), rejected.GetOrderId(), rejected.GetRejectReason())
+	}
+
+	// Replay needs no limits
+	riskLimits.mu.Lock()
+	delete(riskLimits.symbols, testSymbol)
+	riskLimits.mu.Unlock()
+	if live, replayed := checkBook(t, a.engine), replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
+
+func TestRiskRateWindow(t *testing.T) {
+	setTestRiskLimits(t, symbolRiskLimits{Limits: RiskLimits{MaxOrdersPerSecond: 2}})
+
+	a := newTestActor(t, t.TempDir())
+	clock := newTestClock()
+	a.engine.Clock = clock
+	runTestActor(t, a)
+
+	place := func(id string) pbTypes.RejectReason {
+		return placeTestOrder(t, a, limitOrder(id, "u", pbTypes.Side_BUY, 99, 1)).Order.RejectReason
+	}
+
+	if place("o1") != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		t.Fatal("o1 rejected")
+	}
+	clock.Advance(500 * time.Millisecond)
+	if place("o2") != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		t.Fatal("o2 rejected")
+	}
+	if place("o3") != pbTypes.RejectReason_REJECT_REASON_RISK_RATE_LIMIT {
+		t.Fatal("o3 is over the rate")
+	}
+
+	// o1 leaves the window a second after it was placed; the rejected o3 never counted
+	clock.Advance(500 * time.Millisecond)
+	if place("o4") != pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED {
+		t.Fatal("o4 rejected after o1 left the window")
+	}
+	if place("o5") != pbTypes.RejectReason_REJECT_REASON_RISK_RATE_LIMIT {
+		t.Fatal("o5 is over the rate")
+	}
+
+	// Modifies are not held to the rate
+	modifyTestOrder(t, a, "o1", "u", "o1-r", int64Ptr(98), nil)
+}
+
+func TestModifyIsRiskChecked(t *testing.T) {
+	setTestRiskLimits(t, symbolRiskLimits{Limits: RiskLimits{MaxOrderQuantity: 10, MaxPriceDeviationBps: 1000, MaxOpenOrders: 2}})
+
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("b1", "u", pbTypes.Side_BUY, 100, 5))
+	placeTestOrder(t, a, limitOrder("b2", "u", pbTypes.Side_BUY, 99, 5))
+
+	tests := []struct {
+		name        string
+		newPrice    *int64
+		newQuantity *int64
+		want        pbTypes.RejectReason
+	}{
+		{"raised above the max quantity", nil, int64Ptr(11), pbTypes.RejectReason_REJECT_REASON_RISK_MAX_QUANTITY},
+		{"moved too far from the reference", int64Ptr(80), nil, pbTypes.RejectReason_REJECT_REASON_RISK_PRICE_DEVIATION},
+	}
+	for _, tt := range tests {
+		_, err := tryModifyTestOrder(t, a, "b1", "u", "b1-r", tt.newPrice, tt.newQuantity)
+		if status.Code(err) != codes.FailedPrecondition || rejectReason(err) != tt.want {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if b1 := a.engine.AllOrders["b1"]; b1 == nil || b1.Price != 100 || b1.RemainingQuantity != 5 {
+			t.Fatalf("%s: b1 changed: %+v", tt.name, b1)
+		}
+	}
+
+	// The user is at MaxOpenOrders, but the replacement takes the place of b1
+	modifyTestOrder(t, a, "b1", "u", "b1-r", int64Ptr(98), int64Ptr(10))
+	if a.engine.AllOrders["b1"] != nil || a.engine.AllOrders["b1-r"] == nil {
+		t.Fatal("b1 was not replaced")
+	}
+
+	// Reductions are never held back
+	modifyTestOrder(t, a, "b1-r", "u", "b1-s", nil, int64Ptr(1))
+
+	stop()
+
+	if live, replayed := checkBook(t, a.engine), replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
+
+func TestRiskLimitsSurviveReload(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	registerTestActor(t, a)
+
+	saved := riskLimits
+	riskLimits = &riskRegistry{symbols: map[string]symbolRiskLimits{}}
+	t.Cleanup(func() { riskLimits = saved })
+
+	path := filepath.Join(t.TempDir(), "risk_limits.json")
+	if err := LoadRiskLimits(path); err != nil {
+		t.Fatal(err)
+	}
+
+	symbol := RiskLimits{MaxOrderQuantity: 100, MaxNotional: 5000}
+	user := RiskLimits{MaxOrderQuantity: 1000}
+	if _, _, err := SetRiskLimits(testSymbol, "", symbol, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SetRiskLimits(testSymbol, "mm", user, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SetRiskLimits(testSymbol, "", RiskLimits{MaxNotional: -1}, false); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("negative limit: %v", err)
+	}
+
+	riskLimits = &riskRegistry{symbols: map[string]symbolRiskLimits{}}
+	if err := LoadRiskLimits(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := riskLimits.limits(testSymbol, "anyone"); got != symbol {
+		t.Fatalf("symbol limits after reload = %+v", got)
+	}
+	if got := riskLimits.limits(testSymbol, "mm"); got != (RiskLimits{MaxOrderQuantity: 1000, MaxNotional: 5000}) {
+		t.Fatalf("limits of mm after reload = %+v", got)
+	}
+}
@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+/*
+==================================================================
+============== Account Self-Trade Prevention Defaults ============
+==================================================================
+*/
+
+// stpDefaults holds the STP mode of accounts that set one. It is read by every
+// PlaceOrder handler concurrently, so unlike the books it sits behind a lock.
+type stpDefaults struct {
+	mu    sync.RWMutex
+	path  string
+	modes map[string]pbTypes.SelfTradePrevention
+}
+
+var accountSTP = &stpDefaults{modes: map[string]pbTypes.SelfTradePrevention{}}
+
+// LoadSelfTradePreventionDefaults reads the account defaults from path and keeps
+// path as the file later changes are written to. A missing file is a fresh start.
+func LoadSelfTradePreventionDefaults(path string) error {
+	accountSTP.mu.Lock()
+	defer accountSTP.mu.Unlock()
+
+	accountSTP.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	modes := map[string]string{}
+	if err := json.Unmarshal(data, &modes); err != nil {
+		return err
+	}
+
+	for userID, name := range modes {
+		mode, ok := pbTypes.SelfTradePrevention_value[name]
+		if !ok {
+			return fmt.Errorf("unknown self-trade prevention mode %q for user %s", name, userID)
+		}
+		accountSTP.modes[userID] = pbTypes.SelfTradePrevention(mode)
+	}
+
+	return nil
+}
+
+// SetSelfTradePrevention sets the default mode of a user; STP_UNSPECIFIED clears it.
+func SetSelfTradePrevention(userID string, mode pbTypes.SelfTradePrevention) error {
+	if userID == "" {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "user id is required")
+	}
+	if _, ok := pbTypes.SelfTradePrevention_name[int32(mode)]; !ok {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "unknown self-trade prevention mode %d", mode)
+	}
+
+	accountSTP.mu.Lock()
+	defer accountSTP.mu.Unlock()
+
+	previous, existed := accountSTP.modes[userID]
+	if mode == pbTypes.SelfTradePrevention_STP_UNSPECIFIED {
+		delete(accountSTP.modes, userID)
+	} else {
+		accountSTP.modes[userID] = mode
+	}
+
+	if err := accountSTP.save(); err != nil {
+		// Keep memory and disk in agreement
+		if existed {
+			accountSTP.modes[userID] = previous
+		} else {
+			delete(accountSTP.modes, userID)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// save writes the defaults atomically. Callers hold the lock.
+func (d *stpDefaults) save() error {
+	if d.path == "" {
+		return nil
+	}
+
+	modes := make(map[string]string, len(d.modes))
+	for userID, mode := range d.modes {
+		modes[userID] = mode.String()
+	}
+
+	data, err := json.MarshalIndent(modes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(d.path, data)
+}
+
+// resolveSelfTradePrevention picks the mode an order runs with: its own, else the
+// account default, else STP_CANCEL_NEWEST.
+func resolveSelfTradePrevention(userID string, mode pbTypes.SelfTradePrevention) pbTypes.SelfTradePrevention {
+	if mode != pbTypes.SelfTradePrevention_STP_UNSPECIFIED {
+		return mode
+	}
+
+	accountSTP.mu.RLock()
+	defer accountSTP.mu.RUnlock()
+
+	if accountMode, ok := accountSTP.modes[userID]; ok {
+		return accountMode
+	}
+
+	return pbTypes.SelfTradePrevention_STP_CANCEL_NEWEST
+}
+
+/*
+==================================================================
+================ Self-Trade Prevention in Matching ===============
+==================================================================
+*/
+
+// selfTradeAction is what STP did to one order. buildEvents reports it after the
+// trades, encoded with the order's final state.
+type selfTradeAction struct {
+	order   *Order
+	reduced bool
+
+	oldRemainingQuantity int64
+	newRemainingQuantity int64
+	oldCancelledQuantity int64
+	newCancelledQuantity int64
+}
+
+// preventSelfTrade resolves an incoming order meeting a resting order of the same user.
+// Every mode takes quantity out of at least one of them, so the matching loop always moves on.
+func (me *MatchingEngine) preventSelfTrade(incoming *Order, resting *Order) []selfTradeAction {
+	mode := incoming.SelfTradePrevention
+	decrement := min(incoming.RemainingQuantity, resting.RemainingQuantity)
+
+	actions := []selfTradeAction{}
+
+	// ---------- resting order ----------
+	switch mode {
+	case pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST, pbTypes.SelfTradePrevention_STP_CANCEL_BOTH:
+		actions = append(actions, me.cancelForSelfTrade(resting))
+
+	case pbTypes.SelfTradePrevention_STP_DECREMENT_AND_CANCEL:
+		if resting.RemainingQuantity == decrement {
+			actions = append(actions, me.cancelForSelfTrade(resting))
+		} else {
+			actions = append(actions, decrementForSelfTrade(resting, decrement))
+		}
+	}
+
+	// ---------- incoming order ----------
+	// A cancelled incoming order is reported by buildEvents with its final state
+	switch mode {
+	case pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST:
+
+	case pbTypes.SelfTradePrevention_STP_DECREMENT_AND_CANCEL:
+		if incoming.RemainingQuantity == decrement {
+			me.cancelForSelfTrade(incoming)
+		} else {
+			actions = append(actions, decrementForSelfTrade(incoming, decrement))
+		}
+
+	default: // STP_CANCEL_NEWEST, STP_CANCEL_BOTH
+		me.cancelForSelfTrade(incoming)
+	}
+
+	return actions
+}
+
+func (me *MatchingEngine) cancelForSelfTrade(order *Order) selfTradeAction {
+	// The incoming order is not in the book yet
+	if order.PriceLevel != nil {
+		me.removeFromBook(order)
+	}
+
+	order.CancelledQuantity += order.RemainingQuantity
+	order.RemainingQuantity = 0
+	order.Status = pbTypes.OrderStatus_CANCELLED
+	order.CancelReason = pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION
+	order.StatusMessage = "Cancelled by self-trade prevention"
+
+	return selfTradeAction{order: order}
+}
+
+const selfTradeReducedMessage = "Reduced by self-trade prevention"
+
+func decrementForSelfTrade(order *Order, quantity int64) selfTradeAction {
+	action := selfTradeAction{
+		order:                order,
+		reduced:              true,
+		oldRemainingQuantity: order.RemainingQuantity,
+		oldCancelledQuantity: order.CancelledQuantity,
+	}
+
+	order.CancelledQuantity += quantity
+	order.CancelReason = pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION
+	order.StatusMessage = selfTradeReducedMessage
+
+	if order.PriceLevel != nil {
+		order.PriceLevel.Reduce(order, quantity)
+	} else {
+		order.RemainingQuantity -= quantity
+	}
+
+	action.newRemainingQuantity = order.RemainingQuantity
+	action.newCancelledQuantity = order.CancelledQuantity
+
+	return action
+}
+
+func selfTradeEvent(action selfTradeAction) *pb.EngineEvent {
+	order := action.order
+
+	if !action.reduced {
+		data, _ := EncodeOrderStatusEvent(order, StrPtr(""), false)
+		return &pb.EngineEvent{
+			EventType: pbTypes.EventType_ORDER_CANCELLED,
+			UserId:    order.UserID,
+			Data:      data,
+		}
+	}
+
+	// Told as an STP reduction even when the incoming order ends up cancelled for another reason
+	data, _ := EncodeOrderReducedEvent(
+		order,
+		pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION,
+		StrPtr(selfTradeReducedMessage),
+		order.Quantity,
+		order.Quantity,
+		action.oldRemainingQuantity,
+		action.newRemainingQuantity,
+		action.newCancelledQuantity,
+		action.oldCancelledQuantity,
+	)
+	return &pb.EngineEvent{
+		EventType: pbTypes.EventType_ORDER_REDUCED,
+		UserId:    order.UserID,
+		Data:      data,
+	}
+}
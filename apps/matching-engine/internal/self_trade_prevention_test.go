@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+func selfTradeOrder(id string, userID string, side pbTypes.Side, price int64, quantity int64, mode pbTypes.SelfTradePrevention) *Order {
+	order := limitOrder(id, userID, side, price, quantity)
+	order.SelfTradePrevention = mode
+	return order
+}
+
+func TestSelfTradePreventionModes(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	// asks 400: own1(3, me) oth1(2, o); 401: own2(5, me) oth2(4, o)
+	placeTestOrder(t, a, limitOrder("own1", "me", pbTypes.Side_SELL, 400, 3))
+	placeTestOrder(t, a, limitOrder("oth1", "o", pbTypes.Side_SELL, 400, 2))
+	placeTestOrder(t, a, limitOrder("own2", "me", pbTypes.Side_SELL, 401, 5))
+	placeTestOrder(t, a, limitOrder("oth2", "o", pbTypes.Side_SELL, 401, 4))
+
+	// Cancel newest: the incoming order goes, nothing trades
+	res := placeTestOrder(t, a, selfTradeOrder("n1", "me", pbTypes.Side_BUY, 401, 4, pbTypes.SelfTradePrevention_STP_CANCEL_NEWEST))
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.CancelledQuantity != 4 || a.engine.AllOrders["own1"] == nil {
+		t.Fatalf("n1: %+v", res.Order)
+	}
+	if res.Order.CancelReason != pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION {
+		t.Fatalf("n1 cancel reason %v", res.Order.CancelReason)
+	}
+
+	// Decrement: own1 (3) goes and n2 drops to 3, 2 trade with oth1, then own2 and n2 lose 1
+	res = placeTestOrder(t, a, selfTradeOrder("n2", "me", pbTypes.Side_BUY, 401, 6, pbTypes.SelfTradePrevention_STP_DECREMENT_AND_CANCEL))
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.FilledQuantity != 2 || a.engine.AllOrders["own1"] != nil {
+		t.Fatalf("n2: %+v", res.Order)
+	}
+	own2 := a.engine.AllOrders["own2"]
+	if own2.RemainingQuantity != 4 || own2.CancelReason != pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION || own2.StatusMessage != selfTradeReducedMessage {
+		t.Fatalf("own2: remaining %d, reason %v, message %q", own2.RemainingQuantity, own2.CancelReason, own2.StatusMessage)
+	}
+
+	// Cancel oldest: own2 goes, n3 fills against oth2
+	res = placeTestOrder(t, a, selfTradeOrder("n3", "me", pbTypes.Side_BUY, 401, 3, pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST))
+	if res.Order.Status != pbTypes.OrderStatus_FILLED || a.engine.AllOrders["own2"] != nil || a.engine.AllOrders["oth2"].RemainingQuantity != 1 {
+		t.Fatalf("n3: %+v", res.Order)
+	}
+
+	// Decrement where the incoming order is larger and rests with the rest
+	placeTestOrder(t, a, limitOrder("own3", "me", pbTypes.Side_SELL, 399, 2))
+	placeTestOrder(t, a, selfTradeOrder("n4", "me", pbTypes.Side_BUY, 399, 5, pbTypes.SelfTradePrevention_STP_DECREMENT_AND_CANCEL))
+	if n4 := a.engine.AllOrders["n4"]; n4 == nil || n4.RemainingQuantity != 3 || a.engine.AllOrders["own3"] != nil {
+		t.Fatalf("n4: %+v", n4)
+	}
+	cancelTestOrder(t, a, "n4", "me")
+
+	// Cancel both
+	placeTestOrder(t, a, limitOrder("own4", "o", pbTypes.Side_BUY, 398, 2))
+	res = placeTestOrder(t, a, selfTradeOrder("n5", "o", pbTypes.Side_SELL, 398, 1, pbTypes.SelfTradePrevention_STP_CANCEL_BOTH))
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || a.engine.AllOrders["own4"] != nil {
+		t.Fatalf("n5: %+v", res.Order)
+	}
+
+	// FOK counts the user's own liquidity out unless STP removes it first
+	placeTestOrder(t, a, limitOrder("own5", "o", pbTypes.Side_BUY, 398, 1))
+	placeTestOrder(t, a, limitOrder("oth5", "x", pbTypes.Side_BUY, 397, 5))
+	fok := selfTradeOrder("n6", "o", pbTypes.Side_SELL, 1, 4, pbTypes.SelfTradePrevention_STP_CANCEL_NEWEST)
+	fok.TimeInForce = pbTypes.TimeInForce_FOK
+	if res := placeTestOrder(t, a, fok); res.Order.Status != pbTypes.OrderStatus_REJECTED {
+		t.Fatalf("n6: %+v", res.Order)
+	}
+	fok = selfTradeOrder("n7", "o", pbTypes.Side_SELL, 1, 4, pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST)
+	fok.TimeInForce = pbTypes.TimeInForce_FOK
+	if res := placeTestOrder(t, a, fok); res.Order.Status != pbTypes.OrderStatus_FILLED || a.engine.AllOrders["own5"] != nil {
+		t.Fatalf("n7: %+v", res.Order)
+	}
+
+	stop()
+
+	live := checkBook(t, a.engine)
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
+
+func TestSelfTradePreventionCancelsUnfilledMarketOrder(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("own", "me", pbTypes.Side_SELL, 100, 3))
+
+	market := marketOrder("mkt", "me", pbTypes.Side_BUY, 3)
+	market.SelfTradePrevention = pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST
+	res := placeTestOrder(t, a, market)
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.FilledQuantity != 0 || res.Order.RemainingQuantity != 0 || res.Order.CancelledQuantity != 3 {
+		t.Fatalf("mkt: %+v", res.Order)
+	}
+	if res.Order.CancelReason != pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION {
+		t.Fatalf("mkt cancel reason %v", res.Order.CancelReason)
+	}
+	if len(a.engine.AllOrders) != 0 {
+		t.Fatalf("book not empty:\n%s", bookState(a.engine))
+	}
+
+	stop()
+
+	live := checkBook(t, a.engine)
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
+
+func TestSelfTradeReducedEventCarriesReason(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("own", "me", pbTypes.Side_SELL, 100, 5))
+	placeTestOrder(t, a, selfTradeOrder("in", "me", pbTypes.Side_BUY, 100, 2, pbTypes.SelfTradePrevention_STP_DECREMENT_AND_CANCEL))
+	stop()
+
+	var reduced *pb.OrderReducedEvent
+	for _, event := range walEvents(t, a) {
+		if event.GetEventType() != pbTypes.EventType_ORDER_REDUCED {
+			continue
+		}
+		reduced = &pb.OrderReducedEvent{}
+		if err := proto.Unmarshal(event.GetData(), reduced); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if reduced == nil {
+		t.Fatal("no ORDER_REDUCED event in the WAL")
+	}
+	if reduced.GetOrder().GetOrderId() != "own" || reduced.GetOldRemainingQuantity() != 5 || reduced.GetNewRemainingQuantity() != 3 {
+		t.Fatalf("reduced event: %+v", reduced)
+	}
+	if reduced.GetOrder().GetCancelReason() != pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION || reduced.GetOrder().GetStatusMessage() != selfTradeReducedMessage {
+		t.Fatalf("reduced event reason %v, message %q", reduced.GetOrder().GetCancelReason(), reduced.GetOrder().GetStatusMessage())
+	}
+
+	b := newTestActor(t, dir)
+	defer b.wal.Close()
+	if err := b.replayWal(0); err != nil {
+		t.Fatal(err)
+	}
+	if own := b.engine.AllOrders["own"]; own == nil || own.CancelReason != pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION {
+		t.Fatalf("replayed own: %+v", own)
+	}
+}
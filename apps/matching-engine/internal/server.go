@@ -3,9 +3,11 @@ package internal
 import (
 	"context"
 	"log/slog"
+	"strconv"
 	"time"
 
 	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -14,23 +16,11 @@ type Server struct {
 }
 
 func (s *Server) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
-	order := &Order{
-		Symbol:            req.Symbol,
-		Price:             req.Price,
-		Quantity:          req.Quantity,
-		RemainingQuantity: req.Quantity,
-		Side:              req.Side,
-		Type:              req.Type,
-		ClientOrderID:     req.ClientOrderId,
-		UserID:            req.UserId,
-		GatewayTimestamp:  req.GatewayTimestamp,
-		ClientTimestamp:   req.ClientTimestamp,
-		EngineTimestamp:   timestamppb.New(time.Now()),
-	}
+	order := orderFromRequest(req)
 
 	slog.Info("Request to place a order", "order", order)
 
-	res, err := PlaceOrder(order)
+	res, err := PlaceOrder(ctx, order)
 
 	if err != nil {
 		slog.Error("Failed to process order",
@@ -40,30 +30,63 @@ func (s *Server) PlaceOrder(ctx context.Context, req *pb.PlaceOrderRequest) (*pb
 		return nil, err
 	}
 
+	return placeOrderResponse(res), nil
+}
+
+func orderFromRequest(req *pb.PlaceOrderRequest) *Order {
+	return &Order{
+		Symbol:              req.Symbol,
+		Price:               req.Price,
+		StopPrice:           req.StopPrice,
+		TimeInForce:         req.TimeInForce,
+		SelfTradePrevention: resolveSelfTradePrevention(req.UserId, req.SelfTradePrevention),
+		DisplayQuantity:     req.DisplayQuantity,
+		Hidden:              req.Hidden,
+		Quantity:            req.Quantity,
+		RemainingQuantity:   req.Quantity,
+		Side:                req.Side,
+		Type:                req.Type,
+		ClientOrderID:       req.ClientOrderId,
+		UserID:              req.UserId,
+		GatewayTimestamp:    req.GatewayTimestamp,
+		ClientTimestamp:     req.ClientTimestamp,
+	}
+}
+
+func placeOrderResponse(res *AddOrderInternalResponse) *pb.PlaceOrderResponse {
 	return &pb.PlaceOrderResponse{
-		ClientOrderId:     res.Order.ClientOrderID,
-		Symbol:            res.Order.Symbol,
-		Status:            res.Order.Status,
-		Price:             res.Order.Price,
-		AveragePrice:      res.Order.AveragePrice,
-		Quantity:          res.Order.Quantity,
-		RemainingQuantity: res.Order.RemainingQuantity,
-		FilledQuantity:    res.Order.FilledQuantity,
-		CancelledQuantity: res.Order.CancelledQuantity,
-		ExecutedValue:     res.Order.ExecutedValue,
-		Side:              res.Order.Side,
-		Type:              res.Order.Type,
-		UserId:            res.Order.UserID,
-
-		AuctionNumber:    "0",
+		ClientOrderId:       res.Order.ClientOrderID,
+		Symbol:              res.Order.Symbol,
+		Status:              res.Order.Status,
+		Price:               res.Order.Price,
+		StopPrice:           res.Order.StopPrice,
+		TimeInForce:         res.Order.TimeInForce,
+		SelfTradePrevention: res.Order.SelfTradePrevention,
+		CancelReason:        res.Order.CancelReason,
+		RejectReason:        res.Order.RejectReason,
+		DisplayQuantity:     res.Order.DisplayQuantity,
+		Hidden:              res.Order.Hidden,
+		VisibleQuantity:     res.Order.VisibleQuantity,
+		Duplicate:           res.Duplicate,
+		AveragePrice:        res.Order.AveragePrice,
+		Quantity:            res.Order.Quantity,
+		RemainingQuantity:   res.Order.RemainingQuantity,
+		FilledQuantity:      res.Order.FilledQuantity,
+		CancelledQuantity:   res.Order.CancelledQuantity,
+		ExecutedValue:       res.Order.ExecutedValue,
+		Side:                res.Order.Side,
+		Type:                res.Order.Type,
+		UserId:              res.Order.UserID,
+
+		AuctionNumber:    strconv.FormatUint(res.AuctionNumber, 10),
 		ClientTimestamp:  res.Order.ClientTimestamp,
 		GatewayTimestamp: res.Order.GatewayTimestamp,
-	}, nil
+	}
 }
 
 func (s *Server) CancelOrder(ctx context.Context, req *pb.CancelOrderRequest) (*pb.CancelOrderResponse, error) {
 	slog.Info("Request for cancel a order", "orderId", req.Id, "symbol", req.Symbol)
-	res, err := CancelOrder(req.Id, req.UserId, req.Symbol)
+	res, err := CancelOrder(ctx, req.Id, req.UserId, req.Symbol)
 
 	if err != nil {
 		slog.Error("Failed to cancel order", "orderId", req.Id, "symbol", req.Symbol, "error", err)
@@ -87,7 +110,7 @@ func (s *Server) ModifyOrder(ctx context.Context, req *pb.ModifyOrderRequest) (*
 		"NewQuantity", req.NewQuantity,
 	)
 
-	res, err := ModifyOrder(req.Symbol, req.OrderId, req.UserId, req.ClientModifyId, req.NewPrice, req.NewQuantity)
+	res, err := ModifyOrder(ctx, req.Symbol, req.OrderId, req.UserId, req.ClientModifyId, req.NewPrice, req.NewQuantity)
 
 	if err != nil {
 		slog.Error("Failed to modify order",
@@ -111,3 +134,164 @@ func (s *Server) ModifyOrder(ctx context.Context, req *pb.ModifyOrderRequest) (*
 	}, nil
 }
 
+func (s *Server) PlaceOrders(ctx context.Context, req *pb.PlaceOrdersRequest) (*pb.PlaceOrdersResponse, error) {
+	slog.Info("Request to place a batch of orders", "symbol", req.Symbol, "orders", len(req.Orders), "allOrNothing", req.AllOrNothing)
+
+	orders := make([]*Order, 0, len(req.Orders))
+	for _, orderReq := range req.Orders {
+		order := orderFromRequest(orderReq)
+		if order.Symbol == "" {
+			order.Symbol = req.Symbol
+		}
+		orders = append(orders, order)
+	}
+
+	results, err := PlaceOrders(ctx, req.Symbol, orders, req.AllOrNothing)
+	if err != nil {
+		slog.Error("Failed to process the batch of orders", "symbol", req.Symbol, "error", err)
+		return nil, err
+	}
+
+	response := &pb.PlaceOrdersResponse{}
+	for _, result := range results {
+		if result.Err != nil {
+			response.Results = append(response.Results, &pb.PlaceOrderResult{Error: result.Err.Error(), RejectReason: rejectReason(result.Err)})
+			continue
+		}
+		response.Results = append(response.Results, &pb.PlaceOrderResult{Order: placeOrderResponse(result.Response)})
+	}
+
+	return response, nil
+}
+
+func (s *Server) CancelReplaceOrders(ctx context.Context, req *pb.CancelReplaceOrdersRequest) (*pb.CancelReplaceOrdersResponse, error) {
+	slog.Info("Request to modify a batch of orders", "symbol", req.Symbol, "orders", len(req.Orders), "allOrNothing", req.AllOrNothing)
+
+	modifies := make([]ModifyRequest, 0, len(req.Orders))
+	for _, modifyReq := range req.Orders {
+		modifies = append(modifies, ModifyRequest{
+			OrderID:        modifyReq.OrderId,
+			UserID:         modifyReq.UserId,
+			ClientModifyID: modifyReq.ClientModifyId,
+			NewPrice:       modifyReq.NewPrice,
+			NewQuantity:    modifyReq.NewQuantity,
+		})
+	}
+
+	results, err := CancelReplaceOrders(ctx, req.Symbol, modifies, req.AllOrNothing)
+	if err != nil {
+		slog.Error("Failed to process the batch of modifies", "symbol", req.Symbol, "error", err)
+		return nil, err
+	}
+
+	response := &pb.CancelReplaceOrdersResponse{}
+	for _, result := range results {
+		if result.Err != nil {
+			response.Results = append(response.Results, &pb.ModifyOrderResult{Error: result.Err.Error(), RejectReason: rejectReason(result.Err)})
+			continue
+		}
+		response.Results = append(response.Results, &pb.ModifyOrderResult{Order: &pb.ModifyOrderResponse{
+			OrderId:       result.Response.OrderID,
+			OldOrderId:    result.Response.OldOrderId,
+			NewOrderId:    result.Response.NewOrderId,
+			Status:        result.Response.Status,
+			StatusMessage: result.Response.StatusMessage,
+		}})
+	}
+
+	return response, nil
+}
+
+func (s *Server) MassCancel(ctx context.Context, req *pb.MassCancelRequest) (*pb.MassCancelResponse, error) {
+	slog.Info("Request to mass cancel", "userId", req.UserId, "symbol", req.Symbol, "side", req.Side)
+
+	res, err := MassCancel(ctx, req.UserId, req.Symbol, req.Side)
+	if err != nil {
+		slog.Error("Failed to mass cancel", "userId", req.UserId, "symbol", req.Symbol, "side", req.Side, "error", err)
+		return nil, err
+	}
+
+	if len(res.Failures) > 0 {
+		slog.Warn("Mass cancel failed for some symbols", "userId", req.UserId, "failures", res.Failures)
+	}
+
+	return res, nil
+}
+
+func (s *Server) SetCancelAllAfter(ctx context.Context, req *pb.SetCancelAllAfterRequest) (*pb.SetCancelAllAfterResponse, error) {
+	deadline, err := SetCancelAllAfter(req.UserId, time.Duration(req.TimeoutMs)*time.Millisecond)
+	if err != nil {
+		slog.Error("Failed to set cancel-all-after", "userId", req.UserId, "timeoutMs", req.TimeoutMs, "error", err)
+		return nil, err
+	}
+
+	res := &pb.SetCancelAllAfterResponse{UserId: req.UserId}
+	if !deadline.IsZero() {
+		res.Deadline = timestamppb.New(deadline)
+	}
+	return res, nil
+}
+
+func (s *Server) SetSelfTradePrevention(ctx context.Context, req *pb.SetSelfTradePreventionRequest) (*pb.SetSelfTradePreventionResponse, error) {
+	slog.Info("Request to set self-trade prevention", "userId", req.UserId, "mode", req.Mode)
+
+	if err := SetSelfTradePrevention(req.UserId, req.Mode); err != nil {
+		slog.Error("Failed to set self-trade prevention", "userId", req.UserId, "mode", req.Mode, "error", err)
+		return nil, err
+	}
+
+	return &pb.SetSelfTradePreventionResponse{
+		UserId: req.UserId,
+		Mode:   req.Mode,
+	}, nil
+}
+
+func (s *Server) GetInstruments(ctx context.Context, req *pb.GetInstrumentsRequest) (*pb.GetInstrumentsResponse, error) {
+	instruments, err := GetInstruments(req.Symbols)
+	if err != nil {
+		slog.Error("Failed to get instruments", "symbols", req.Symbols, "error", err)
+		return nil, err
+	}
+
+	return &pb.GetInstrumentsResponse{Instruments: instruments}, nil
+}
+
+func (s *Server) SubscribeSymbol(req *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.EngineEvent]) error {
+	slog.Info("Request to subscribe to a symbol", "symbol", req.Symbol, "gatewayId", req.GatewayId)
+
+	err := SubscribeSymbol(stream.Context(), req.Symbol, req.GatewayId, stream.Send)
+	if err != nil {
+		slog.Warn("Symbol subscription ended", "symbol", req.Symbol, "gatewayId", req.GatewayId, "error", err)
+	}
+	return err
+}
+
+func (s *Server) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.GetOrderResponse, error) {
+	res, err := GetOrder(ctx, req.Symbol, req.OrderId, req.UserId)
+	if err != nil {
+		slog.Error("Failed to get order", "orderId", req.OrderId, "symbol", req.Symbol, "userId", req.UserId, "error", err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *Server) ListOpenOrders(ctx context.Context, req *pb.ListOpenOrdersRequest) (*pb.ListOpenOrdersResponse, error) {
+	res, err := ListOpenOrders(ctx, req.Symbol, req.UserId)
+	if err != nil {
+		slog.Error("Failed to list open orders", "symbol", req.Symbol, "userId", req.UserId, "error", err)
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *Server) GetOrderBook(ctx context.Context, req *pb.GetOrderBookRequest) (*pb.GetOrderBookResponse, error) {
+	res, err := GetOrderBook(ctx, req.Symbol, int(req.Depth), req.Orders)
+	if err != nil {
+		slog.Error("Failed to get order book", "symbol", req.Symbol, "depth", req.Depth, "error", err)
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,418 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Older snapshots are kept as a fallback in case the latest one is corrupted,
+// so WAL segments are only released once every retained snapshot covers them.
+const snapshotsToRetain = 2
+
+/*
+==================================================================
+================ Order Book Snapshot Management ==================
+==================================================================
+*/
+type SnapshotStore struct {
+	dirPath string
+	symbol  string
+}
+
+func OpenSnapshotStore(dir string, symbol string) (*SnapshotStore, error) {
+	dirPath := filepath.Join(dir, symbol, "snapshots")
+
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, err
+	}
+
+	return &SnapshotStore{dirPath: dirPath, symbol: symbol}, nil
+}
+
+func (ss *SnapshotStore) path(walSequence uint64) string {
+	return filepath.Join(ss.dirPath, fmt.Sprintf("%d.snap", walSequence))
+}
+
+// Write persists a snapshot atomically.
+// Snapshot File Format: [4-byte CRC32][protobuf EngineSnapshot]
+func (ss *SnapshotStore) Write(snapshot *pb.EngineSnapshot) error {
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	var crcBytes [4]byte
+	binary.LittleEndian.PutUint32(crcBytes[:], crc32.ChecksumIEEE(data))
+
+	finalPath := ss.path(snapshot.GetWalSequence())
+	tmpPath := finalPath + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(crcBytes[:]); err != nil {
+		file.Close()
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return err
+	}
+
+	return syncDir(ss.dirPath)
+}
+
+func (ss *SnapshotStore) read(walSequence uint64) (*pb.EngineSnapshot, error) {
+	data, err := os.ReadFile(ss.path(walSequence))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("snapshot %d is truncated", walSequence)
+	}
+
+	expectedChecksum := binary.LittleEndian.Uint32(data[:4])
+	if crc32.ChecksumIEEE(data[4:]) != expectedChecksum {
+		return nil, fmt.Errorf("snapshot %d CRC mismatch: data may be corrupted", walSequence)
+	}
+
+	snapshot := &pb.EngineSnapshot{}
+	if err := proto.Unmarshal(data[4:], snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.GetSymbol() != ss.symbol || snapshot.GetWalSequence() != walSequence {
+		return nil, fmt.Errorf("snapshot %d does not belong to %s", walSequence, ss.symbol)
+	}
+
+	return snapshot, nil
+}
+
+// list returns the WAL sequences of all snapshots on disk in ascending order.
+func (ss *SnapshotStore) list() ([]uint64, error) {
+	entries, err := os.ReadDir(ss.dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sequences := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		seqStr, exists := strings.CutSuffix(entry.Name(), ".snap")
+		if !exists {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		sequences = append(sequences, seq)
+	}
+
+	sort.Slice(sequences, func(i, j int) bool {
+		return sequences[i] < sequences[j]
+	})
+
+	return sequences, nil
+}
+
+// LoadLatest returns the newest snapshot that passes validation, or nil if there is none.
+func (ss *SnapshotStore) LoadLatest() (*pb.EngineSnapshot, error) {
+	sequences, err := ss.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(sequences) - 1; i >= 0; i-- {
+		snapshot, err := ss.read(sequences[i])
+		if err != nil {
+			slog.Warn("skipping invalid snapshot", "symbol", ss.symbol, "walSequence", sequences[i], "err", err)
+			continue
+		}
+		return snapshot, nil
+	}
+
+	return nil, nil
+}
+
+// Prune deletes all but the newest `retain` snapshots and returns the WAL
+// sequence of the oldest snapshot still on disk.
+func (ss *SnapshotStore) Prune(retain int) (uint64, error) {
+	sequences, err := ss.list()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(sequences) == 0 {
+		return 0, nil
+	}
+
+	if len(sequences) > retain {
+		for _, seq := range sequences[:len(sequences)-retain] {
+			if err := os.Remove(ss.path(seq)); err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		sequences = sequences[len(sequences)-retain:]
+	}
+
+	return sequences[0], nil
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// writeFileAtomic replaces path with data the way Write does: a crash leaves the old file or
+// the new one, never a torn file or a rename that did not reach the disk.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+/*
+==================================================================
+================= Actor Snapshot & WAL Truncation ================
+==================================================================
+*/
+
+// loadSnapshot restores the engine from the latest valid snapshot and returns
+// the first WAL sequence that still has to be replayed on top of it.
+func (a *SymbolActor) loadSnapshot() (uint64, error) {
+	snapshot, err := a.snapshots.LoadLatest()
+	if err != nil {
+		return 0, err
+	}
+
+	if snapshot == nil {
+		return 0, nil
+	}
+
+	a.engine.RestoreSnapshot(snapshot)
+	a.wal.advanceTo(snapshot.GetWalSequence() + 1)
+	a.lastSnapshotSequence = snapshot.GetWalSequence()
+
+	slog.Info(fmt.Sprintf("Loaded the %s snapshot at WAL sequence %d with %d orders", a.symbol, snapshot.GetWalSequence(), len(a.engine.AllOrders)))
+
+	return snapshot.GetWalSequence() + 1, nil
+}
+
+func (a *SymbolActor) snapshotWorker() {
+	if a.snapshotIntervalMM <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Millisecond * time.Duration(a.snapshotIntervalMM))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.quit:
+			return
+
+		case <-ticker.C:
+			if err := a.takeSnapshot(); err != nil {
+				slog.Error("snapshot failed", "symbol", a.symbol, "err", err)
+			}
+		}
+	}
+}
+
+func (a *SymbolActor) takeSnapshot() error {
+	// The snapshot is built inside the actor loop so it sees the book between two messages.
+	replay := make(chan *pb.EngineSnapshot, 1)
+	if err := a.send(context.Background(), SnapshotMsg{replay: replay}); err != nil {
+		return err
+	}
+
+	return a.persistSnapshot(<-replay)
+}
+
+// persistSnapshot writes a snapshot, prunes old ones and releases the WAL segments they cover.
+func (a *SymbolActor) persistSnapshot(snapshot *pb.EngineSnapshot) error {
+	// Nothing was written since the last snapshot
+	if snapshot.GetWalSequence() <= a.lastSnapshotSequence {
+		return nil
+	}
+
+	if err := a.snapshots.Write(snapshot); err != nil {
+		return err
+	}
+	a.lastSnapshotSequence = snapshot.GetWalSequence()
+
+	oldestSnapshot, err := a.snapshots.Prune(snapshotsToRetain)
+	if err != nil {
+		return err
+	}
+
+	// A segment can go only when it is covered by every retained snapshot and already in Kafka.
+	deleted, err := a.wal.DeleteSegmentsUpTo(min(oldestSnapshot, a.kafkaEmitter.CommittedOffset()))
+	if err != nil {
+		return err
+	}
+
+	slog.Info("snapshot written",
+		"symbol", a.symbol,
+		"walSequence", snapshot.GetWalSequence(),
+		"orders", len(snapshot.GetBids())+len(snapshot.GetAsks()),
+		"deletedSegments", deleted,
+	)
+
+	return nil
+}
+
+/*
+==================================================================
+================ Matching Engine Snapshot / Restore ==============
+==================================================================
+*/
+func (me *MatchingEngine) Snapshot(walSequence uint64) *pb.EngineSnapshot {
+	breakerReference, breakerWindow := me.breaker.snapshot()
+	tickerBuckets, tickerReference := me.stats.snapshot()
+
+	return &pb.EngineSnapshot{
+		Symbol:        me.Symbol,
+		WalSequence:   walSequence,
+		TradeSequence: me.TradeSequence,
+		OrderSequence: me.OrderSequence,
+		TotalMatches:  me.TotalMatches,
+		TotalVolume:   me.TotalVolume,
+		Bids:          snapshotBookSide(me.Bids),
+		Asks:          snapshotBookSide(me.Asks),
+		CreatedAt:     timestamppb.Now(),
+
+		BuyStops:       snapshotBookSide(me.Stops.BuyStops),
+		SellStops:      snapshotBookSide(me.Stops.SellStops),
+		LastTradePrice: me.LastTradePrice,
+
+		IdempotencyWindow: me.Idempotency.Snapshot(),
+
+		TradingState:            me.TradingState,
+		CircuitBreakerReference: breakerReference,
+		CircuitBreakerWindow:    breakerWindow,
+		AuctionNumber:           me.AuctionNumber,
+		TickerBuckets:           tickerBuckets,
+		TickerReferencePrice:    tickerReference,
+		BookSequence:            me.BookSequence,
+	}
+}
+
+// snapshotBookSide walks the side from the best price and each level head to tail,
+// so restoring the orders in the same sequence keeps price-time priority.
+func snapshotBookSide(obs *OrderBookSide) []*pb.OrderStatusEvent {
+	orders := []*pb.OrderStatusEvent{}
+
+	for level := obs.BestPriceLevel; level != nil; level = level.NextPrice {
+		for order := level.HeadOrder; order != nil; order = order.Next {
+			orders = append(orders, NewOrderStatusEvent(order))
+		}
+	}
+
+	return orders
+}
+
+func (me *MatchingEngine) RestoreSnapshot(snapshot *pb.EngineSnapshot) {
+	me.Bids = newDepthSide(pbTypes.Side_BUY)
+	me.Asks = newDepthSide(pbTypes.Side_SELL)
+	me.AllOrders = make(map[string]*Order)
+	me.Stops = NewTriggerBook()
+	me.UserOrders = make(map[string]map[string]*Order)
+	me.Idempotency = NewIdempotencyWindow(me.Idempotency.capacity)
+	me.Idempotency.Restore(snapshot.GetIdempotencyWindow())
+
+	me.TradeSequence = snapshot.GetTradeSequence()
+	me.OrderSequence = snapshot.GetOrderSequence()
+	me.TotalMatches = snapshot.GetTotalMatches()
+	me.TotalVolume = snapshot.GetTotalVolume()
+	me.LastTradePrice = snapshot.GetLastTradePrice()
+	me.TradingState = snapshot.GetTradingState()
+	me.AuctionNumber = snapshot.GetAuctionNumber()
+	me.BookSequence = snapshot.GetBookSequence()
+	me.breaker.restore(snapshot.GetCircuitBreakerReference(), snapshot.GetCircuitBreakerWindow())
+	me.stats.restore(snapshot.GetTickerBuckets(), snapshot.GetTickerReferencePrice())
+
+	me.restoreBookSide(me.Bids, snapshot.GetBids())
+	me.restoreBookSide(me.Asks, snapshot.GetAsks())
+
+	for _, event := range append(snapshot.GetBuyStops(), snapshot.GetSellStops()...) {
+		order := OrderFromStatusEvent(event)
+		me.Stops.Add(order)
+		me.indexOrder(order)
+	}
+}
+
+func (me *MatchingEngine) restoreBookSide(obs *OrderBookSide, orders []*pb.OrderStatusEvent) {
+	for _, event := range orders {
+		order := OrderFromStatusEvent(event)
+
+		level := obs.GetOrCreatePriceLevel(order.Price)
+		level.Push(order)
+		me.AllOrders[order.ClientOrderID] = order
+		me.indexOrder(order)
+	}
+}
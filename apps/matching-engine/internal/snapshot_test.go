@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+// tradingScenario runs limit, market, modify and cancel traffic, stops, every time in force,
+// icebergs, hidden orders and retried ids against a running actor.
+func tradingScenario(t *testing.T, a *SymbolActor) {
+	t.Helper()
+
+	placeTestOrder(t, a, limitOrder("s1", "u1", pbTypes.Side_SELL, 101, 5))
+	placeTestOrder(t, a, limitOrder("s2", "u2", pbTypes.Side_SELL, 102, 7))
+	placeTestOrder(t, a, limitOrder("s3", "u3", pbTypes.Side_SELL, 101, 3))
+	placeTestOrder(t, a, limitOrder("b1", "u4", pbTypes.Side_BUY, 99, 10))
+	placeTestOrder(t, a, limitOrder("b2", "u5", pbTypes.Side_BUY, 101, 6))
+	placeTestOrder(t, a, marketOrder("m1", "u6", pbTypes.Side_BUY, 4))
+	modifyTestOrder(t, a, "b1", "u4", "b1m", int64Ptr(98), nil)
+	modifyTestOrder(t, a, "s2", "u2", "s2m", nil, int64Ptr(3))
+	placeTestOrder(t, a, limitOrder("b3", "u7", pbTypes.Side_BUY, 97, 2))
+	cancelTestOrder(t, a, "b3", "u7")
+	placeTestOrder(t, a, limitOrder("s4", "u8", pbTypes.Side_SELL, 98, 4))
+	placeTestOrder(t, a, marketOrder("m2", "u9", pbTypes.Side_SELL, 100))
+
+	// Stops: a trade at 110 triggers st1, whose fills at 112 trigger st2.
+	placeTestOrder(t, a, limitOrder("a1", "mm", pbTypes.Side_SELL, 110, 5))
+	placeTestOrder(t, a, limitOrder("a2", "mm", pbTypes.Side_SELL, 112, 5))
+	placeTestOrder(t, a, limitOrder("a3", "mm", pbTypes.Side_SELL, 115, 5))
+	placeTestOrder(t, a, limitOrder("bb1", "mm", pbTypes.Side_BUY, 90, 5))
+	placeTestOrder(t, a, &Order{ClientOrderID: "st1", UserID: "s", Side: pbTypes.Side_BUY, Type: pbTypes.OrderType_STOP_MARKET, StopPrice: 110, Quantity: 4})
+	placeTestOrder(t, a, &Order{ClientOrderID: "st2", UserID: "s", Side: pbTypes.Side_BUY, Type: pbTypes.OrderType_STOP_LIMIT, StopPrice: 112, Price: 113, Quantity: 4})
+	placeTestOrder(t, a, &Order{ClientOrderID: "st3", UserID: "s", Side: pbTypes.Side_BUY, Type: pbTypes.OrderType_STOP_LIMIT, StopPrice: 200, Price: 201, Quantity: 1})
+	placeTestOrder(t, a, &Order{ClientOrderID: "st4", UserID: "s", Side: pbTypes.Side_SELL, Type: pbTypes.OrderType_STOP_MARKET, StopPrice: 50, Quantity: 1})
+	cancelTestOrder(t, a, "st4", "s")
+	placeTestOrder(t, a, limitOrder("tk", "t", pbTypes.Side_BUY, 110, 3))
+	if _, ok := a.engine.Stops.Orders["st2"]; ok {
+		t.Fatal("st2 should have triggered")
+	}
+	if _, ok := a.engine.Stops.Orders["st3"]; !ok {
+		t.Fatal("st3 should still be pending")
+	}
+
+	// Time in force against a fresh book.
+	placeTestOrder(t, a, marketOrder("sweep", "sw", pbTypes.Side_BUY, 1000))
+	placeTestOrder(t, a, limitOrder("ta1", "mm", pbTypes.Side_SELL, 300, 5))
+	placeTestOrder(t, a, limitOrder("ta2", "mm", pbTypes.Side_SELL, 301, 5))
+	placeTestOrder(t, a, limitOrder("tb1", "mm", pbTypes.Side_BUY, 295, 5))
+
+	ioc := limitOrder("ioc1", "x", pbTypes.Side_BUY, 300, 8)
+	ioc.TimeInForce = pbTypes.TimeInForce_IOC
+	if res := placeTestOrder(t, a, ioc); res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.FilledQuantity != 5 || res.Order.CancelledQuantity != 3 {
+		t.Fatalf("ioc1: %+v", res.Order)
+	}
+	fok := limitOrder("fok1", "x", pbTypes.Side_BUY, 301, 6)
+	fok.TimeInForce = pbTypes.TimeInForce_FOK
+	if res := placeTestOrder(t, a, fok); res.Order.Status != pbTypes.OrderStatus_REJECTED {
+		t.Fatalf("fok1: %+v", res.Order)
+	}
+	fok = limitOrder("fok2", "x", pbTypes.Side_BUY, 301, 4)
+	fok.TimeInForce = pbTypes.TimeInForce_FOK
+	if res := placeTestOrder(t, a, fok); res.Order.Status != pbTypes.OrderStatus_FILLED {
+		t.Fatalf("fok2: %+v", res.Order)
+	}
+	postOnly := limitOrder("po1", "x", pbTypes.Side_BUY, 301, 1)
+	postOnly.TimeInForce = pbTypes.TimeInForce_POST_ONLY
+	if res := placeTestOrder(t, a, postOnly); res.Order.Status != pbTypes.OrderStatus_REJECTED {
+		t.Fatalf("po1: %+v", res.Order)
+	}
+	postOnly = limitOrder("po2", "x", pbTypes.Side_BUY, 305, 1)
+	postOnly.TimeInForce = pbTypes.TimeInForce_POST_ONLY_SLIDE
+	if res := placeTestOrder(t, a, postOnly); res.Order.Price != 300 || a.engine.AllOrders["po2"] == nil {
+		t.Fatalf("po2: %+v", res.Order)
+	}
+
+	// Icebergs and hidden orders.
+	placeTestOrder(t, a, marketOrder("sweep2", "sw", pbTypes.Side_BUY, 1000))
+	placeTestOrder(t, a, marketOrder("sweep3", "sw", pbTypes.Side_SELL, 1000))
+	iceberg := limitOrder("ice1", "i", pbTypes.Side_SELL, 500, 10)
+	iceberg.DisplayQuantity = 3
+	placeTestOrder(t, a, iceberg)
+	placeTestOrder(t, a, limitOrder("pl1", "p", pbTypes.Side_SELL, 500, 2))
+	hidden := limitOrder("hid1", "h", pbTypes.Side_SELL, 499, 4)
+	hidden.Hidden = true
+	placeTestOrder(t, a, hidden)
+	if level := a.engine.Asks.PriceLevels[500]; level.DisplayedVolume != 5 || level.TotalVolume != 12 {
+		t.Fatalf("level 500: displayed %d, total %d", level.DisplayedVolume, level.TotalVolume)
+	}
+	if res := placeTestOrder(t, a, limitOrder("tk1", "t", pbTypes.Side_BUY, 500, 10)); res.Order.Status != pbTypes.OrderStatus_FILLED || a.engine.AllOrders["pl1"] != nil {
+		t.Fatalf("tk1: %+v", res.Order)
+	}
+	if ice := a.engine.AllOrders["ice1"]; ice.RemainingQuantity != 6 || ice.VisibleQuantity != 2 {
+		t.Fatalf("ice1: remaining %d, visible %d", ice.RemainingQuantity, ice.VisibleQuantity)
+	}
+	iceberg = limitOrder("ice2", "j", pbTypes.Side_BUY, 500, 12)
+	iceberg.DisplayQuantity = 4
+	placeTestOrder(t, a, iceberg)
+	modifyTestOrder(t, a, "ice2", "j", "", nil, int64Ptr(9))
+	if ice := a.engine.AllOrders["ice2"]; ice.RemainingQuantity != 3 || ice.VisibleQuantity != 3 {
+		t.Fatalf("ice2: remaining %d, visible %d", ice.RemainingQuantity, ice.VisibleQuantity)
+	}
+
+	// Retried ids answer from the idempotency window without executing again.
+	if res := placeTestOrder(t, a, limitOrder("ioc1", "x", pbTypes.Side_BUY, 9999, 8)); !res.Duplicate || res.Order.FilledQuantity != 5 {
+		t.Fatalf("ioc1 retry: %+v", res.Order)
+	}
+	placeTestOrder(t, a, limitOrder("md1", "m", pbTypes.Side_BUY, 10, 8))
+	modifyTestOrder(t, a, "md1", "m", "mod-a", nil, int64Ptr(5))
+	modifyTestOrder(t, a, "md1", "m", "mod-a", nil, int64Ptr(2))
+	if remaining := a.engine.AllOrders["md1"].RemainingQuantity; remaining != 5 {
+		t.Fatalf("md1 retried modify executed again: remaining %d", remaining)
+	}
+	modifyTestOrder(t, a, "md1", "m", "md2", int64Ptr(11), nil)
+	if a.engine.AllOrders["md2"] == nil || a.engine.AllOrders["md1"] != nil {
+		t.Fatal("md1 was not replaced by md2")
+	}
+}
+
+func takeTestSnapshot(t *testing.T, a *SymbolActor) *pb.EngineSnapshot {
+	t.Helper()
+
+	replay := make(chan *pb.EngineSnapshot, 1)
+	if err := a.send(context.Background(), SnapshotMsg{replay: replay}); err != nil {
+		t.Fatal(err)
+	}
+	return <-replay
+}
+
+func TestReplayAndSnapshotRebuildTheBook(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	tradingScenario(t, a)
+	snapshot := takeTestSnapshot(t, a)
+	stop()
+
+	live := checkBook(t, a.engine)
+
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+
+	restored := NewMatchingEngine(testSymbol, nil)
+	restored.RestoreSnapshot(snapshot)
+	if got := checkBook(t, restored); got != live {
+		t.Fatalf("restored book differs:\n%s\nlive:\n%s", got, live)
+	}
+	if snapshot.GetWalSequence() != a.wal.LastSequenceNumber() {
+		t.Fatalf("snapshot at sequence %d, WAL at %d", snapshot.GetWalSequence(), a.wal.LastSequenceNumber())
+	}
+}
+
+func TestRecoveryFromSnapshotAndWalTail(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	tradingScenario(t, a)
+	snapshot := takeTestSnapshot(t, a)
+	if err := a.snapshots.Write(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tail after the snapshot, then the segments the snapshot covers go away.
+	placeTestOrder(t, a, limitOrder("x1", "u1", pbTypes.Side_BUY, 100, 5))
+	placeTestOrder(t, a, limitOrder("x2", "u2", pbTypes.Side_SELL, 100, 2))
+	stop()
+
+	deleted, err := a.wal.DeleteSegmentsUpTo(snapshot.GetWalSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 {
+		t.Fatal("no WAL segment was released by the snapshot")
+	}
+	live := checkBook(t, a.engine)
+
+	b := newTestActor(t, dir)
+	defer b.wal.Close()
+
+	from, err := b.loadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != snapshot.GetWalSequence()+1 {
+		t.Fatalf("replay starts at %d, want %d", from, snapshot.GetWalSequence()+1)
+	}
+	if err := b.replayWal(from); err != nil {
+		t.Fatal(err)
+	}
+	if got := checkBook(t, b.engine); got != live {
+		t.Fatalf("recovered book differs:\n%s\nlive:\n%s", got, live)
+	}
+	if b.wal.LastSequenceNumber() != a.wal.LastSequenceNumber() {
+		t.Fatalf("recovered WAL at %d, live at %d", b.wal.LastSequenceNumber(), a.wal.LastSequenceNumber())
+	}
+}
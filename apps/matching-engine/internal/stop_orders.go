@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"fmt"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+/*
+==================================================================
+================ Stop Order Trigger Book Management ==============
+==================================================================
+*/
+
+// TriggerBook holds untriggered stop orders off the visible book. Both sides reuse
+// OrderBookSide keyed by stop price, so each stop price keeps its own FIFO.
+type TriggerBook struct {
+	// Buy stops fire when the price rises to them: lowest stop first (ascending, like asks)
+	BuyStops *OrderBookSide
+	// Sell stops fire when the price falls to them: highest stop first (descending, like bids)
+	SellStops *OrderBookSide
+
+	Orders map[string]*Order
+}
+
+func NewTriggerBook() *TriggerBook {
+	return &TriggerBook{
+		BuyStops:  NewOrderBookSide(pbTypes.Side_SELL),
+		SellStops: NewOrderBookSide(pbTypes.Side_BUY),
+		Orders:    make(map[string]*Order),
+	}
+}
+
+func (tb *TriggerBook) sideFor(order *Order) *OrderBookSide {
+	if order.Side == pbTypes.Side_BUY {
+		return tb.BuyStops
+	}
+	return tb.SellStops
+}
+
+func (tb *TriggerBook) Add(order *Order) {
+	level := tb.sideFor(order).GetOrCreatePriceLevel(order.StopPrice)
+	level.Push(order)
+	tb.Orders[order.ClientOrderID] = order
+}
+
+// NextTriggered returns the highest priority stop order crossed by lastTradePrice, or nil.
+func (tb *TriggerBook) NextTriggered(lastTradePrice int64) *Order {
+	if lastTradePrice <= 0 {
+		return nil
+	}
+
+	if level := tb.BuyStops.BestPriceLevel; level != nil && level.Price <= lastTradePrice {
+		return level.HeadOrder
+	}
+
+	if level := tb.SellStops.BestPriceLevel; level != nil && level.Price >= lastTradePrice {
+		return level.HeadOrder
+	}
+
+	return nil
+}
+
+func isStopOrder(orderType pbTypes.OrderType) bool {
+	return orderType == pbTypes.OrderType_STOP_LIMIT || orderType == pbTypes.OrderType_STOP_MARKET
+}
+
+// triggeredOrderType is the order type a stop order converts into once its stop price is reached.
+func triggeredOrderType(orderType pbTypes.OrderType) pbTypes.OrderType {
+	if orderType == pbTypes.OrderType_STOP_MARKET {
+		return pbTypes.OrderType_MARKET
+	}
+	return pbTypes.OrderType_LIMIT
+}
+
+func (me *MatchingEngine) addStopOrder(order *Order) []*pb.EngineEvent {
+	if order.StopPrice <= 0 {
+		order.Status = pbTypes.OrderStatus_REJECTED
+		order.RejectReason = pbTypes.RejectReason_REJECT_REASON_INVALID_STOP_PRICE
+		order.StatusMessage = "Stop order rejected: stop price is required"
+
+		data, _ := EncodeOrderStatusEvent(order, StrPtr(""), false)
+		return []*pb.EngineEvent{
+			{
+				EventType: pbTypes.EventType_ORDER_REJECTED,
+				UserId:    order.UserID,
+				Data:      data,
+			},
+		}
+	}
+
+	order.Status = pbTypes.OrderStatus_PENDING
+	me.Stops.Add(order)
+	me.indexOrder(order)
+
+	// Encoded now: the order may trigger (and change type) before this message is done
+	data, _ := EncodeOrderStatusEvent(order, StrPtr(""), true)
+	return []*pb.EngineEvent{
+		{
+			EventType: pbTypes.EventType_ORDER_ACCEPTED,
+			UserId:    order.UserID,
+			Data:      data,
+		},
+	}
+}
+
+// processTriggers fires every stop order crossed by the last trade price. A triggered
+// order can trade and move the price again, so keep going until nothing is in range.
+func (me *MatchingEngine) processTriggers() []*pb.EngineEvent {
+	events := []*pb.EngineEvent{}
+
+	for {
+		order := me.Stops.NextTriggered(me.LastTradePrice)
+		if order == nil {
+			return events
+		}
+
+		me.removeFromBook(order)
+		order.Type = triggeredOrderType(order.Type)
+
+		_, triggerEvents := me.processOrder(order, pbTypes.EventType_ORDER_TRIGGERED)
+		events = append(events, triggerEvents...)
+	}
+}
+
+func triggerMessage(order *Order) string {
+	return fmt.Sprintf("Stop price %d reached", order.StopPrice)
+}
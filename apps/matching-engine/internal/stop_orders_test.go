@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+func stopOrder(id string, userID string, side pbTypes.Side, orderType pbTypes.OrderType, stopPrice int64, price int64, quantity int64) *Order {
+	return &Order{ClientOrderID: id, UserID: userID, Side: side, Type: orderType, StopPrice: stopPrice, Price: price, Quantity: quantity}
+}
+
+// triggeredIDs lists the orders of the ORDER_TRIGGERED events in the WAL of a stopped actor.
+func triggeredIDs(t *testing.T, a *SymbolActor) []string {
+	t.Helper()
+
+	ids := []string{}
+	for _, event := range walEvents(t, a) {
+		if event.GetEventType() != pbTypes.EventType_ORDER_TRIGGERED {
+			continue
+		}
+		var order pb.OrderStatusEvent
+		if err := proto.Unmarshal(event.GetData(), &order); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, order.GetOrderId())
+	}
+	return ids
+}
+
+func TestStopsTriggerInCascade(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("s1", "seller", pbTypes.Side_SELL, 101, 5))
+	placeTestOrder(t, a, limitOrder("s2", "seller", pbTypes.Side_SELL, 103, 5))
+	placeTestOrder(t, a, limitOrder("s3", "seller", pbTypes.Side_SELL, 106, 5))
+	placeTestOrder(t, a, stopOrder("st1", "u1", pbTypes.Side_BUY, pbTypes.OrderType_STOP_MARKET, 101, 0, 5))
+	placeTestOrder(t, a, stopOrder("st2", "u2", pbTypes.Side_BUY, pbTypes.OrderType_STOP_LIMIT, 103, 104, 5))
+	placeTestOrder(t, a, stopOrder("st3", "u3", pbTypes.Side_BUY, pbTypes.OrderType_STOP_LIMIT, 110, 110, 5))
+
+	// A sell stop reduced while it waits keeps its place and triggers with what is left
+	placeTestOrder(t, a, limitOrder("b1", "buyer", pbTypes.Side_BUY, 90, 10))
+	placeTestOrder(t, a, stopOrder("st4", "u4", pbTypes.Side_SELL, pbTypes.OrderType_STOP_LIMIT, 95, 90, 10))
+	modifyTestOrder(t, a, "st4", "u4", "st4-m", nil, int64Ptr(4))
+
+	if len(a.engine.Stops.Orders) != 4 {
+		t.Fatalf("%d stops wait", len(a.engine.Stops.Orders))
+	}
+
+	// 1 at 101 fires st1, whose 5 take the rest of s1 and 1 of s2 at 103, which fires st2:
+	// 4 more of s2 at 103 and 1 left resting at 104. st3 stays below 110.
+	placeTestOrder(t, a, marketOrder("m1", "taker", pbTypes.Side_BUY, 1))
+
+	if a.engine.LastTradePrice != 103 {
+		t.Fatalf("last trade %d", a.engine.LastTradePrice)
+	}
+	if st2 := a.engine.AllOrders["st2"]; st2 == nil || st2.Type != pbTypes.OrderType_LIMIT || st2.Price != 104 || st2.RemainingQuantity != 1 {
+		t.Fatalf("st2: %+v", st2)
+	}
+	if a.engine.AllOrders["s1"] != nil || a.engine.AllOrders["s2"] != nil || a.engine.AllOrders["st1"] != nil {
+		t.Fatal("s1, s2 and st1 should be filled")
+	}
+	if _, waiting := a.engine.Stops.Orders["st3"]; !waiting {
+		t.Fatal("st3 triggered")
+	}
+
+	// m2 takes what is left of st2 at 104 and 1 of b1 at 90, which fires st4 with its reduced
+	// 4: 4 more of b1
+	placeTestOrder(t, a, marketOrder("m2", "taker", pbTypes.Side_SELL, 2))
+	if b1 := a.engine.AllOrders["b1"]; b1 == nil || b1.RemainingQuantity != 5 || a.engine.AllOrders["st4"] != nil {
+		t.Fatalf("b1: %+v", b1)
+	}
+	stop()
+
+	if got := fmt.Sprint(triggeredIDs(t, a)); got != "[st1 st2 st4]" {
+		t.Fatalf("triggered %s", got)
+	}
+
+	live := checkBook(t, a.engine)
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
+
+func TestStopPlacedPastItsStopPriceTriggersAtOnce(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	// Without a trade yet there is no price to trigger against
+	placeTestOrder(t, a, stopOrder("early", "u1", pbTypes.Side_BUY, pbTypes.OrderType_STOP_LIMIT, 50, 99, 1))
+	if _, waiting := a.engine.Stops.Orders["early"]; !waiting {
+		t.Fatal("a stop triggered without a trade")
+	}
+
+	placeTestOrder(t, a, limitOrder("s1", "seller", pbTypes.Side_SELL, 100, 10))
+	placeTestOrder(t, a, limitOrder("b1", "buyer", pbTypes.Side_BUY, 100, 1))
+
+	// early fires with the trade at 100 and rests at 99
+	if early := a.engine.AllOrders["early"]; early == nil || early.Type != pbTypes.OrderType_LIMIT {
+		t.Fatalf("early: %+v", early)
+	}
+
+	// Buy stop below the last trade, sell stop above it
+	response := placeTestOrder(t, a, stopOrder("late-buy", "u2", pbTypes.Side_BUY, pbTypes.OrderType_STOP_MARKET, 90, 0, 2))
+	if response.Order.FilledQuantity != 2 || response.Order.Status != pbTypes.OrderStatus_FILLED {
+		t.Fatalf("late-buy: %v %d", response.Order.Status, response.Order.FilledQuantity)
+	}
+	placeTestOrder(t, a, stopOrder("late-sell", "u3", pbTypes.Side_SELL, pbTypes.OrderType_STOP_LIMIT, 110, 101, 3))
+	if late := a.engine.AllOrders["late-sell"]; late == nil || late.Price != 101 || late.RemainingQuantity != 3 {
+		t.Fatalf("late-sell: %+v", late)
+	}
+	if len(a.engine.Stops.Orders) != 0 {
+		t.Fatalf("%d stops still wait", len(a.engine.Stops.Orders))
+	}
+	stop()
+
+	if got := fmt.Sprint(triggeredIDs(t, a)); got != "[early late-buy late-sell]" {
+		t.Fatalf("triggered %s", got)
+	}
+
+	live := checkBook(t, a.engine)
+	if replayed := replayedBook(t, dir); replayed != live {
+		t.Fatalf("replayed book differs:\n%s\nlive:\n%s", replayed, live)
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+)
+
+/*
+==================================================================
+===================== Symbol Event Subscriptions =================
+==================================================================
+*/
+
+// Events a subscriber may fall behind by before its stream is ended
+const subscriberBufferSize = 4096
+
+// subscriber is one gateway's SubscribeSymbol stream. The actor only ever does a
+// non-blocking send into events, so a slow gateway cannot hold up the matching loop.
+type subscriber struct {
+	gatewayID string
+	events    chan *pb.EngineEvent
+
+	closeOnce sync.Once
+	done      chan struct{} // closed with err set when the stream has to end
+	err       error
+}
+
+func newSubscriber(gatewayID string) *subscriber {
+	return &subscriber{
+		gatewayID: gatewayID,
+		events:    make(chan *pb.EngineEvent, subscriberBufferSize),
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *subscriber) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// SubscribeMsg registers a subscriber from inside the actor loop, so the depth snapshot it
+// starts with and the events that follow are in actor order.
+type SubscribeMsg struct {
+	subscriber *subscriber
+	replay     chan struct{}
+}
+
+func (a *SymbolActor) addSubscriber(sub *subscriber) {
+	depth, err := a.engine.getDepthEvent()
+	if err != nil {
+		sub.close(err)
+		return
+	}
+	depth.Symbol = a.symbol
+	depth.EngineTimestamp = a.engine.timestamp()
+	sub.events <- depth
+
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	// A gateway that reconnects replaces its old stream
+	if previous, ok := a.subscribers[sub.gatewayID]; ok {
+		previous.close(fmt.Errorf("gateway %s subscribed to %s again", sub.gatewayID, a.symbol))
+	}
+	a.subscribers[sub.gatewayID] = sub
+}
+
+func (a *SymbolActor) removeSubscriber(sub *subscriber) {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	if a.subscribers[sub.gatewayID] == sub {
+		delete(a.subscribers, sub.gatewayID)
+	}
+}
+
+// broadcast hands an event to every subscriber. Runs inside the actor loop.
+func (a *SymbolActor) broadcast(event *pb.EngineEvent) {
+	a.subscribersMu.RLock()
+	defer a.subscribersMu.RUnlock()
+
+	for _, sub := range a.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.close(fmt.Errorf("gateway %s fell more than %d events behind on %s", sub.gatewayID, subscriberBufferSize, a.symbol))
+		}
+	}
+}
+
+// closeSubscribers ends every stream once the actor has stopped.
+func (a *SymbolActor) closeSubscribers() {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	for gatewayID, sub := range a.subscribers {
+		sub.close(fmt.Errorf("symbol %s was delisted", a.symbol))
+		delete(a.subscribers, gatewayID)
+	}
+}
+
+// SubscribeSymbol streams a symbol's events to send until ctx ends, the subscriber falls
+// behind or the symbol is delisted. The first event is a depth snapshot.
+func SubscribeSymbol(ctx context.Context, symbol string, gatewayID string, send func(*pb.EngineEvent) error) error {
+	if gatewayID == "" {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "gateway_id is required")
+	}
+
+	actor, err := lookupActor(symbol)
+	if err != nil {
+		return err
+	}
+
+	sub := newSubscriber(gatewayID)
+	replay := make(chan struct{}, 1)
+	if err := actor.send(ctx, SubscribeMsg{subscriber: sub, replay: replay}); err != nil {
+		return err
+	}
+	<-replay
+	defer actor.removeSubscriber(sub)
+
+	slog.Info("gateway subscribed", "symbol", symbol, "gatewayId", gatewayID)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-sub.done:
+			// What was buffered when the stream ended still goes out, e.g. the last events before a delist
+			for pending := len(sub.events); pending > 0; pending-- {
+				if err := send(<-sub.events); err != nil {
+					return err
+				}
+			}
+			return sub.err
+
+		case event := <-sub.events:
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+==================================================================
+=========================== 24h Ticker ===========================
+==================================================================
+*/
+
+const (
+	tickerWindow     = 24 * time.Hour
+	tickerBucketSize = time.Minute
+)
+
+// tickerBucket is the trades of one minute.
+type tickerBucket struct {
+	start  time.Time
+	open   int64
+	high   int64
+	low    int64
+	close  int64
+	volume int64
+}
+
+// tickerStats keeps the trades of the last 24h in minute buckets. Times come from the engine
+// clock, so replaying the WAL rebuilds the same buckets.
+type tickerStats struct {
+	buckets   []tickerBucket // oldest first
+	reference int64          // close of the last bucket that left the window, 0 = none
+}
+
+func newTickerStats() *tickerStats {
+	return &tickerStats{}
+}
+
+// prune drops the buckets that ended 24h or more before at.
+func (ts *tickerStats) prune(at time.Time) {
+	cutoff := at.Add(-tickerWindow)
+	expired := 0
+	for expired < len(ts.buckets) && !ts.buckets[expired].start.Add(tickerBucketSize).After(cutoff) {
+		ts.reference = ts.buckets[expired].close
+		expired++
+	}
+	ts.buckets = ts.buckets[expired:]
+}
+
+func (ts *tickerStats) observe(at time.Time, price int64, quantity int64) {
+	ts.prune(at)
+
+	start := at.Truncate(tickerBucketSize)
+	if n := len(ts.buckets); n > 0 && !ts.buckets[n-1].start.Before(start) {
+		bucket := &ts.buckets[n-1]
+		bucket.high = max(bucket.high, price)
+		bucket.low = min(bucket.low, price)
+		bucket.close = price
+		bucket.volume += quantity
+		return
+	}
+
+	ts.buckets = append(ts.buckets, tickerBucket{start: start, open: price, high: price, low: price, close: price, volume: quantity})
+}
+
+// open is the price 24h ago: the last trade before the window, else the first one in it.
+func (ts *tickerStats) open() int64 {
+	if ts.reference != 0 || len(ts.buckets) == 0 {
+		return ts.reference
+	}
+	return ts.buckets[0].open
+}
+
+func (ts *tickerStats) snapshot() ([]*pb.TickerBucket, int64) {
+	buckets := make([]*pb.TickerBucket, 0, len(ts.buckets))
+	for _, bucket := range ts.buckets {
+		buckets = append(buckets, &pb.TickerBucket{
+			Start:  timestamppb.New(bucket.start),
+			Open:   bucket.open,
+			High:   bucket.high,
+			Low:    bucket.low,
+			Close:  bucket.close,
+			Volume: bucket.volume,
+		})
+	}
+
+	return buckets, ts.reference
+}
+
+func (ts *tickerStats) restore(buckets []*pb.TickerBucket, reference int64) {
+	ts.reference = reference
+	ts.buckets = nil
+	for _, bucket := range buckets {
+		ts.buckets = append(ts.buckets, tickerBucket{
+			start:  bucket.GetStart().AsTime(),
+			open:   bucket.GetOpen(),
+			high:   bucket.GetHigh(),
+			low:    bucket.GetLow(),
+			close:  bucket.GetClose(),
+			volume: bucket.GetVolume(),
+		})
+	}
+}
+
+// tickerEvents closes the ticker of the current message: one TICKER when it traded or moved
+// the best displayed bid or ask.
+func (me *MatchingEngine) tickerEvents() []*pb.EngineEvent {
+	bid, _ := me.Bids.BestDisplayedPrice()
+	ask, _ := me.Asks.BestDisplayedPrice()
+	if me.TradeSequence == me.tickerTradeSequence && bid == me.tickerBid && ask == me.tickerAsk {
+		return nil
+	}
+
+	return []*pb.EngineEvent{me.tickerEvent()}
+}
+
+// tickerHeartbeat sends the ticker again when none went out for a heartbeat interval, so an
+// idle market still sees its 24h figures roll.
+func (me *MatchingEngine) tickerHeartbeat() []*pb.EngineEvent {
+	if me.tickerInterval <= 0 || me.now.Sub(me.lastTicker) < me.tickerInterval {
+		return nil
+	}
+
+	return []*pb.EngineEvent{me.tickerEvent()}
+}
+
+func (me *MatchingEngine) tickerEvent() *pb.EngineEvent {
+	me.stats.prune(me.now)
+
+	bid, _ := me.Bids.BestDisplayedPrice()
+	ask, _ := me.Asks.BestDisplayedPrice()
+	me.tickerTradeSequence, me.tickerBid, me.tickerAsk = me.TradeSequence, bid, ask
+	me.lastTicker = me.now
+
+	ticker := &pb.TickerEvent{
+		Symbol:    me.Symbol,
+		LastPrice: me.LastTradePrice,
+		BidPrice:  bid,
+		AskPrice:  ask,
+		Timestamp: me.timestamp(),
+	}
+
+	for i, bucket := range me.stats.buckets {
+		if i == 0 || bucket.high > ticker.High_24H {
+			ticker.High_24H = bucket.high
+		}
+		if i == 0 || bucket.low < ticker.Low_24H {
+			ticker.Low_24H = bucket.low
+		}
+		ticker.Volume_24H += bucket.volume
+	}
+
+	if open := me.stats.open(); open != 0 {
+		ticker.PriceChange_24H = me.LastTradePrice - open
+		ticker.PriceChangePercent_24H = ticker.PriceChange_24H * 10_000 / open
+	}
+
+	data, _ := proto.Marshal(ticker)
+	return &pb.EngineEvent{
+		EventType: pbTypes.EventType_TICKER,
+		Data:      data,
+	}
+}
+
+// tickerWorker asks the actor for a heartbeat ticker every interval.
+func (a *SymbolActor) tickerWorker() {
+	if a.engine.tickerInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.engine.tickerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.quit:
+			return
+
+		case <-ticker.C:
+			if err := a.send(context.Background(), TickerMsg{}); err != nil {
+				slog.Error("ticker heartbeat failed", "symbol", a.symbol, "err", err)
+			}
+		}
+	}
+}
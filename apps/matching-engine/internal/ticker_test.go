@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+)
+
+// bucketState prints the ticker buckets and the reference price.
+func bucketState(ts *tickerStats) string {
+	state := fmt.Sprintf("reference=%d", ts.reference)
+	for _, bucket := range ts.buckets {
+		state += fmt.Sprintf(" %s:%d/%d/%d/%d/%d", bucket.start.UTC().Format("02T15:04"), bucket.open, bucket.high, bucket.low, bucket.close, bucket.volume)
+	}
+	return state
+}
+
+func lastTicker(t *testing.T, sub *subscriber) *pb.TickerEvent {
+	t.Helper()
+
+	events := receivedEvents(sub, pbTypes.EventType_TICKER)
+	if len(events) == 0 {
+		t.Fatal("no ticker")
+	}
+	var ticker pb.TickerEvent
+	if err := proto.Unmarshal(events[len(events)-1].Data, &ticker); err != nil {
+		t.Fatal(err)
+	}
+	return &ticker
+}
+
+func TestTickerWindow(t *testing.T) {
+	t0 := time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC)
+	ts := newTickerStats()
+
+	ts.observe(t0, 100, 1)
+	ts.observe(t0.Add(30*time.Second), 110, 2)
+	ts.observe(t0.Add(time.Hour), 90, 1)
+	ts.observe(t0.Add(23*time.Hour+59*time.Minute), 95, 4)
+	if got := bucketState(ts); got != "reference=0 02T09:00:100/110/100/110/3 02T10:00:90/90/90/90/1 03T08:59:95/95/95/95/4" {
+		t.Fatalf("buckets %s", got)
+	}
+	if ts.open() != 100 {
+		t.Fatalf("open %d before any bucket left", ts.open())
+	}
+
+	// The 09:00 minute is still inside the window until it has fully passed 24h ago
+	ts.prune(t0.Add(tickerWindow))
+	if len(ts.buckets) != 3 {
+		t.Fatalf("pruned early: %s", bucketState(ts))
+	}
+	ts.prune(t0.Add(tickerWindow + tickerBucketSize))
+	if got := bucketState(ts); got != "reference=110 02T10:00:90/90/90/90/1 03T08:59:95/95/95/95/4" {
+		t.Fatalf("after 09:00 left %s", got)
+	}
+
+	// The open is the last trade before the window, not the first one inside it
+	if ts.open() != 110 {
+		t.Fatalf("open %d", ts.open())
+	}
+
+	// With every bucket gone the last close is still the open
+	ts.prune(t0.Add(2 * tickerWindow))
+	if got := bucketState(ts); got != "reference=95" || ts.open() != 95 {
+		t.Fatalf("after all left %s, open %d", got, ts.open())
+	}
+}
+
+func TestTickerEvents(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	clock := newTestClock()
+	a.engine.Clock = clock
+	a.engine.tickerInterval = time.Minute
+	sub := subscribeTestActor(a)
+	runTestActor(t, a)
+
+	trade := func(id string, price int64, quantity int64) {
+		placeTestOrder(t, a, limitOrder(id, "s", pbTypes.Side_SELL, price, quantity))
+		placeTestOrder(t, a, marketOrder(id+"-m", "b", pbTypes.Side_BUY, quantity))
+	}
+
+	trade("t1", 300, 2)
+	clock.Advance(time.Hour)
+	trade("t2", 310, 1)
+	clock.Advance(time.Hour)
+	trade("t3", 301, 3)
+
+	// 1 up on 300 is 33.3 basis points, rounded towards zero
+	ticker := lastTicker(t, sub)
+	if ticker.GetLastPrice() != 301 || ticker.GetHigh_24H() != 310 || ticker.GetLow_24H() != 300 || ticker.GetVolume_24H() != 6 {
+		t.Fatalf("ticker %v", ticker)
+	}
+	if ticker.GetPriceChange_24H() != 1 || ticker.GetPriceChangePercent_24H() != 33 {
+		t.Fatalf("change %d, %d bps", ticker.GetPriceChange_24H(), ticker.GetPriceChangePercent_24H())
+	}
+
+	// A resting order that moves the best bid sends one too
+	placeTestOrder(t, a, limitOrder("bid", "b", pbTypes.Side_BUY, 290, 1))
+	if ticker := lastTicker(t, sub); ticker.GetBidPrice() != 290 {
+		t.Fatalf("bid %d", ticker.GetBidPrice())
+	}
+
+	// A day after t1 only t2 and t3 are in the window, but t1's 300 is still the open
+	clock.Advance(22*time.Hour + tickerBucketSize)
+	heartbeat(t, a)
+	ticker = lastTicker(t, sub)
+	if ticker.GetVolume_24H() != 4 || ticker.GetLow_24H() != 301 || ticker.GetPriceChange_24H() != 1 || ticker.GetPriceChangePercent_24H() != 33 {
+		t.Fatalf("after t1 left: %v", ticker)
+	}
+
+	// Once t2 left too the open is its 310: down 9, -290 basis points
+	clock.Advance(time.Hour)
+	heartbeat(t, a)
+	ticker = lastTicker(t, sub)
+	if ticker.GetVolume_24H() != 3 || ticker.GetPriceChange_24H() != -9 || ticker.GetPriceChangePercent_24H() != -290 {
+		t.Fatalf("after t2 left: %v", ticker)
+	}
+
+	// With no trade in the window there is no range, and no change from the last price
+	clock.Advance(tickerWindow)
+	heartbeat(t, a)
+	ticker = lastTicker(t, sub)
+	if ticker.GetVolume_24H() != 0 || ticker.GetHigh_24H() != 0 || ticker.GetLow_24H() != 0 || ticker.GetPriceChange_24H() != 0 || ticker.GetLastPrice() != 301 {
+		t.Fatalf("idle: %v", ticker)
+	}
+}
+
+// heartbeat has the actor send a heartbeat ticker and waits until it went out.
+func heartbeat(t *testing.T, a *SymbolActor) {
+	t.Helper()
+
+	if err := a.send(context.Background(), TickerMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	replay := make(chan *pb.SymbolStatus, 1)
+	if err := a.send(context.Background(), StatusMsg{replay: replay}); err != nil {
+		t.Fatal(err)
+	}
+	<-replay
+}
+
+func TestTickerBucketsAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	clock := newTestClock()
+	a.engine.Clock = clock
+	stop := runTestActor(t, a)
+
+	for i, price := range []int64{100, 104, 98, 101, 99} {
+		placeTestOrder(t, a, limitOrder(fmt.Sprintf("s%d", i), "s", pbTypes.Side_SELL, price, int64(i+1)))
+		placeTestOrder(t, a, marketOrder(fmt.Sprintf("m%d", i), "b", pbTypes.Side_BUY, int64(i+1)))
+		clock.Advance(7 * time.Hour)
+
+		if i == 2 {
+			if err := a.snapshots.Write(takeTestSnapshot(t, a)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := bucketState(a.engine.stats)
+	stop()
+
+	// 100 left the window when 99 traded 28h after it
+	if want != "reference=100 02T16:00:104/104/104/104/2 02T23:00:98/98/98/98/3 03T06:00:101/101/101/101/4 03T13:00:99/99/99/99/5" {
+		t.Fatalf("live buckets %s", want)
+	}
+
+	// From the WAL alone, and from the snapshot taken after the third trade and the WAL tail
+	replayed := newTestActor(t, dir)
+	defer replayed.wal.Close()
+	if err := replayed.replayWal(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := bucketState(replayed.engine.stats); got != want {
+		t.Fatalf("replayed buckets %s\nwant %s", got, want)
+	}
+
+	recovered := newTestActor(t, dir)
+	defer recovered.wal.Close()
+	from, err := recovered.loadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from <= 1 {
+		t.Fatal("no snapshot")
+	}
+	if err := recovered.replayWal(from); err != nil {
+		t.Fatal(err)
+	}
+	if got := bucketState(recovered.engine.stats); got != want {
+		t.Fatalf("recovered buckets %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"fmt"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+)
+
+/*
+==================================================================
+================== Time In Force Management ======================
+==================================================================
+*/
+
+// checkTimeInForceValue turns away a time in force the engine does not know before the order
+// reaches the actor.
+func checkTimeInForceValue(order *Order) error {
+	if _, ok := pbTypes.TimeInForce_name[int32(order.TimeInForce)]; !ok {
+		return invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "unknown time in force %d", order.TimeInForce)
+	}
+	return nil
+}
+
+// checkTimeInForce runs the pre-match time-in-force rules. It may reprice a POST_ONLY_SLIDE
+// order and returns a reject reason and message when the order must not reach the matching loop.
+func (me *MatchingEngine) checkTimeInForce(order *Order) (pbTypes.RejectReason, string) {
+	oppositeBook := me.Asks
+	if order.Side == pbTypes.Side_SELL {
+		oppositeBook = me.Bids
+	}
+
+	switch order.TimeInForce {
+	case pbTypes.TimeInForce_POST_ONLY, pbTypes.TimeInForce_POST_ONLY_SLIDE:
+		if order.Type != pbTypes.OrderType_LIMIT {
+			return pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "Post-only order rejected: only LIMIT orders can be post-only"
+		}
+
+		if !me.CanMatch(oppositeBook, order) {
+			return pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, ""
+		}
+
+		if order.TimeInForce == pbTypes.TimeInForce_POST_ONLY {
+			return pbTypes.RejectReason_REJECT_REASON_WOULD_TAKE_LIQUIDITY, "Post-only order rejected: order would take liquidity"
+		}
+
+		// Slide to one tick behind the opposite best so the order rests as a maker
+		oldPrice := order.Price
+		if order.Side == pbTypes.Side_BUY {
+			order.Price = oppositeBook.BestPriceLevel.Price - me.Instrument.tickSize()
+		} else {
+			order.Price = oppositeBook.BestPriceLevel.Price + me.Instrument.tickSize()
+		}
+
+		if order.Price <= 0 {
+			return pbTypes.RejectReason_REJECT_REASON_WOULD_TAKE_LIQUIDITY, "Post-only order rejected: no valid price behind the opposite best price"
+		}
+		order.StatusMessage = fmt.Sprintf("Post-only order repriced from %d to %d", oldPrice, order.Price)
+
+	case pbTypes.TimeInForce_FOK:
+		if me.availableLiquidity(order) < order.RemainingQuantity {
+			return pbTypes.RejectReason_REJECT_REASON_FOK_NOT_FILLABLE, "FOK order rejected: not enough liquidity to fill the full quantity"
+		}
+	}
+
+	return pbTypes.RejectReason_REJECT_REASON_UNSPECIFIED, ""
+}
+
+// availableLiquidity is a dry run of the matching walk: it sums the opposite orders the order
+// could trade against, stopping as soon as the order's remaining quantity is covered.
+func (me *MatchingEngine) availableLiquidity(incoming *Order) int64 {
+	oppositeBook := me.Asks
+	if incoming.Side == pbTypes.Side_SELL {
+		oppositeBook = me.Bids
+	}
+
+	var available int64
+	for level := oppositeBook.BestPriceLevel; level != nil && available < incoming.RemainingQuantity; level = level.NextPrice {
+		if !crossesPrice(incoming, level.Price) {
+			break
+		}
+
+		// Pro-rata meets the whole level at once, so an own order anywhere in it ends the fill
+		if me.Matching.Algorithm != MatchingFIFO && incoming.SelfTradePrevention != pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST &&
+			me.selfTradeOrder(level, incoming) != nil {
+			return available
+		}
+
+		for order := level.HeadOrder; order != nil && available < incoming.RemainingQuantity; order = order.Next {
+			if order.UserID == incoming.UserID {
+				// Only STP_CANCEL_OLDEST walks past the user's own orders; every other mode ends the fill here
+				if incoming.SelfTradePrevention != pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST {
+					return available
+				}
+				continue
+			}
+			available += order.RemainingQuantity
+		}
+	}
+
+	return available
+}
+
+// cancelUnfilledRemainder applies the after-match rule for orders that must not rest:
+// MARKET orders and IOC / FOK limit orders. selfTraded tells that self-trade prevention took
+// resting orders out of the way during matching.
+func cancelUnfilledRemainder(order *Order, selfTraded bool) {
+	if order.RemainingQuantity == 0 || order.Status == pbTypes.OrderStatus_REJECTED {
+		return
+	}
+
+	reason := pbTypes.CancelReason_CANCEL_REASON_UNFILLED_REMAINDER
+
+	switch {
+	case order.Type == pbTypes.OrderType_MARKET && order.FilledQuantity == 0 && selfTraded:
+		// MatchOrder saw liquidity, but only the user's own orders, which STP removed
+		order.StatusMessage = "Market order cancelled: only the user's own orders were left to trade against"
+		reason = pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION
+
+	case order.Type == pbTypes.OrderType_MARKET && order.FilledQuantity == 0:
+		order.StatusMessage = "Market order cancelled: no liquidity left to fill it"
+
+	case order.Type == pbTypes.OrderType_MARKET:
+		order.StatusMessage = "Market order partially filled; remaining quantity cancelled"
+
+	case order.TimeInForce == pbTypes.TimeInForce_IOC || order.TimeInForce == pbTypes.TimeInForce_FOK:
+		order.StatusMessage = fmt.Sprintf("%s order remaining quantity cancelled", order.TimeInForce)
+
+	default:
+		return
+	}
+
+	order.Status = pbTypes.OrderStatus_CANCELLED
+	order.CancelReason = reason
+	order.CancelledQuantity += order.RemainingQuantity
+	order.RemainingQuantity = 0
+}
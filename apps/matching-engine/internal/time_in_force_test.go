@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func timeInForceOrder(id string, userID string, side pbTypes.Side, price int64, quantity int64, tif pbTypes.TimeInForce) *Order {
+	order := limitOrder(id, userID, side, price, quantity)
+	order.TimeInForce = tif
+	return order
+}
+
+func TestPostOnly(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	a.engine.Instrument = InstrumentSpec{TickSize: 5}
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("a1", "seller", pbTypes.Side_SELL, 100, 5))
+	placeTestOrder(t, a, limitOrder("b1", "buyer", pbTypes.Side_BUY, 90, 5))
+
+	// Resting below the ask is fine
+	res := placeTestOrder(t, a, timeInForceOrder("p1", "u", pbTypes.Side_BUY, 95, 2, pbTypes.TimeInForce_POST_ONLY))
+	if a.engine.AllOrders["p1"] == nil || len(res.Trades) != 0 {
+		t.Fatalf("p1: %+v", res.Order)
+	}
+
+	res = placeTestOrder(t, a, timeInForceOrder("p2", "u", pbTypes.Side_BUY, 100, 2, pbTypes.TimeInForce_POST_ONLY))
+	if res.Order.Status != pbTypes.OrderStatus_REJECTED || res.Order.RejectReason != pbTypes.RejectReason_REJECT_REASON_WOULD_TAKE_LIQUIDITY || len(res.Trades) != 0 {
+		t.Fatalf("p2: %+v", res.Order)
+	}
+
+	// Slides one tick behind the opposite best on either side
+	res = placeTestOrder(t, a, timeInForceOrder("s1", "u", pbTypes.Side_BUY, 110, 3, pbTypes.TimeInForce_POST_ONLY_SLIDE))
+	if a.engine.AllOrders["s1"] == nil || res.Order.Price != 95 || len(res.Trades) != 0 {
+		t.Fatalf("s1: %+v", res.Order)
+	}
+	if res.Order.StatusMessage != "Post-only order repriced from 110 to 95" {
+		t.Fatalf("s1 message %q", res.Order.StatusMessage)
+	}
+	res = placeTestOrder(t, a, timeInForceOrder("s2", "u", pbTypes.Side_SELL, 80, 3, pbTypes.TimeInForce_POST_ONLY_SLIDE))
+	if a.engine.AllOrders["s2"] == nil || res.Order.Price != 100 {
+		t.Fatalf("s2: %+v", res.Order)
+	}
+
+	// Post-only is for limit orders only
+	market := marketOrder("m1", "u", pbTypes.Side_BUY, 1)
+	market.TimeInForce = pbTypes.TimeInForce_POST_ONLY
+	res = placeTestOrder(t, a, market)
+	if res.Order.Status != pbTypes.OrderStatus_REJECTED || res.Order.RejectReason != pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST {
+		t.Fatalf("m1: %+v", res.Order)
+	}
+
+	if a.engine.TotalMatches != 0 {
+		t.Fatalf("%d matches", a.engine.TotalMatches)
+	}
+	want := checkBook(t, a.engine)
+	stop()
+
+	if got := replayedBook(t, dir); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFillOrKillDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    *Order
+		fillable bool
+	}{
+		// asks 100: other(3) own(4) ice(10, shows 2); 101: other2(5)
+		{"covered by the first level", timeInForceOrder("f", "other", pbTypes.Side_BUY, 100, 3, pbTypes.TimeInForce_FOK), true},
+		{"own order ends the fill", timeInForceOrder("f", "me", pbTypes.Side_BUY, 101, 4, pbTypes.TimeInForce_FOK), false},
+		{"cancel oldest walks past own order", func() *Order {
+			order := timeInForceOrder("f", "me", pbTypes.Side_BUY, 100, 13, pbTypes.TimeInForce_FOK)
+			order.SelfTradePrevention = pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST
+			return order
+		}(), true},
+		{"hidden iceberg quantity counts", timeInForceOrder("f", "other", pbTypes.Side_BUY, 100, 17, pbTypes.TimeInForce_FOK), true},
+		{"price limit stops the walk", timeInForceOrder("f", "other", pbTypes.Side_BUY, 100, 18, pbTypes.TimeInForce_FOK), false},
+		{"next level covers the rest", timeInForceOrder("f", "other", pbTypes.Side_BUY, 101, 22, pbTypes.TimeInForce_FOK), true},
+		{"not enough in the book", timeInForceOrder("f", "other", pbTypes.Side_BUY, 101, 23, pbTypes.TimeInForce_FOK), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := newTestActor(t, dir)
+			stop := runTestActor(t, a)
+
+			placeTestOrder(t, a, limitOrder("other", "o", pbTypes.Side_SELL, 100, 3))
+			placeTestOrder(t, a, limitOrder("own", "me", pbTypes.Side_SELL, 100, 4))
+			iceberg := limitOrder("ice", "o", pbTypes.Side_SELL, 100, 10)
+			iceberg.DisplayQuantity = 2
+			placeTestOrder(t, a, iceberg)
+			placeTestOrder(t, a, limitOrder("other2", "o", pbTypes.Side_SELL, 101, 5))
+
+			res := placeTestOrder(t, a, test.order)
+			if !test.fillable {
+				if res.Order.Status != pbTypes.OrderStatus_REJECTED || res.Order.RejectReason != pbTypes.RejectReason_REJECT_REASON_FOK_NOT_FILLABLE || len(res.Trades) != 0 {
+					t.Fatalf("%+v", res.Order)
+				}
+				if a.engine.TotalMatches != 0 || a.engine.Asks.BestPriceLevel.TotalVolume != 17 || len(a.engine.AllOrders) != 4 {
+					t.Fatalf("the dry run touched the book:\n%s", checkBook(t, a.engine))
+				}
+				return
+			}
+
+			if res.Order.Status != pbTypes.OrderStatus_FILLED || res.Order.FilledQuantity != test.order.Quantity {
+				t.Fatalf("%+v", res.Order)
+			}
+			want := checkBook(t, a.engine)
+			stop()
+
+			if got := replayedBook(t, dir); got != want {
+				t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestUnfilledRemainderIsCancelled(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestActor(t, dir)
+	stop := runTestActor(t, a)
+
+	placeTestOrder(t, a, limitOrder("a1", "seller", pbTypes.Side_SELL, 100, 3))
+	placeTestOrder(t, a, limitOrder("a2", "seller", pbTypes.Side_SELL, 102, 3))
+
+	// IOC takes what crosses and drops the rest instead of resting
+	res := placeTestOrder(t, a, timeInForceOrder("i1", "u", pbTypes.Side_BUY, 101, 5, pbTypes.TimeInForce_IOC))
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.FilledQuantity != 3 || res.Order.CancelledQuantity != 2 {
+		t.Fatalf("i1: %+v", res.Order)
+	}
+	if res.Order.CancelReason != pbTypes.CancelReason_CANCEL_REASON_UNFILLED_REMAINDER || a.engine.AllOrders["i1"] != nil {
+		t.Fatalf("i1 cancel reason %v", res.Order.CancelReason)
+	}
+
+	// A market order eats the book and cancels what is left
+	res = placeTestOrder(t, a, marketOrder("m1", "u", pbTypes.Side_BUY, 5))
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.FilledQuantity != 3 || res.Order.CancelledQuantity != 2 {
+		t.Fatalf("m1: %+v", res.Order)
+	}
+	if res.Order.CancelReason != pbTypes.CancelReason_CANCEL_REASON_UNFILLED_REMAINDER {
+		t.Fatalf("m1 cancel reason %v", res.Order.CancelReason)
+	}
+
+	// Facing only the user's own order, the market order is cancelled for self-trade prevention
+	placeTestOrder(t, a, limitOrder("own", "u", pbTypes.Side_SELL, 105, 4))
+	m2 := marketOrder("m2", "u", pbTypes.Side_BUY, 2)
+	m2.SelfTradePrevention = pbTypes.SelfTradePrevention_STP_CANCEL_OLDEST
+	res = placeTestOrder(t, a, m2)
+	if res.Order.Status != pbTypes.OrderStatus_CANCELLED || res.Order.CancelReason != pbTypes.CancelReason_CANCEL_REASON_SELF_TRADE_PREVENTION || a.engine.AllOrders["own"] != nil {
+		t.Fatalf("m2: %+v", res.Order)
+	}
+
+	want := checkBook(t, a.engine)
+	stop()
+
+	if got := replayedBook(t, dir); got != want {
+		t.Fatalf("replayed book\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnknownTimeInForceIsInvalidArgument(t *testing.T) {
+	a := newTestActor(t, t.TempDir())
+	runTestActor(t, a)
+	registerTestActor(t, a)
+
+	order := timeInForceOrder("o1", "u", pbTypes.Side_BUY, 100, 1, pbTypes.TimeInForce(99))
+	order.Symbol = testSymbol
+	order.RemainingQuantity = order.Quantity
+
+	_, err := PlaceOrder(context.Background(), order)
+	if status.Code(err) != codes.InvalidArgument || rejectReason(err) != pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST {
+		t.Fatalf("err %v", err)
+	}
+	if len(a.engine.AllOrders) != 0 {
+		t.Fatal("the order reached the book")
+	}
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+==================================================================
+======================= Circuit Breaker ==========================
+==================================================================
+*/
+
+// CircuitBreakerSpec halts a symbol when a trade moves more than MaxMoveBps away from the
+// price WindowMM earlier. A zero MaxMoveBps disables the breaker.
+type CircuitBreakerSpec struct {
+	MaxMoveBps int64 // 100 = 1%
+	WindowMM   int64
+
+	// State the breaker switches to; OPEN (the zero value) means HALTED
+	HaltState pbTypes.TradingState
+}
+
+func (spec CircuitBreakerSpec) Validate() error {
+	if spec.MaxMoveBps < 0 || spec.WindowMM < 0 {
+		return fmt.Errorf("circuit breaker settings cannot be negative")
+	}
+	if spec.MaxMoveBps > 0 && spec.WindowMM == 0 {
+		return fmt.Errorf("circuit breaker needs a window")
+	}
+	if _, ok := pbTypes.TradingState_name[int32(spec.HaltState)]; !ok {
+		return fmt.Errorf("unknown trading state %d", spec.HaltState)
+	}
+	return nil
+}
+
+func CircuitBreakerSpecFromProto(spec *pb.CircuitBreakerSpec) CircuitBreakerSpec {
+	return CircuitBreakerSpec{
+		MaxMoveBps: spec.GetMaxMoveBps(),
+		WindowMM:   spec.GetWindowMs(),
+		HaltState:  spec.GetHaltState(),
+	}
+}
+
+func (spec CircuitBreakerSpec) haltState() pbTypes.TradingState {
+	if spec.HaltState == pbTypes.TradingState_TRADING_STATE_OPEN {
+		return pbTypes.TradingState_TRADING_STATE_HALTED
+	}
+	return spec.HaltState
+}
+
+type pricePoint struct {
+	price int64
+	at    time.Time
+}
+
+// circuitBreaker keeps the trades of the last window. The reference is the last trade that
+// left the window, i.e. the price the market was at when the window started.
+type circuitBreaker struct {
+	spec      CircuitBreakerSpec
+	reference pricePoint
+	window    []pricePoint // oldest first
+}
+
+// breakerTrip is the first trade of a message that moved the price too far.
+type breakerTrip struct {
+	reference int64
+	price     int64
+}
+
+func newCircuitBreaker(spec CircuitBreakerSpec) *circuitBreaker {
+	return &circuitBreaker{spec: spec}
+}
+
+func (cb *circuitBreaker) enabled() bool {
+	return cb.spec.MaxMoveBps > 0
+}
+
+// observe records a trade and reports whether it moved too far from the reference price.
+// Times come from the engine clock, so replay rebuilds the same window.
+func (cb *circuitBreaker) observe(at time.Time, price int64) (int64, bool) {
+	if !cb.enabled() {
+		return 0, false
+	}
+
+	cutoff := at.Add(-time.Duration(cb.spec.WindowMM) * time.Millisecond)
+	expired := 0
+	for expired < len(cb.window) && !cb.window[expired].at.After(cutoff) {
+		cb.reference = cb.window[expired]
+		expired++
+	}
+	cb.window = cb.window[expired:]
+
+	reference := cb.reference.price
+	if reference == 0 && len(cb.window) > 0 {
+		reference = cb.window[0].price
+	}
+
+	cb.window = append(cb.window, pricePoint{price: price, at: at})
+
+	if reference == 0 {
+		return 0, false
+	}
+
+	move := price - reference
+	if move < 0 {
+		move = -move
+	}
+	return reference, move*10_000 > reference*cb.spec.MaxMoveBps
+}
+
+// reset starts measuring from price again, e.g. when trading reopens after a halt.
+func (cb *circuitBreaker) reset(at time.Time, price int64) {
+	cb.reference = pricePoint{price: price, at: at}
+	cb.window = nil
+}
+
+func (cb *circuitBreaker) snapshot() (*pb.PricePoint, []*pb.PricePoint) {
+	window := make([]*pb.PricePoint, 0, len(cb.window))
+	for _, point := range cb.window {
+		window = append(window, &pb.PricePoint{Price: point.price, Timestamp: timestamppb.New(point.at)})
+	}
+
+	return &pb.PricePoint{Price: cb.reference.price, Timestamp: timestamppb.New(cb.reference.at)}, window
+}
+
+func (cb *circuitBreaker) restore(reference *pb.PricePoint, window []*pb.PricePoint) {
+	cb.reference = pricePoint{price: reference.GetPrice(), at: reference.GetTimestamp().AsTime()}
+	cb.window = nil
+	for _, point := range window {
+		cb.window = append(cb.window, pricePoint{price: point.GetPrice(), at: point.GetTimestamp().AsTime()})
+	}
+}
+
+/*
+==================================================================
+====================== Trading State Management ==================
+==================================================================
+*/
+
+// SetTradingState switches the symbol on an admin command. It is the only way out of an
+// auction: the engine has no timer, so the uncross runs when this call moves the symbol on.
+func (me *MatchingEngine) SetTradingState(state pbTypes.TradingState, reason string) (*pb.SetTradingStateResponse, []*pb.EngineEvent, error) {
+	if _, ok := pbTypes.TradingState_name[int32(state)]; !ok {
+		return nil, nil, invalidArgument(pbTypes.RejectReason_REJECT_REASON_INVALID_REQUEST, "unknown trading state %d", state)
+	}
+
+	response := &pb.SetTradingStateResponse{Symbol: me.Symbol, State: state, PreviousState: me.TradingState}
+	if state == me.TradingState {
+		return response, nil, nil
+	}
+
+	// Leaving an auction executes it before the new state applies
+	var events []*pb.EngineEvent
+	if me.TradingState == pbTypes.TradingState_TRADING_STATE_AUCTION {
+		events = me.uncross()
+	}
+
+	events = append(events, me.changeTradingState(state, reason, nil))
+
+	// Stops crossed while the symbol was not open (or by the uncross) fire once it reopens
+	if state == pbTypes.TradingState_TRADING_STATE_OPEN {
+		events = append(events, me.processTriggers()...)
+		events = append(events, me.applyCircuitBreaker()...)
+	}
+
+	return response, events, nil
+}
+
+// applyCircuitBreaker halts the symbol if a trade of the current message tripped the breaker.
+// The message itself completes first, so the book is never left half-matched.
+func (me *MatchingEngine) applyCircuitBreaker() []*pb.EngineEvent {
+	trip := me.trip
+	me.trip = nil
+
+	if trip == nil || me.TradingState != pbTypes.TradingState_TRADING_STATE_OPEN {
+		return nil
+	}
+
+	reason := fmt.Sprintf("Circuit breaker: price moved from %d to %d", trip.reference, trip.price)
+	return []*pb.EngineEvent{me.changeTradingState(me.breaker.spec.haltState(), reason, trip)}
+}
+
+func (me *MatchingEngine) changeTradingState(state pbTypes.TradingState, reason string, trip *breakerTrip) *pb.EngineEvent {
+	event := &pb.TradingStateEvent{
+		Symbol:         me.Symbol,
+		State:          state,
+		PreviousState:  me.TradingState,
+		Reason:         reason,
+		CircuitBreaker: trip != nil,
+		Timestamp:      me.timestamp(),
+	}
+	if trip != nil {
+		event.ReferencePrice = trip.reference
+		event.TriggerPrice = trip.price
+	}
+
+	me.applyTradingState(state)
+
+	data, _ := proto.Marshal(event)
+	return &pb.EngineEvent{
+		EventType: pbTypes.EventType_TRADING_STATE_CHANGED,
+		Data:      data,
+	}
+}
+
+// applyTradingState is shared by live changes and replay. Reopening measures the breaker
+// from the last trade price again, so the move that caused a halt cannot trip it twice.
+func (me *MatchingEngine) applyTradingState(state pbTypes.TradingState) {
+	if state == pbTypes.TradingState_TRADING_STATE_AUCTION && me.TradingState != state {
+		me.AuctionNumber++
+	}
+	me.TradingState = state
+
+	if state == pbTypes.TradingState_TRADING_STATE_OPEN {
+		me.breaker.reset(me.now, me.LastTradePrice)
+	}
+}
+
+// checkTradingState returns a reject message when the current state does not accept order.
+func (me *MatchingEngine) checkTradingState(order *Order) string {
+	switch me.TradingState {
+	case pbTypes.TradingState_TRADING_STATE_HALTED:
+		return fmt.Sprintf("Trading in %s is halted", me.Symbol)
+
+	case pbTypes.TradingState_TRADING_STATE_CANCEL_ONLY:
+		return fmt.Sprintf("%s is cancel-only: new orders are not accepted", me.Symbol)
+
+	case pbTypes.TradingState_TRADING_STATE_POST_ONLY:
+		if order.Type != pbTypes.OrderType_LIMIT {
+			return fmt.Sprintf("%s is post-only: only LIMIT orders are accepted", me.Symbol)
+		}
+
+		// A POST_ONLY_SLIDE order is repriced behind the opposite best instead
+		if order.TimeInForce != pbTypes.TimeInForce_POST_ONLY_SLIDE && me.wouldTake(order, order.Price) {
+			return fmt.Sprintf("%s is post-only: order would take liquidity", me.Symbol)
+		}
+
+	case pbTypes.TradingState_TRADING_STATE_AUCTION:
+		return checkAuctionOrder(order)
+	}
+
+	return ""
+}
+
+// checkModifyTradingState allows what the state allows: nothing when halted, only in-place
+// reductions when cancel-only, and no replacement that would take liquidity when post-only.
+func (me *MatchingEngine) checkModifyTradingState(order *Order, replace bool, newPrice *int64) error {
+	switch me.TradingState {
+	case pbTypes.TradingState_TRADING_STATE_HALTED:
+		return failedPrecondition(pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, "trading in %s is halted", me.Symbol)
+
+	case pbTypes.TradingState_TRADING_STATE_CANCEL_ONLY:
+		if replace {
+			return failedPrecondition(pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, "%s is cancel-only: only quantity reductions are accepted", me.Symbol)
+		}
+
+	case pbTypes.TradingState_TRADING_STATE_POST_ONLY:
+		price := order.Price
+		if newPrice != nil {
+			price = *newPrice
+		}
+		if replace && me.wouldTake(order, price) {
+			return failedPrecondition(pbTypes.RejectReason_REJECT_REASON_TRADING_STATE, "%s is post-only: replacement would take liquidity", me.Symbol)
+		}
+	}
+
+	return nil
+}
+
+func (me *MatchingEngine) wouldTake(order *Order, price int64) bool {
+	oppositeBook := me.Asks
+	if order.Side == pbTypes.Side_SELL {
+		oppositeBook = me.Bids
+	}
+
+	probe := *order
+	probe.Price = price
+	return me.CanMatch(oppositeBook, &probe)
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	pbTypes "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
 	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
 	"google.golang.org/protobuf/proto"
 )
@@ -9,17 +10,27 @@ func StrPtr(s string) *string {
 	return &s
 }
 
-func EncodeOrderStatusEvent(order *Order, statusMessage *string, isAcceptEvent bool) ([]byte, error) {
-	data := &pb.OrderStatusEvent{
-		OrderId:       order.ClientOrderID,
-		UserId:        order.UserID,
-		Symbol:        order.Symbol,
-		Status:        order.Status,
-		StatusMessage: statusMessage,
-		Side:          order.Side,
-		Type:          order.Type,
+func NewOrderStatusEvent(order *Order) *pb.OrderStatusEvent {
+	return &pb.OrderStatusEvent{
+		OrderId:             order.ClientOrderID,
+		UserId:              order.UserID,
+		Symbol:              order.Symbol,
+		Status:              order.Status,
+		StatusMessage:       StrPtr(order.StatusMessage),
+		Side:                order.Side,
+		Type:                order.Type,
+		TimeInForce:         order.TimeInForce,
+		SelfTradePrevention: order.SelfTradePrevention,
+		CancelReason:        order.CancelReason,
+		RejectReason:        order.RejectReason,
+		DisplayQuantity:     order.DisplayQuantity,
+		Hidden:              order.Hidden,
+		VisibleQuantity:     order.VisibleQuantity,
+		ClientModifyId:      order.ClientModifyID,
+		ReplacedOrderId:     order.ReplacedOrderID,
 
 		Price:         order.Price,
+		StopPrice:     order.StopPrice,
 		ExecutedValue: order.ExecutedValue,
 		AveragePrice:  order.AveragePrice,
 
@@ -32,9 +43,48 @@ func EncodeOrderStatusEvent(order *Order, statusMessage *string, isAcceptEvent b
 		ClientTimestamp:  order.ClientTimestamp,
 		EngineTimestamp:  order.EngineTimestamp,
 	}
+}
+
+func OrderFromStatusEvent(event *pb.OrderStatusEvent) *Order {
+	return &Order{
+		Symbol:              event.Symbol,
+		Status:              event.Status,
+		StatusMessage:       event.GetStatusMessage(),
+		UserID:              event.UserId,
+		ClientOrderID:       event.OrderId,
+		Side:                event.Side,
+		Type:                event.Type,
+		TimeInForce:         event.TimeInForce,
+		SelfTradePrevention: event.SelfTradePrevention,
+		CancelReason:        event.CancelReason,
+		RejectReason:        event.RejectReason,
+		DisplayQuantity:     event.DisplayQuantity,
+		Hidden:              event.Hidden,
+		VisibleQuantity:     event.VisibleQuantity,
+		ClientModifyID:      event.ClientModifyId,
+		ReplacedOrderID:     event.ReplacedOrderId,
+
+		Price:         event.Price,
+		StopPrice:     event.StopPrice,
+		AveragePrice:  event.AveragePrice,
+		ExecutedValue: event.ExecutedValue,
+
+		Quantity:          event.Quantity,
+		FilledQuantity:    event.FilledQuantity,
+		RemainingQuantity: event.RemainingQuantity,
+		CancelledQuantity: event.CancelledQuantity,
+
+		ClientTimestamp:  event.ClientTimestamp,
+		GatewayTimestamp: event.GatewayTimestamp,
+		EngineTimestamp:  event.EngineTimestamp,
+	}
+}
+
+func EncodeOrderStatusEvent(order *Order, statusMessage *string, isAcceptEvent bool) ([]byte, error) {
+	data := NewOrderStatusEvent(order)
 
-	if data.StatusMessage == nil || *data.StatusMessage == "" {
-		data.StatusMessage = &order.StatusMessage
+	if statusMessage != nil && *statusMessage != "" {
+		data.StatusMessage = statusMessage
 	}
 
 	if isAcceptEvent {
@@ -43,6 +93,9 @@ func EncodeOrderStatusEvent(order *Order, statusMessage *string, isAcceptEvent b
 		data.RemainingQuantity = order.Quantity
 		data.ExecutedValue = 0
 		data.AveragePrice = 0
+		if order.isIceberg() {
+			data.VisibleQuantity = min(order.DisplayQuantity, order.Quantity)
+		}
 	}
 
 	eventByte, err := proto.Marshal(data)
@@ -53,29 +106,15 @@ func EncodeOrderStatusEvent(order *Order, statusMessage *string, isAcceptEvent b
 	return eventByte, nil
 }
 
-func EncodeOrderReducedEvent(order *Order, oldQuantity int64, newQuantity int64, oldRemainingQuantiy int64, newRemainingQuantiy int64, newCancelledQuantity int64, oldCancelledQuantity int64) ([]byte, error) {
+// EncodeOrderReducedEvent carries why the quantity was taken out in reason and statusMessage,
+// so a self-trade reduction is told apart from a user's modify.
+func EncodeOrderReducedEvent(order *Order, reason pbTypes.CancelReason, statusMessage *string, oldQuantity int64, newQuantity int64, oldRemainingQuantiy int64, newRemainingQuantiy int64, newCancelledQuantity int64, oldCancelledQuantity int64) ([]byte, error) {
+	data := NewOrderStatusEvent(order)
+	data.CancelReason = reason
+	data.StatusMessage = statusMessage
+
 	eventByte, err := proto.Marshal(&pb.OrderReducedEvent{
-		Order: &pb.OrderStatusEvent{
-			OrderId: order.ClientOrderID,
-			UserId:  order.UserID,
-			Symbol:  order.Symbol,
-			Status:  order.Status,
-			Side:    order.Side,
-			Type:    order.Type,
-
-			Price:         order.Price,
-			ExecutedValue: order.ExecutedValue,
-			AveragePrice:  order.AveragePrice,
-
-			Quantity:          order.Quantity,
-			FilledQuantity:    order.FilledQuantity,
-			RemainingQuantity: order.RemainingQuantity,
-			CancelledQuantity: order.CancelledQuantity,
-
-			GatewayTimestamp: order.GatewayTimestamp,
-			ClientTimestamp:  order.ClientTimestamp,
-			EngineTimestamp:  order.EngineTimestamp,
-		},
+		Order:                data,
 		OldQuantity:          oldQuantity,
 		NewQuantity:          newQuantity,
 		OldRemainingQuantity: oldRemainingQuantiy,
@@ -103,6 +142,7 @@ func EncodeTradeEvent(trade *Trade) ([]byte, error) {
 		SellOrderId:   trade.SellOrderID,
 		IsBuyerMaker:  trade.IsBuyerMaker,
 		Timestamp:     trade.Timeline,
+		Auction:       trade.Auction,
 	})
 	if err != nil {
 		return nil, err
@@ -120,16 +120,115 @@ func OpenWAL(dir string, symbol string, maxFileSize int64, enableFsync bool, syn
 		cancel:              cancel,
 	}
 
-	offset, err := wal.findLastSequenceNumber(file.Name())
+	segments, err := wal.listSegments()
 	if err != nil {
 		return nil, err
 	}
+
+	// The newest segment can be empty right after a rotation, so walk back until an entry is found
+	var offset uint64
+	for i := len(segments) - 1; i >= 0 && offset == 0; i-- {
+		offset, err = wal.findLastSequenceNumber(wal.segmentPath(segments[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
 	wal.nextOffset = offset + 1
 
 	// go wal.keepSyncing()
 	return wal, nil
 }
 
+func (sw *SymbolWAL) segmentPath(index int) string {
+	return filepath.Join(sw.dirPath, fmt.Sprintf("%d.log", index))
+}
+
+// listSegments returns the segment indexes in numeric order ("10.log" must come after "9.log").
+func (sw *SymbolWAL) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(sw.dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		indexStr, exists := strings.CutSuffix(entry.Name(), ".log")
+		if !exists {
+			continue
+		}
+
+		index, err := strconv.Atoi(indexStr)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, index)
+	}
+
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// LastSequenceNumber returns the sequence number of the last entry written to the WAL.
+func (sw *SymbolWAL) LastSequenceNumber() uint64 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return sw.nextOffset - 1
+}
+
+// advanceTo makes sure the next entry is numbered at least `next`. Needed when the
+// segments holding the newest entries were already released after a snapshot.
+func (sw *SymbolWAL) advanceTo(next uint64) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.nextOffset < next {
+		sw.nextOffset = next
+	}
+}
+
+// DeleteSegmentsUpTo removes closed segments whose entries all have a sequence number <= seq.
+// The active segment is never removed.
+func (sw *SymbolWAL) DeleteSegmentsUpTo(seq uint64) (int, error) {
+	sw.mu.Lock()
+	currentSegmentIndex := sw.currentSegmentIndex
+	sw.mu.Unlock()
+
+	segments, err := sw.listSegments()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, index := range segments {
+		if index >= currentSegmentIndex {
+			break
+		}
+
+		path := sw.segmentPath(index)
+		lastEntry, err := sw.findLastEntryInLog(path)
+		if err != nil {
+			return deleted, err
+		}
+
+		if lastEntry != nil && lastEntry.GetSequenceNumber() > seq {
+			break
+		}
+
+		if err := os.Remove(path); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
 // WriteEntry writes an entry to the WAL.
 func (wal *SymbolWAL) WriteEntry(data []byte) error {
 	return wal.writeEntry(data)
@@ -225,18 +324,39 @@ func (sw *SymbolWAL) resetTimer() {
 }
 
 func (sw *SymbolWAL) keepSyncing() {
-	for range sw.syncTimer.C {
+	for {
+		select {
+		case <-sw.ctx.Done():
+			return
 
-		sw.mu.Lock()
-		err := sw.Sync()
-		sw.mu.Unlock()
+		case <-sw.syncTimer.C:
+			sw.mu.Lock()
+			err := sw.Sync()
+			sw.mu.Unlock()
 
-		if err != nil {
-			log.Printf("Error while performing sync: %v", err)
+			if err != nil {
+				log.Printf("Error while performing sync: %v", err)
+			}
 		}
 	}
 }
 
+// Close flushes what is buffered and closes the active segment. keepSyncing stops with it.
+func (sw *SymbolWAL) Close() error {
+	sw.cancel()
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	err := sw.Sync()
+	sw.syncTimer.Stop()
+	if err != nil {
+		return err
+	}
+
+	return sw.currentSegmentFile.Close()
+}
+
 func (sw *SymbolWAL) findLastSequenceNumber(filename string) (uint64, error) {
 	entry, err := sw.findLastEntryInLog(filename)
 	if err != nil {
@@ -316,24 +436,15 @@ func (sw *SymbolWAL) ReadFromTo(from, to uint64) ([]*pbTypes.WAL_Entry, error) {
 		return nil, fmt.Errorf("invalid range: from > to")
 	}
 
-	entries, err := os.ReadDir(sw.dirPath)
+	segments, err := sw.listSegments()
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
-
 	results := make([]*pbTypes.WAL_Entry, 0, to-from+1)
 
-	for _, dirEntry := range entries {
-		if dirEntry.IsDir() || !strings.Contains(dirEntry.Name(), ".log") {
-			continue
-		}
-
-		path := filepath.Join(sw.dirPath, dirEntry.Name())
-		file, err := os.Open(path)
+	for _, index := range segments {
+		file, err := os.Open(sw.segmentPath(index))
 		if err != nil {
 			return nil, err
 		}
@@ -379,25 +490,15 @@ func (sw *SymbolWAL) ReadFromTo(from, to uint64) ([]*pbTypes.WAL_Entry, error) {
 }
 
 func (sw *SymbolWAL) ReadFromToLast(from uint64) ([]*pbTypes.WAL_Entry, error) {
-	entries, err := os.ReadDir(sw.dirPath)
+	segments, err := sw.listSegments()
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
-
 	results := make([]*pbTypes.WAL_Entry, 0, 1_000_000)
 
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.Contains(entry.Name(), ".log") {
-			continue
-		}
-
-		filePath := filepath.Join(sw.dirPath, entry.Name())
-
-		file, err := os.Open(filePath)
+	for _, index := range segments {
+		file, err := os.Open(sw.segmentPath(index))
 		if err != nil {
 			return nil, err
 		}
@@ -78,8 +78,9 @@ export class OrderServerController {
 
       callback(
         {
-          code: grpc.status.INTERNAL,
+          code: (error as grpc.ServiceError).code ?? grpc.status.INTERNAL,
           message: err.message,
+          metadata: (error as grpc.ServiceError).metadata,
           name: "CreateOrderError",
         } as grpc.ServiceError,
         null,
@@ -127,8 +128,9 @@ export class OrderServerController {
 
       callback(
         {
-          code: grpc.status.INTERNAL,
+          code: (error as grpc.ServiceError).code ?? grpc.status.INTERNAL,
           message: err.message,
+          metadata: (error as grpc.ServiceError).metadata,
           name: "CancelOrderError",
         } as grpc.ServiceError,
         null,
@@ -183,8 +185,9 @@ export class OrderServerController {
 
       callback(
         {
-          code: grpc.status.INTERNAL,
+          code: (error as grpc.ServiceError).code ?? grpc.status.INTERNAL,
           message: err.message,
+          metadata: (error as grpc.ServiceError).metadata,
           name: "ModifyOrderError",
         } as grpc.ServiceError,
         null,
@@ -47,6 +47,11 @@ func depthKey(symbol string) string  { return "depth:" + strings.ToUpper(symbol)
 func tickerKey(symbol string) string { return "ticker:" + strings.ToUpper(symbol) }
 func orderKey(userID string) string  { return "order:" + userID }
 
+func tradingStateKey(symbol string) string { return "trading_state:" + strings.ToUpper(symbol) }
+func auctionKey(symbol string) string      { return "auction:" + strings.ToUpper(symbol) }
+func depthDiffKey(symbol string) string    { return "depth_diff:" + strings.ToUpper(symbol) }
+func l3Key(symbol string) string           { return "l3:" + strings.ToUpper(symbol) }
+
 func parseKeyParts(key string) (symbol, timeframe string) {
 	parts := strings.SplitN(key, ":", 3)
 	if len(parts) != 3 {
@@ -14,6 +14,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 	pbType "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/common"
+	pb "github.com/sameerkrdev/nerve/packages/proto-defs/go/generated/engine"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -42,9 +44,13 @@ type WSGateway struct {
 	upgrader     websocket.Upgrader
 	redis        *redis.Client
 
-	depth  *fanoutStream
-	ticker *fanoutStream
-	candle *fanoutStream
+	depth        *fanoutStream
+	depthDiff    *fanoutStream
+	l3           *fanoutStream
+	ticker       *fanoutStream
+	candle       *fanoutStream
+	tradingState *fanoutStream
+	auction      *fanoutStream
 
 	connectedUsersMu sync.RWMutex
 	connectedUsers   map[string]*User
@@ -66,6 +72,14 @@ func NewWSGateway(redisClient *redis.Client, jwtPublicKey *rsa.PublicKey) *WSGat
 		func(_ string, data []byte) (*Event, error) {
 			return &Event{EventType: pbType.EventType_DEPTH, Data: data}, nil
 		})
+	wsg.depthDiff = newFanoutStream(ctx, redisClient, "depth_diff", depthDiffKey,
+		func(_ string, data []byte) (*Event, error) {
+			return &Event{EventType: pbType.EventType_DEPTH_DIFF, Data: data}, nil
+		})
+	wsg.l3 = newFanoutStream(ctx, redisClient, "l3", l3Key,
+		func(_ string, data []byte) (*Event, error) {
+			return &Event{EventType: pbType.EventType_L3, Data: data}, nil
+		})
 	wsg.ticker = newFanoutStream(ctx, redisClient, "ticker", tickerKey,
 		func(_ string, data []byte) (*Event, error) {
 			return &Event{EventType: pbType.EventType_TICKER, Data: data}, nil
@@ -73,6 +87,19 @@ func NewWSGateway(redisClient *redis.Client, jwtPublicKey *rsa.PublicKey) *WSGat
 	wsg.candle = newFanoutStream(ctx, redisClient, "candle",
 		func(key string) string { return key },
 		makeCandleEvent)
+	wsg.tradingState = newFanoutStream(ctx, redisClient, "trading_state", tradingStateKey,
+		func(_ string, data []byte) (*Event, error) {
+			return &Event{EventType: pbType.EventType_TRADING_STATE_CHANGED, Data: data}, nil
+		})
+	// Indicative and uncross results share the channel, so it carries whole engine events
+	wsg.auction = newFanoutStream(ctx, redisClient, "auction", auctionKey,
+		func(_ string, data []byte) (*Event, error) {
+			var engineEvent pb.EngineEvent
+			if err := proto.Unmarshal(data, &engineEvent); err != nil {
+				return nil, err
+			}
+			return &Event{EventType: engineEvent.EventType, Data: engineEvent.Data}, nil
+		})
 
 	return wsg
 }
@@ -144,8 +171,12 @@ func (wsg *WSGateway) deregisterUser(user *User) {
 	wsg.connectedUsersMu.Unlock()
 
 	wsg.depth.removeUser(user)
+	wsg.depthDiff.removeUser(user)
+	wsg.l3.removeUser(user)
 	wsg.ticker.removeUser(user)
 	wsg.candle.removeUser(user)
+	wsg.tradingState.removeUser(user)
+	wsg.auction.removeUser(user)
 	wsg.stopOrderStream(user)
 
 	slog.Info("user disconnected", "id", user.ID)
@@ -184,7 +215,10 @@ func (wsg *WSGateway) handleMessage(user *User, raw []byte) {
 
 	switch base.Action {
 	case "subscribe_depth", "unsubscribe_depth",
-		"subscribe_ticker", "unsubscribe_ticker":
+		"subscribe_depth_diff", "unsubscribe_depth_diff",
+		"subscribe_l3", "unsubscribe_l3",
+		"subscribe_ticker", "unsubscribe_ticker",
+		"subscribe_auction", "unsubscribe_auction":
 		var msg symbolMsg
 		if err := json.Unmarshal(raw, &msg); err != nil || msg.Symbol == "" {
 			return
@@ -194,12 +228,38 @@ func (wsg *WSGateway) handleMessage(user *User, raw []byte) {
 			wsg.depth.subscribe(user, msg.Symbol)
 		case "unsubscribe_depth":
 			wsg.depth.unsubscribe(user, msg.Symbol)
+		case "subscribe_depth_diff":
+			wsg.depthDiff.subscribe(user, msg.Symbol)
+		case "unsubscribe_depth_diff":
+			wsg.depthDiff.unsubscribe(user, msg.Symbol)
+		case "subscribe_l3":
+			wsg.l3.subscribe(user, msg.Symbol)
+		case "unsubscribe_l3":
+			wsg.l3.unsubscribe(user, msg.Symbol)
 		case "subscribe_ticker":
 			wsg.ticker.subscribe(user, msg.Symbol)
 		case "unsubscribe_ticker":
 			wsg.ticker.unsubscribe(user, msg.Symbol)
+		case "subscribe_auction":
+			wsg.auction.subscribe(user, msg.Symbol)
+		case "unsubscribe_auction":
+			wsg.auction.unsubscribe(user, msg.Symbol)
 		}
 
+	case "subscribe_trading_state":
+		var msg symbolMsg
+		if err := json.Unmarshal(raw, &msg); err != nil || msg.Symbol == "" {
+			return
+		}
+		wsg.tradingState.subscribe(user, msg.Symbol)
+		wsg.sendTradingState(user, msg.Symbol)
+	case "unsubscribe_trading_state":
+		var msg symbolMsg
+		if err := json.Unmarshal(raw, &msg); err != nil || msg.Symbol == "" {
+			return
+		}
+		wsg.tradingState.unsubscribe(user, msg.Symbol)
+
 	case "subscribe_orders":
 		wsg.startOrderStream(user)
 	case "unsubscribe_orders":
@@ -220,3 +280,18 @@ func (wsg *WSGateway) handleMessage(user *User, raw []byte) {
 		}
 	}
 }
+
+// sendTradingState sends the last state change of a symbol, so a new subscriber knows the
+// current state without waiting for the next change. Nothing is sent for a symbol that has
+// never changed state, i.e. one that is OPEN.
+func (wsg *WSGateway) sendTradingState(user *User, symbol string) {
+	data, err := wsg.redis.Get(wsg.ctx, tradingStateKey(symbol)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Warn("fetching trading state failed", "symbol", symbol, "err", err)
+		}
+		return
+	}
+
+	user.emit(&Event{EventType: pbType.EventType_TRADING_STATE_CHANGED, Data: data})
+}
@@ -100,7 +100,8 @@ func (u *User) dispatch(event *Event) error {
 	case pbType.EventType_ORDER_ACCEPTED,
 		pbType.EventType_ORDER_CANCELLED,
 		pbType.EventType_ORDER_FILLED,
-		pbType.EventType_ORDER_REJECTED:
+		pbType.EventType_ORDER_REJECTED,
+		pbType.EventType_ORDER_TRIGGERED:
 		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.OrderStatusEvent{})
 
 	case pbType.EventType_ORDER_REDUCED:
@@ -112,8 +113,20 @@ func (u *User) dispatch(event *Event) error {
 	case pbType.EventType_DEPTH:
 		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.DepthEvent{})
 
+	case pbType.EventType_DEPTH_DIFF:
+		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.DepthDiffEvent{})
+
+	case pbType.EventType_L3:
+		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.L3Event{})
+
 	case pbType.EventType_TICKER:
 		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.TickerEvent{})
+
+	case pbType.EventType_TRADING_STATE_CHANGED:
+		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.TradingStateEvent{})
+
+	case pbType.EventType_AUCTION_INDICATIVE, pbType.EventType_AUCTION_UNCROSSED:
+		return u.sendProtoJSON(event.EventType.String(), event.Data, &pb.AuctionEvent{})
 	}
 
 	return nil
@@ -1,5 +1,6 @@
 const KAFKA_TOPICS = {
   ENGINE_EVENTS: "matching-engine.events",
+  ENGINE_L3: "matching-engine.l3",
   CANDLES: "candle-service.candles",
   PAYMENTS: "payments",
   USERS: "users",